@@ -0,0 +1,190 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// cfgURL is the url of the config managed centrally, merged over the config file.
+var cfgURL string
+
+// cfgURLCache is the copy of the last config fetched from the url, used when the url fails.
+var cfgURLCache string
+
+const remoteConfigTimeout = 30 * time.Second
+
+// defaultRemoteConfigCache return the path of the cached copy in the cache directory of the user,
+// empty to disable it when the user has none.
+func defaultRemoteConfigCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "iptv-proxy", "remote-config.json")
+}
+
+// remoteConfigTypes is the config type by content type, the url extension is used for the others.
+var remoteConfigTypes = map[string]string{
+	"application/json":   "json",
+	"application/yaml":   "yaml",
+	"application/x-yaml": "yaml",
+	"text/yaml":          "yaml",
+	"text/x-yaml":        "yaml",
+	"application/toml":   "toml",
+}
+
+// mergeRemoteConfig fetch the config from the url and merge it, the cached copy is merged
+// instead when the url fails or serves an invalid config.
+func mergeRemoteConfig() error {
+	settings, err := fetchRemoteConfig()
+	if err == nil {
+		return viper.MergeConfigMap(settings)
+	}
+
+	cached, cacheErr := readRemoteConfigCache()
+	if cacheErr != nil {
+		return fmt.Errorf("config url %s: %w, no cached copy: %s", cfgURL, err, cacheErr)
+	}
+	fmt.Printf("config url %s: %s, using the cached copy %s\n", cfgURL, err, cfgURLCache)
+
+	return viper.MergeConfigMap(cached)
+}
+
+// fetchRemoteConfig download and parse the config, then keep a copy of it.
+func fetchRemoteConfig() (map[string]interface{}, error) {
+	client := &http.Client{Timeout: remoteConfigTimeout}
+	resp, err := client.Get(cfgURL)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	configType := remoteConfigType(resp.Header.Get("Content-Type"))
+	settings, err := parseConfig(body, configType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeRemoteConfigCache(settings); err != nil {
+		fmt.Printf("config url cache %s: %s\n", cfgURLCache, err)
+	}
+
+	return settings, nil
+}
+
+// remoteConfigType return the type of the config served with the content type.
+func remoteConfigType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if configType, ok := remoteConfigTypes[mediaType]; ok {
+			return configType
+		}
+	}
+
+	ext := strings.TrimPrefix(path.Ext(strings.SplitN(cfgURL, "?", 2)[0]), ".")
+	for _, supported := range viper.SupportedExts {
+		if ext == supported {
+			return ext
+		}
+	}
+
+	return "yaml"
+}
+
+// parseConfig parse the config apart from the loaded one, so that an invalid config changes nothing.
+func parseConfig(body []byte, configType string) (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigType(configType)
+	if err := v.ReadConfig(bytes.NewReader(body)); err != nil {
+		return nil, fmt.Errorf("invalid %s config: %w", configType, err)
+	}
+
+	return v.AllSettings(), nil
+}
+
+// writeRemoteConfigCache replace the cached copy, kept as json whatever the type served.
+func writeRemoteConfigCache(settings map[string]interface{}) error {
+	if cfgURLCache == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the config holds the credentials, the copy is readable by the user only
+	dir := filepath.Dir(cfgURLCache)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// created 0600, an older copy is replaced with its mode
+	tmp, err := os.CreateTemp(dir, filepath.Base(cfgURLCache)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), cfgURLCache)
+}
+
+func readRemoteConfigCache() (map[string]interface{}, error) {
+	if cfgURLCache == "" {
+		return nil, fmt.Errorf("disabled")
+	}
+
+	b, err := os.ReadFile(filepath.Clean(cfgURLCache))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(b, "json")
+}
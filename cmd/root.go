@@ -24,10 +24,12 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
 
 	"github.com/romaxa55/iptv-proxy/pkg/server"
 
@@ -38,68 +40,44 @@ import (
 
 var cfgFile string
 
+// cfgMergeFiles are the config files merged in order over the config file.
+var cfgMergeFiles []string
+
+// baseConfigFile is the config file found, read again before the merged ones on a reload.
+var baseConfigFile string
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "iptv-proxy",
 	Short: "Reverse proxy on iptv m3u file and xtream codes server api",
 	Run: func(cmd *cobra.Command, args []string) {
-		// Запуск housekeeper в горутине
-		go housekeeper()
-		m3uURL := viper.GetString("m3u-url")
-		remoteHostURL, err := url.Parse(m3uURL)
+		logLevel, err := logger.ParseLevel(viper.GetString("log-level"))
 		if err != nil {
 			log.Fatal(err)
 		}
+		logger.SetLevel(logLevel)
 
-		xtreamUser := viper.GetString("xtream-user")
-		xtreamPassword := viper.GetString("xtream-password")
-		xtreamBaseURL := viper.GetString("xtream-base-url")
-
-		var username, password string
-		if strings.Contains(m3uURL, "/get.php") {
-			username = remoteHostURL.Query().Get("username")
-			password = remoteHostURL.Query().Get("password")
-		}
-
-		if xtreamBaseURL == "" && xtreamPassword == "" && xtreamUser == "" {
-			if username != "" && password != "" {
-				log.Printf("[iptv-proxy] INFO: It's seams you are using an Xtream provider!")
-
-				xtreamUser = username
-				xtreamPassword = password
-				xtreamBaseURL = fmt.Sprintf("%s://%s", remoteHostURL.Scheme, remoteHostURL.Host)
-				log.Printf("[iptv-proxy] INFO: xtream service enable with xtream base url: %q xtream username: %q xtream password: %q", xtreamBaseURL, xtreamUser, xtreamPassword)
+		if logFile := viper.GetString("log-file"); logFile != "" {
+			f, err := logger.OpenFile(logFile, viper.GetInt("log-max-size-mb"), viper.GetDuration("log-max-age"))
+			if err != nil {
+				log.Fatal(err)
 			}
+			logger.SetOutput(f)
 		}
 
-		conf := &config.ProxyConfig{
-			HostConfig: &config.HostConfiguration{
-				Hostname: viper.GetString("hostname"),
-				Port:     viper.GetInt("port"),
-			},
-			RemoteURL:            remoteHostURL,
-			XtreamUser:           config.CredentialString(xtreamUser),
-			XtreamPassword:       config.CredentialString(xtreamPassword),
-			XtreamBaseURL:        xtreamBaseURL,
-			M3UCacheExpiration:   viper.GetInt("m3u-cache-expiration"),
-			User:                 config.CredentialString(viper.GetString("user")),
-			Password:             config.CredentialString(viper.GetString("password")),
-			AdvertisedPort:       viper.GetInt("advertised-port"),
-			HTTPS:                viper.GetBool("https"),
-			M3UFileName:          viper.GetString("m3u-file-name"),
-			CustomEndpoint:       viper.GetString("custom-endpoint"),
-			CustomId:             viper.GetString("custom-id"),
-			XtreamGenerateApiGet: viper.GetBool("xtream-api-get"),
-		}
+		// Запуск housekeeper в горутине
+		go housekeeper()
 
-		if conf.AdvertisedPort == 0 {
-			conf.AdvertisedPort = conf.HostConfig.Port
+		conf, err := loadConfig()
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		server, err := server.NewServer(conf)
 		if err != nil {
 			log.Fatal(err)
 		}
+		server.SetConfigLoader(reloadConfig)
 
 		if e := server.Serve(); e != nil {
 			log.Fatal(e)
@@ -108,6 +86,288 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// loadConfig build the proxy configuration from the flags, the environment and the config file.
+func loadConfig() (*config.ProxyConfig, error) {
+	if _, err := logger.ParseLevel(viper.GetString("log-level")); err != nil {
+		return nil, err
+	}
+
+	m3uURL := viper.GetString("m3u-url")
+	remoteHostURL, err := url.Parse(m3uURL)
+	if err != nil {
+		return nil, err
+	}
+
+	xtreamUser := viper.GetString("xtream-user")
+	xtreamPassword := viper.GetString("xtream-password")
+	xtreamBaseURL := viper.GetString("xtream-base-url")
+
+	var username, password string
+	if strings.Contains(m3uURL, "/get.php") {
+		username = remoteHostURL.Query().Get("username")
+		password = remoteHostURL.Query().Get("password")
+	}
+
+	if xtreamBaseURL == "" && xtreamPassword == "" && xtreamUser == "" {
+		if username != "" && password != "" {
+			logger.Infof("It's seams you are using an Xtream provider!")
+
+			xtreamUser = username
+			xtreamPassword = password
+			xtreamBaseURL = fmt.Sprintf("%s://%s", remoteHostURL.Scheme, remoteHostURL.Host)
+			logger.Infof("xtream service enable with xtream base url: %q xtream username: %q xtream password: %q", xtreamBaseURL, xtreamUser, xtreamPassword)
+		}
+	}
+
+	downloadDirMode, err := parseFileMode("download-dir-mode")
+	if err != nil {
+		return nil, err
+	}
+	downloadFileMode, err := parseFileMode("download-file-mode")
+	if err != nil {
+		return nil, err
+	}
+
+	hostConcurrency, err := parseHostConcurrency("upstream-host-concurrency-by-host")
+	if err != nil {
+		return nil, err
+	}
+
+	tagFilters, err := parseTagFilters("tag-filter")
+	if err != nil {
+		return nil, err
+	}
+	tagExclude, err := parseTagFilters("tag-exclude")
+	if err != nil {
+		return nil, err
+	}
+
+	timeshiftBuffers, err := parseDurationsByName("timeshift-buffer-by-channel")
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &config.ProxyConfig{
+		HostConfig: &config.HostConfiguration{
+			Hostname:   viper.GetString("hostname"),
+			Port:       viper.GetInt("port"),
+			UnixSocket: viper.GetString("unix-socket"),
+		},
+		RemoteURL:            remoteHostURL,
+		XtreamUser:           config.CredentialString(xtreamUser),
+		XtreamPassword:       config.CredentialString(xtreamPassword),
+		XtreamBaseURL:        xtreamBaseURL,
+		M3UCacheExpiration:   viper.GetInt("m3u-cache-expiration"),
+		User:                 config.CredentialString(viper.GetString("user")),
+		Password:             config.CredentialString(viper.GetString("password")),
+		AdvertisedPort:       viper.GetInt("advertised-port"),
+		HTTPS:                viper.GetBool("https"),
+		M3UFileName:          viper.GetString("m3u-file-name"),
+		CustomEndpoint:       viper.GetString("custom-endpoint"),
+		CustomId:             viper.GetString("custom-id"),
+		URLIndexEncoding:     viper.GetString("url-index-encoding"),
+		XtreamGenerateApiGet: viper.GetBool("xtream-api-get"),
+		EpgURL:               viper.GetString("epg-url"),
+
+		CircuitBreakerThreshold: viper.GetInt("circuit-breaker-threshold"),
+		CircuitBreakerCooldown:  viper.GetDuration("circuit-breaker-cooldown"),
+
+		HDHomeRun:           viper.GetBool("hdhomerun"),
+		HDHomeRunTunerCount: viper.GetInt("hdhomerun-tuner-count"),
+
+		Enigma2ServiceType: viper.GetInt("enigma2-service-type"),
+
+		AvailabilityCacheTTL: viper.GetDuration("availability-cache-ttl"),
+
+		HLSRewriteDepth:    viper.GetInt("hls-rewrite-depth"),
+		HLSSegmentRefresh:  viper.GetBool("hls-segment-refresh"),
+		SegmentPassthrough: viper.GetBool("segment-passthrough"),
+
+		UpstreamInsecureSkipVerify: viper.GetBool("upstream-insecure-skip-verify"),
+
+		ChannelHeadersFile: viper.GetString("channel-headers-file"),
+
+		URLSigningSecret: viper.GetString("url-signing-secret"),
+		URLSignTTL:       viper.GetDuration("url-sign-ttl"),
+
+		SkippedTracksFile: viper.GetString("skipped-tracks-file"),
+
+		PlaylistFetchHeaders: viper.GetStringMapString("playlist-fetch-headers"),
+
+		HLSMasterBandwidth:  viper.GetInt("hls-master-bandwidth"),
+		HLSMasterResolution: viper.GetString("hls-master-resolution"),
+
+		Favicon: viper.GetBool("favicon"),
+
+		DirectPlay: viper.GetStringSlice("direct-play"),
+
+		Metrics: viper.GetBool("metrics"),
+
+		LogLevel: viper.GetString("log-level"),
+
+		TranscodeCommand:  viper.GetString("transcode-command"),
+		TranscodeChannels: viper.GetStringSlice("transcode-channels"),
+
+		PlaylistRefreshInterval: viper.GetDuration("playlist-refresh-interval"),
+
+		MaxConcurrentStreams: viper.GetInt("max-concurrent-streams"),
+
+		TrustedNetworks: viper.GetStringSlice("trusted-networks"),
+
+		StreamHeartbeat: viper.GetDuration("stream-heartbeat"),
+
+		DownloadDirMode:  downloadDirMode,
+		DownloadFileMode: downloadFileMode,
+
+		SelfTest: viper.GetBool("self-test"),
+
+		UpstreamMirrorsFile: viper.GetString("upstream-mirrors-file"),
+
+		SegmentCacheControl:       viper.GetString("segment-cache-control"),
+		SegmentCacheControlByType: viper.GetStringMapString("segment-cache-control-by-type"),
+
+		FailOnEmptyPlaylist: viper.GetBool("fail-on-empty-playlist"),
+
+		IndexPage: viper.GetBool("index-page"),
+
+		UpstreamProxyURL: viper.GetString("upstream-proxy-url"),
+
+		NamedUpstreams: viper.GetStringMapString("named-upstreams"),
+
+		ChannelMetadataTTL: viper.GetDuration("channel-metadata-ttl"),
+
+		TrailingSlash: viper.GetString("trailing-slash"),
+
+		CompressSegments: viper.GetBool("compress-segments"),
+
+		NotFoundSegment: viper.GetString("not-found-segment"),
+
+		PlaylistWorkers: viper.GetInt("playlist-workers"),
+
+		SegmentFilename: viper.GetString("segment-filename"),
+
+		LogoMaxWidth:  viper.GetInt("logo-max-width"),
+		LogoMaxHeight: viper.GetInt("logo-max-height"),
+
+		ChannelNameFormat: viper.GetString("channel-name-format"),
+
+		StaleWhileRevalidate: viper.GetDuration("stale-while-revalidate"),
+
+		PlaylistFetchTimeout: viper.GetDuration("playlist-fetch-timeout"),
+
+		WatchPlaylistFile: viper.GetBool("watch-playlist-file"),
+
+		KodiPVR: viper.GetBool("kodi-pvr"),
+
+		CoalesceSegments: viper.GetBool("coalesce-segments"),
+
+		UpstreamRateLimitBackoff: viper.GetDuration("upstream-rate-limit-backoff"),
+
+		ForceStreamContentType:     viper.GetString("force-stream-content-type"),
+		StreamContentTypeByChannel: viper.GetStringMapString("stream-content-type-by-channel"),
+
+		PlaylistChunkSize: viper.GetInt("playlist-chunk-size"),
+
+		TvgIDMap:     viper.GetStringMapString("tvg-id-map"),
+		TvgIDMapFile: viper.GetString("tvg-id-map-file"),
+
+		ProtectPlaylist: viper.GetBool("protect-playlist"),
+
+		GroupNormalization: viper.GetStringSlice("group-normalization"),
+
+		MDNSEnabled: viper.GetBool("mdns"),
+
+		LogFile:      viper.GetString("log-file"),
+		LogMaxSizeMB: viper.GetInt("log-max-size-mb"),
+		LogMaxAge:    viper.GetDuration("log-max-age"),
+
+		StreamIdleTimeout:             viper.GetDuration("stream-idle-timeout"),
+		XtreamExpiryWarning:           viper.GetDuration("xtream-expiry-warning"),
+		XtreamFallbackToM3U:           viper.GetBool("xtream-fallback-m3u"),
+		URLBlacklist:                  viper.GetStringSlice("url-blacklist"),
+		TvgShift:                      viper.GetString("tvg-shift"),
+		TvgShiftByGroup:               viper.GetStringMapString("tvg-shift-by-group"),
+		SegmentStoreEndpoint:          viper.GetString("segment-store-endpoint"),
+		SegmentStoreBucket:            viper.GetString("segment-store-bucket"),
+		SegmentStoreRegion:            viper.GetString("segment-store-region"),
+		SegmentStoreAccessKey:         config.CredentialString(viper.GetString("segment-store-access-key")),
+		SegmentStoreSecretKey:         config.CredentialString(viper.GetString("segment-store-secret-key")),
+		UpstreamHostConcurrency:       viper.GetInt("upstream-host-concurrency"),
+		UpstreamHostConcurrencyByHost: hostConcurrency,
+		MaxRequestDuration:            viper.GetDuration("max-request-duration"),
+		PlaylistFileCache:             viper.GetBool("playlist-file-cache"),
+		PlaylistRefreshRetries:        viper.GetInt("playlist-refresh-retries"),
+		PlaylistRefreshRetryDelay:     viper.GetDuration("playlist-refresh-retry-delay"),
+		DisabledChannelsFile:          viper.GetString("disabled-channels-file"),
+		SegmentPrefetch:               viper.GetInt("segment-prefetch"),
+		TagFilters:                    tagFilters,
+		TagExclude:                    tagExclude,
+		MaintenanceRetryAfter:         viper.GetDuration("maintenance-retry-after"),
+		PlaylistFilename:              viper.GetString("playlist-filename"),
+		PlaylistDisposition:           viper.GetString("playlist-disposition"),
+		DetectStreamType:              viper.GetBool("detect-stream-type"),
+		HLSEndList:                    viper.GetString("hls-endlist"),
+		ClientAllowlist:               viper.GetStringSlice("client-allowlist"),
+		ClientDenylist:                viper.GetStringSlice("client-denylist"),
+		TrustedProxies:                viper.GetStringSlice("trusted-proxies"),
+		TimeshiftBufferByChannel:      timeshiftBuffers,
+		TimeshiftDir:                  viper.GetString("timeshift-dir"),
+		TimeshiftMaxSizeMB:            viper.GetInt("timeshift-max-size-mb"),
+		EmptyPlaylistStatus:           viper.GetInt("empty-playlist-status"),
+		MaxSegmentBytes:               viper.GetInt64("max-segment-bytes"),
+		PlaylistMergeSources:          viper.GetStringSlice("m3u-merge-url"),
+		PlaylistMergeDuplicates:       viper.GetString("merge-duplicates"),
+		PlaylistFetchConcurrency:      viper.GetInt("playlist-fetch-concurrency"),
+	}
+
+	// an advertised port set to 0 leaves the port out of the urls
+	if !viper.IsSet("advertised-port") {
+		conf.AdvertisedPort = conf.HostConfig.Port
+	}
+
+	return conf, nil
+}
+
+// reloadConfig read the config files again and build the proxy configuration from them.
+func reloadConfig() (*config.ProxyConfig, error) {
+	if err := readConfigFiles(); err != nil {
+		return nil, err
+	}
+
+	return loadConfig()
+}
+
+// readConfigFiles read the config file, merge the config of the url over it,
+// then the override files in order:
+// the maps are merged key by key, the lists and the other values are replaced.
+func readConfigFiles() error {
+	if baseConfigFile != "" {
+		viper.SetConfigFile(baseConfigFile)
+	}
+
+	err := viper.ReadInConfig()
+	if err == nil {
+		baseConfigFile = viper.ConfigFileUsed()
+	} else if len(cfgMergeFiles) == 0 && cfgURL == "" {
+		return err
+	}
+
+	if cfgURL != "" {
+		if err := mergeRemoteConfig(); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range cfgMergeFiles {
+		viper.SetConfigFile(file)
+		if err := viper.MergeInConfig(); err != nil {
+			return fmt.Errorf("config file %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -124,12 +384,17 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "iptv-proxy-config", "C", "Config file (default is $HOME/.iptv-proxy.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgURL, "iptv-proxy-config-url", "", "Url of a config managed centrally, merged over the config file and fetched again on a reload")
+	rootCmd.PersistentFlags().StringVar(&cfgURLCache, "iptv-proxy-config-url-cache", defaultRemoteConfigCache(), "Copy of the last valid config fetched from the url, used when the url fails, readable by the user only (empty to disable, disabled by default without a user cache directory)")
+	rootCmd.PersistentFlags().StringSliceVar(&cfgMergeFiles, "iptv-proxy-config-merge", nil, "Config files merged in order over the config file, e.g. per environment overrides: the maps are merged key by key, the lists and the other values are replaced")
 	rootCmd.Flags().StringP("m3u-url", "u", "", `Iptv m3u file or url e.g: "http://example.com/iptv.m3u"`)
 	rootCmd.Flags().StringP("m3u-file-name", "", "iptv.m3u", `Name of the new proxified m3u file e.g "http://poxy.com/iptv.m3u"`)
 	rootCmd.Flags().StringP("custom-endpoint", "", "", `Custom endpoint "http://poxy.com/<custom-endpoint>/iptv.m3u"`)
 	rootCmd.Flags().StringP("custom-id", "", "", `Custom anti-collison ID for each track "http://proxy.com/<custom-id>/..."`)
+	rootCmd.Flags().String("url-index-encoding", "decimal", `Encoding of the track index in the proxyfied urls: "decimal", "base62" or "hash" (stable across playlist reordering)`)
 	rootCmd.Flags().Int("port", 8080, "Iptv-proxy listening port")
-	rootCmd.Flags().Int("advertised-port", 0, "Port to expose the IPTV file and xtream (by default, it's taking value from port) useful to put behind a reverse proxy")
+	rootCmd.Flags().String("unix-socket", "", "Unix socket path to listen on instead of the tcp port")
+	rootCmd.Flags().Int("advertised-port", 0, "Port to expose the IPTV file and xtream (by default, it's taking value from port) useful to put behind a reverse proxy, left out of the urls when it is 0 or the default port of the scheme")
 	rootCmd.Flags().String("hostname", "", "Hostname or IP to expose the IPTVs endpoints")
 	rootCmd.Flags().BoolP("https", "", false, "Activate https for urls proxy")
 	rootCmd.Flags().String("user", "usertest", "User auth to access proxy (m3u/xtream)")
@@ -139,6 +404,107 @@ func init() {
 	rootCmd.Flags().String("xtream-base-url", "", "Xtream-code base url e.g(http://expample.tv:8080)")
 	rootCmd.Flags().Int("m3u-cache-expiration", 1, "M3U cache expiration in hour")
 	rootCmd.Flags().BoolP("xtream-api-get", "", false, "Generate get.php from xtream API instead of get.php original endpoint")
+	rootCmd.Flags().Int("circuit-breaker-threshold", 5, "Consecutive upstream failures before fast failing the requests to that host (0 to disable)")
+	rootCmd.Flags().Duration("circuit-breaker-cooldown", 30*time.Second, "Time to wait before probing again a failing upstream host")
+	rootCmd.Flags().String("epg-url", "", `XMLTV epg file or url served on "http://proxy.com/epg.xml", an empty epg listing the playlist channels is served when not set`)
+	rootCmd.Flags().Bool("hdhomerun", false, "Emulate an HDHomeRun tuner (discover.json, lineup.json...) for Plex and DVRs, lineup is served without credentials to the trusted networks only")
+	rootCmd.Flags().Int("hdhomerun-tuner-count", 1, "Number of tuners advertised by the HDHomeRun emulation")
+	rootCmd.Flags().Int("enigma2-service-type", 4097, `Service type of the Enigma2 bouquet "http://proxy.com/userbouquet.tv" (4097 gstreamer, 5001 exteplayer3, 5002 gstplayer)`)
+	rootCmd.Flags().Duration("availability-cache-ttl", 10*time.Second, "How long the availability and metadata of an upstream hls channel are reused (0 to disable)")
+	rootCmd.Flags().Int("hls-rewrite-depth", 0, "Serve the hls channels by rewriting their playlists on demand instead of transcoding them with ffmpeg, number of nested playlist levels (master, media) whose uris go through the proxy (0 to transcode)")
+	rootCmd.Flags().Bool("hls-segment-refresh", true, "Fetch again the playlist of a rewritten hls segment whose url answers 403 or 410, for the providers with expiring segment tokens")
+	rootCmd.Flags().Bool("segment-passthrough", false, "Rewrite only the hls playlists through the proxy, the segment urls point at the upstream (implies --hls-rewrite-depth 2 when it is 0)")
+	rootCmd.Flags().Bool("upstream-insecure-skip-verify", false, "Do not verify the upstream TLS certificates (self-signed or misconfigured providers), insecure")
+	rootCmd.Flags().String("channel-headers-file", "", `Json file of the headers sent to the upstream by tvg-id or channel name, "*" for all the channels`)
+	rootCmd.Flags().String("url-signing-secret", "", "Secret used to sign the proxyfied stream urls with an expiry, unsigned urls are rejected when set")
+	rootCmd.Flags().Duration("url-sign-ttl", 24*time.Hour, "Validity of the signed stream urls")
+	rootCmd.Flags().String("skipped-tracks-file", "", "Json file where the tracks skipped from the proxyfied playlist are reported with the reason, rewritten on each generation")
+	rootCmd.Flags().StringToString("playlist-fetch-headers", nil, "Headers sent when downloading the m3u playlist, e.g. Authorization=Bearer xxx")
+	rootCmd.Flags().Int("hls-master-bandwidth", 2000000, "BANDWIDTH attribute of the channels in the combined hls master playlist")
+	rootCmd.Flags().String("hls-master-resolution", "", "RESOLUTION attribute of the channels in the combined hls master playlist, e.g. 1280x720")
+	rootCmd.Flags().Bool("favicon", true, "Answer the browsers /favicon.ico requests with an empty response instead of a 404")
+	rootCmd.Flags().StringSlice("direct-play", nil, "Groups, channel names or tvg-ids kept with their upstream url in the generated playlists")
+	rootCmd.Flags().Bool("metrics", false, "Serve the prometheus metrics on /metrics")
+	rootCmd.Flags().String("log-level", "info", "Minimum level of the logged messages: debug, info (the requests), warn or error")
+	rootCmd.Flags().String("transcode-command", "", "Command the streams of the transcoded channels are piped through (stdin to stdout), {url} and {name} are replaced by the upstream url and the channel name, e.g. \"ffmpeg -i pipe:0 -c:v libx264 -c:a aac -f mpegts pipe:1\"")
+	rootCmd.Flags().StringSlice("transcode-channels", nil, "Groups, channel names or tvg-ids transcoded with the transcode command")
+	rootCmd.Flags().Duration("playlist-refresh-interval", 0, "Interval between the downloads of the m3u playlist to pick up the upstream changes (0 to never refresh)")
+	rootCmd.Flags().Int("max-concurrent-streams", 0, "Maximum of streams served at the same time, the next ones are answered 503, set it to the upstream subscription limit (0 for no limit)")
+	rootCmd.Flags().StringSlice("trusted-networks", nil, "CIDRs of the trusted clients (e.g. 192.168.1.0/24), they get the playlists and the epg without credentials and the credential-less stream urls")
+	rootCmd.Flags().Duration("stream-heartbeat", 0, "Write an MPEG-TS null packet to the clients of a ts stream when the upstream stalls for this duration, to keep the players connected (0 to disable)")
+	rootCmd.Flags().String("download-dir-mode", "0755", "Octal permissions of the hlsdownloads directories")
+	rootCmd.Flags().String("download-file-mode", "0644", "Octal permissions of the hlsdownloads playlists and segments")
+	rootCmd.Flags().Bool("self-test", false, "Fetch the playlist, the first channel and its first segment through the proxy after starting, log a pass/fail summary and exit with its result")
+	rootCmd.Flags().String("upstream-mirrors-file", "", "Json file of the weighted mirrors of each upstream base url, the requests are balanced between them and fall through to the next one on failure")
+	rootCmd.Flags().String("segment-cache-control", "", "Cache-Control header of the segment responses, an Expires header is derived from its max-age")
+	rootCmd.Flags().StringToString("segment-cache-control-by-type", nil, "Cache-Control header of the segment responses by content type prefix, e.g. video/mp2t=max-age=10,video/mp4=max-age=86400")
+	rootCmd.Flags().Bool("fail-on-empty-playlist", false, "Fail the startup when the m3u playlist has no track (e.g. the provider returned an html error page) instead of serving an empty playlist")
+	rootCmd.Flags().Bool("index-page", false, "Serve at the root an index page listing the endpoints to the authenticated users, the others get a 404")
+	rootCmd.Flags().String("upstream-proxy-url", "", "Http or socks5 proxy of the upstream requests, e.g. socks5://127.0.0.1:1080, the hosts listed in NO_PROXY are reached directly")
+	rootCmd.Flags().StringToString("named-upstreams", nil, "Upstreams selectable per request by the trusted clients with the X-Upstream header, e.g. backup=http://backup.tv:8080, the scheme and host of the upstream urls are replaced by the selected one")
+	rootCmd.Flags().Duration("channel-metadata-ttl", 0, "Probe the upstream hls master playlists for the resolution, codecs and bitrate listed in /api/channels and cache them for this duration (0 to not probe)")
+	rootCmd.Flags().String("trailing-slash", "redirect", `Handling of the paths whose trailing slash doesn't match the route: "redirect" to the matching path, "strict" 404 or "both" serving both forms without redirect`)
+	rootCmd.Flags().Bool("compress-segments", false, "Serve the text based hlsdownloads files (playlists, subtitles) gzip-compressed to the clients accepting it, the compressed copy is stored aside the file")
+	rootCmd.Flags().String("not-found-segment", "", `Mpeg-ts file served for the unknown channels (e.g. a "channel not found" slate) instead of a 404, the hls requests get a playlist of it`)
+	rootCmd.Flags().Int("playlist-workers", 1, "Number of tracks processed concurrently when the proxyfied playlists are generated, the output order is kept")
+	rootCmd.Flags().String("segment-filename", "data%02d.ts", "Name template of the segments downloaded by ffmpeg in hlsdownloads: %02d is the segment number, {index} the channel index, {hash} a hash of the upstream url and {time} the unix time the download started")
+	rootCmd.Flags().Int("logo-max-width", 0, "Serve the channel logos through the proxy downscaled to this maximum width (0 for no limit)")
+	rootCmd.Flags().Int("logo-max-height", 0, "Serve the channel logos through the proxy downscaled to this maximum height (0 for no limit)")
+	rootCmd.Flags().String("channel-name-format", "", `Format of the channel names in the generated playlists for the players ignoring the groups, e.g. "[{group}] {name}" (empty to keep the names)`)
+	rootCmd.Flags().Duration("stale-while-revalidate", 0, "Age of the m3u playlist from which a playlist request triggers a refresh in the background, the current playlist is served meanwhile (0 to disable)")
+	rootCmd.Flags().Duration("playlist-fetch-timeout", 0, "Maximum duration of the m3u playlist download, body included, independent of the stream requests (0 for no limit)")
+	rootCmd.Flags().Bool("watch-playlist-file", false, "Reload the local m3u playlist as soon as the file changes on disk, polling it when it can't be watched")
+	rootCmd.Flags().Bool("kodi-pvr", false, "Make the m3u playlist ready for Kodi's PVR IPTV Simple Client: announce the epg.xml in its header and give the channels without tvg-id one matching the epg.xml placeholder")
+	rootCmd.Flags().Bool("coalesce-segments", false, "Share a single upstream download of a segment between the clients requesting it at the same time")
+	rootCmd.Flags().Duration("upstream-rate-limit-backoff", 5*time.Second, "Initial backoff of an upstream host answering 429, doubled while it keeps rate limiting, its Retry-After is honored when given (0 to disable)")
+	rootCmd.Flags().String("force-stream-content-type", "", "Content-Type forced on the stream responses instead of the upstream one, e.g. video/mp2t (the playlists and manifests keep theirs)")
+	rootCmd.Flags().StringToString("stream-content-type-by-channel", nil, "Content-Type forced on the stream responses by channel tvg-id, name or group, e.g. News=video/mp2t")
+	rootCmd.Flags().Int("playlist-chunk-size", 0, "Also serve the playlist split in chunks of this number of channels on /playlist/{n}.m3u, listed on /playlists, for the low memory clients (0 to disable)")
+	rootCmd.Flags().StringToString("tvg-id-map", nil, "tvg-id set on the channels by name, overriding the upstream one, e.g. \"France 2 HD=France2.fr\"")
+	rootCmd.Flags().String("tvg-id-map-file", "", "Json file mapping the channel names to the tvg-id set on them, for the large mappings, e.g. {\"France 2 HD\": \"France2.fr\"}")
+	rootCmd.Flags().Bool("protect-playlist", false, "Answer 401 to the playlist requests without credentials and serve the HDHomeRun lineup only with the credentials or to the trusted networks")
+	rootCmd.Flags().StringSlice("group-normalization", nil, "Rules applied in order to the channel group names so that the similar groups merge: trim, collapse-spaces, strip-separators, lower, upper, title, e.g. strip-separators,collapse-spaces,title")
+	rootCmd.Flags().Bool("mdns", false, "Advertise the HDHomeRun emulation on the local network with mDNS, so that the DVRs find it without entering its address")
+	rootCmd.Flags().String("log-file", "", "File the logs are written to instead of stdout")
+	rootCmd.Flags().Int("log-max-size-mb", 100, "Size in megabytes from which the log file is rotated, renamed with a timestamp (0 to never rotate)")
+	rootCmd.Flags().Duration("log-max-age", 7*24*time.Hour, "Age from which the rotated log files are removed (0 to keep them)")
+	rootCmd.Flags().Duration("stream-idle-timeout", 0, "Abort a stream and its upstream request when no data reaches the client for this duration, e.g. a client no longer reading (0 to disable)")
+	rootCmd.Flags().Duration("xtream-expiry-warning", 7*24*time.Hour, "Log a warning when the xtream account expires within this duration, checked at startup and every 12 hours (0 to disable)")
+	rootCmd.Flags().Bool("xtream-fallback-m3u", false, "Serve the original get.php m3u when the xtream API fails to generate the playlist (with --xtream-api-get)")
+	rootCmd.Flags().StringArray("url-blacklist", nil, "Stream url whose tracks are dropped from the playlist, matched exactly or as a regular expression between slashes, e.g. /\\.mkv$/ (repeatable)")
+	rootCmd.Flags().String("tvg-shift", "", "tvg-shift set on all the channels, the hours the players shift the EPG by, e.g. -2 or +5.5")
+	rootCmd.Flags().StringToString("tvg-shift-by-group", nil, "tvg-shift set on the channels by group, overriding --tvg-shift, e.g. \"US News=-5\"")
+	rootCmd.Flags().String("segment-store-endpoint", "", "Url of the S3 compatible object store the hlsdownloads segments are shared through by the proxy replicas, e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000")
+	rootCmd.Flags().String("segment-store-bucket", "", "Bucket of the segment store, the segments stay on the local disk only when unset; expire the objects with a lifecycle rule. The playlist isn't shared, only the segments it lists, and --segment-filename needs {hash} and {time} so that the replicas don't overwrite each other")
+	rootCmd.Flags().String("segment-store-region", "us-east-1", "Region the segment store requests are signed for")
+	rootCmd.Flags().String("segment-store-access-key", "", "Access key of the segment store")
+	rootCmd.Flags().String("segment-store-secret-key", "", "Secret key of the segment store")
+	rootCmd.Flags().Int("upstream-host-concurrency", 0, "Maximum of concurrent requests to each upstream host, the next ones wait for a free slot, a stream holds its slot until it ends (0 for no limit)")
+	rootCmd.Flags().StringToString("upstream-host-concurrency-by-host", nil, "Maximum of concurrent requests by upstream host, with or without its port, overriding --upstream-host-concurrency, e.g. provider.com=4")
+	rootCmd.Flags().Duration("max-request-duration", 0, "Answer 503 to the playlist, guide and api requests still unanswered after this duration, the streams and the configuration reload are not limited (0 to disable)")
+	rootCmd.Flags().Bool("playlist-file-cache", true, "Serve the playlist from a file written on each refresh, else generate it on the fly for each request")
+	rootCmd.Flags().Int("playlist-refresh-retries", 2, "Retries of a failed playlist refresh, e.g. an unreachable provider or an empty playlist, before the current playlist is kept until the next one")
+	rootCmd.Flags().Duration("playlist-refresh-retry-delay", 5*time.Second, "Delay before the first retry of a failed playlist refresh, doubled on each retry")
+	rootCmd.Flags().String("disabled-channels-file", "", "Json file the channels disabled with the api are kept in across the restarts (in memory only when unset)")
+	rootCmd.Flags().Int("segment-prefetch", 0, "Number of the following segments of a hls playlist downloaded in the background when a segment is requested (0 to disable)")
+	rootCmd.Flags().StringArray("tag-filter", nil, "EXTINF tag value the tracks must have to be kept, as name=value, the value matched exactly or as a regular expression between slashes, e.g. tvg-country=/^(FR|BE)$/ (repeatable, the values of a tag are alternatives)")
+	rootCmd.Flags().StringArray("tag-exclude", nil, "EXTINF tag value whose tracks are dropped from the playlist, as name=value like --tag-filter, e.g. tvg-country=XX (repeatable)")
+	rootCmd.Flags().Duration("maintenance-retry-after", 5*time.Minute, "Retry-After sent with the 503 answered to the streams in maintenance mode, enabled with POST /api/maintenance (0 to omit it)")
+	rootCmd.Flags().String("playlist-filename", "", "File name the playlist is saved as by the clients, in its Content-Disposition (defaults to --m3u-file-name)")
+	rootCmd.Flags().String("playlist-disposition", "attachment", "Content-Disposition of the playlists: attachment to save it as a file, inline to display it in the browsers")
+	rootCmd.Flags().Bool("detect-stream-type", false, "Probe the channels whose url has no known extension, e.g. .m3u8, .mpd or .ts, once to detect their hls, dash or raw stream from the content type and the content, the raw streams are relayed as is")
+	rootCmd.Flags().String("hls-endlist", "auto", "EXT-X-ENDLIST of the hls playlists transcoded by ffmpeg: auto to never end the live channels and serve the vod as ffmpeg writes it, keep to serve every channel as ffmpeg writes it, strip to never end them")
+	rootCmd.Flags().StringSlice("client-allowlist", nil, "CIDRs the clients are allowed from, the others are answered 403 (e.g. 192.168.1.0/24)")
+	rootCmd.Flags().StringSlice("client-denylist", nil, "CIDRs whose clients are answered 403, checked after --client-allowlist")
+	rootCmd.Flags().StringSlice("trusted-proxies", nil, "CIDRs of the reverse proxies whose X-Forwarded-For and X-Real-IP headers give the client address, for the client allowlist and denylist and the logs")
+	rootCmd.Flags().StringToString("timeshift-buffer-by-channel", nil, "Retention of the rolling timeshift buffer recorded on disk for the hls channels by tvg-id, name or group, served from /api/timeshift, e.g. \"France 2=30m\"")
+	rootCmd.Flags().String("timeshift-dir", "timeshift", "Directory the timeshift buffers are recorded in")
+	rootCmd.Flags().Int("timeshift-max-size-mb", 2048, "Maximum size in megabytes of all the timeshift buffers, the oldest segments are removed beyond it (0 for no maximum)")
+	rootCmd.Flags().Int("empty-playlist-status", 200, "Status answered to the m3u playlist requests when the playlist has no track, e.g. 503 for the monitoring to notice it (200 serves the empty playlist)")
+	rootCmd.Flags().Int64("max-segment-bytes", 256<<20, "Maximum size in bytes of the upstream playlists, manifests and timeshift segments read into memory or written to disk, the larger ones are dropped (0 for no maximum)")
+	rootCmd.Flags().StringSlice("m3u-merge-url", nil, "Other iptv m3u files or urls merged after --m3u-url in the given order, the channels of each are numbered after the ones of the previous playlists")
+	rootCmd.Flags().String("merge-duplicates", "keep", "Channels of a merged playlist whose url is already in a previous playlist: keep or drop")
+	rootCmd.Flags().Int("playlist-fetch-concurrency", 4, "Maximum number of playlists of --m3u-url and --m3u-merge-url fetched concurrently at startup and on refresh, they are merged in their configured order whatever their fetch order (0 or 1 to fetch them one after the other)")
 
 	if e := viper.BindPFlags(rootCmd.Flags()); e != nil {
 		log.Fatal("error binding PFlags to viper")
@@ -168,10 +534,73 @@ func initConfig() {
 
 	viper.AutomaticEnv() // read in environment variables that match
 
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	// If a config file is found, read it in, then the merged ones.
+	if err := readConfigFiles(); err != nil && (len(cfgMergeFiles) > 0 || cfgURL != "") {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if baseConfigFile != "" {
+		fmt.Println("Using config file:", baseConfigFile)
+	}
+	if cfgURL != "" {
+		fmt.Println("Merging config url:", cfgURL)
+	}
+	for _, file := range cfgMergeFiles {
+		fmt.Println("Merging config file:", file)
+	}
+}
+
+// parseFileMode return the octal permissions of the flag.
+func parseFileMode(flag string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(viper.GetString(flag), 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid %s %q: expected octal permissions like 0755", flag, viper.GetString(flag))
 	}
+
+	return os.FileMode(mode), nil
+}
+
+// parseHostConcurrency read the maximum of concurrent requests by host of the flag.
+func parseHostConcurrency(flag string) (map[string]int, error) {
+	limits := map[string]int{}
+	for host, value := range viper.GetStringMapString(flag) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s %q for %s: expected a number of requests", flag, value, host)
+		}
+		limits[host] = n
+	}
+
+	return limits, nil
+}
+
+// parseDurationsByName read the durations by name of the flag.
+func parseDurationsByName(flag string) (map[string]time.Duration, error) {
+	durations := map[string]time.Duration{}
+	for name, value := range viper.GetStringMapString(flag) {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid %s %q for %s: expected a duration, e.g. 30m", flag, value, name)
+		}
+		durations[name] = d
+	}
+
+	return durations, nil
+}
+
+// parseTagFilters read the tag values by tag name of the flag, each entry is a name=value.
+func parseTagFilters(flag string) (map[string][]string, error) {
+	filters := map[string][]string{}
+	for _, entry := range viper.GetStringSlice(flag) {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid %s %q: expected a name=value", flag, entry)
+		}
+		name = strings.TrimSpace(name)
+		filters[name] = append(filters[name], value)
+	}
+
+	return filters, nil
 }
 
 func housekeeper() {
@@ -192,7 +621,7 @@ func housekeeper() {
 				entries, err := os.ReadDir(path)
 				if err != nil {
 					// Обработка ошибки, например, запись в лог
-					log.Println("Failed to read directory:", err)
+					logger.Errorf("Failed to read directory: %v", err)
 					return nil
 				}
 
@@ -207,7 +636,7 @@ func housekeeper() {
 				if visibleEntries == 0 && time.Since(info.ModTime()) > 5*time.Minute {
 					if err := os.RemoveAll(path); err != nil {
 						// Обработка ошибки, например, запись в лог
-						log.Println("Failed to remove empty directory:", err)
+						logger.Errorf("Failed to remove empty directory: %v", err)
 					}
 				}
 			} else if (filepath.Ext(path) == ".ts" || filepath.Ext(path) == ".m3u8") && time.Since(info.ModTime()) > 5*time.Minute {
@@ -217,7 +646,7 @@ func housekeeper() {
 		})
 
 		if err != nil {
-			log.Println("Failed:", err)
+			logger.Errorf("Failed: %v", err)
 		}
 	}
 }
@@ -20,6 +20,8 @@ package config
 
 import (
 	"net/url"
+	"os"
+	"time"
 )
 
 // CredentialString represents an iptv-proxy credential.
@@ -37,8 +39,9 @@ func (c CredentialString) String() string {
 
 // HostConfiguration containt host infos
 type HostConfiguration struct {
-	Hostname string
-	Port     int
+	Hostname   string
+	Port       int
+	UnixSocket string
 }
 
 // ProxyConfig Contain original m3u playlist and HostConfiguration
@@ -50,10 +53,196 @@ type ProxyConfig struct {
 	XtreamGenerateApiGet bool
 	M3UCacheExpiration   int
 	M3UFileName          string
+	EpgURL               string
 	CustomEndpoint       string
 	CustomId             string
+	URLIndexEncoding     string
 	RemoteURL            *url.URL
 	AdvertisedPort       int
 	HTTPS                bool
 	User, Password       CredentialString
+
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+
+	HDHomeRun           bool
+	HDHomeRunTunerCount int
+
+	Enigma2ServiceType int
+
+	AvailabilityCacheTTL time.Duration
+
+	HLSRewriteDepth    int
+	HLSSegmentRefresh  bool
+	SegmentPassthrough bool
+
+	UpstreamInsecureSkipVerify bool
+
+	ChannelHeadersFile string
+
+	URLSigningSecret string
+	URLSignTTL       time.Duration
+
+	SkippedTracksFile string
+
+	PlaylistFetchHeaders map[string]string
+
+	HLSMasterBandwidth  int
+	HLSMasterResolution string
+
+	Favicon bool
+
+	DirectPlay []string
+
+	Metrics bool
+
+	LogLevel string
+
+	TranscodeCommand  string
+	TranscodeChannels []string
+
+	PlaylistRefreshInterval time.Duration
+
+	MaxConcurrentStreams int
+
+	TrustedNetworks []string
+
+	StreamHeartbeat time.Duration
+
+	DownloadDirMode  os.FileMode
+	DownloadFileMode os.FileMode
+
+	SelfTest bool
+
+	UpstreamMirrorsFile string
+
+	SegmentCacheControl       string
+	SegmentCacheControlByType map[string]string
+
+	FailOnEmptyPlaylist bool
+
+	IndexPage bool
+
+	UpstreamProxyURL string
+
+	NamedUpstreams map[string]string
+
+	ChannelMetadataTTL time.Duration
+
+	TrailingSlash string
+
+	CompressSegments bool
+
+	NotFoundSegment string
+
+	PlaylistWorkers int
+
+	SegmentFilename string
+
+	LogoMaxWidth  int
+	LogoMaxHeight int
+
+	ChannelNameFormat string
+
+	StaleWhileRevalidate time.Duration
+
+	PlaylistFetchTimeout time.Duration
+
+	WatchPlaylistFile bool
+
+	KodiPVR bool
+
+	CoalesceSegments bool
+
+	UpstreamRateLimitBackoff time.Duration
+
+	ForceStreamContentType     string
+	StreamContentTypeByChannel map[string]string
+
+	PlaylistChunkSize int
+
+	TvgIDMap     map[string]string
+	TvgIDMapFile string
+
+	ProtectPlaylist bool
+
+	GroupNormalization []string
+
+	MDNSEnabled bool
+
+	LogFile      string
+	LogMaxSizeMB int
+	LogMaxAge    time.Duration
+
+	StreamIdleTimeout time.Duration
+
+	XtreamExpiryWarning time.Duration
+
+	XtreamFallbackToM3U bool
+
+	URLBlacklist []string
+
+	TvgShift        string
+	TvgShiftByGroup map[string]string
+
+	SegmentStoreEndpoint  string
+	SegmentStoreBucket    string
+	SegmentStoreRegion    string
+	SegmentStoreAccessKey CredentialString
+	SegmentStoreSecretKey CredentialString
+
+	UpstreamHostConcurrency       int
+	UpstreamHostConcurrencyByHost map[string]int
+
+	MaxRequestDuration time.Duration
+
+	PlaylistFileCache bool
+
+	PlaylistRefreshRetries    int
+	PlaylistRefreshRetryDelay time.Duration
+
+	DisabledChannelsFile string
+
+	SegmentPrefetch int
+
+	TagFilters map[string][]string
+	TagExclude map[string][]string
+
+	MaintenanceRetryAfter time.Duration
+
+	PlaylistFilename    string
+	PlaylistDisposition string
+
+	DetectStreamType bool
+
+	HLSEndList string
+
+	ClientAllowlist []string
+	ClientDenylist  []string
+	TrustedProxies  []string
+
+	TimeshiftBufferByChannel map[string]time.Duration
+	TimeshiftDir             string
+	TimeshiftMaxSizeMB       int
+
+	EmptyPlaylistStatus int
+
+	MaxSegmentBytes int64
+
+	PlaylistMergeSources     []string
+	PlaylistMergeDuplicates  string
+	PlaylistFetchConcurrency int
+}
+
+// PublicPort returns the port the clients reach the proxy on, the default port
+// of the scheme when the advertised port is left out of the urls.
+func (c *ProxyConfig) PublicPort() int {
+	switch {
+	case c.AdvertisedPort != 0:
+		return c.AdvertisedPort
+	case c.HTTPS:
+		return 443
+	default:
+		return 80
+	}
 }
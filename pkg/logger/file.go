@@ -0,0 +1,163 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedSuffixFormat is appended to the name of the rotated log files.
+const rotatedSuffixFormat = "2006-01-02T15-04-05.000"
+
+var output io.Writer = os.Stdout
+var outputLock = sync.RWMutex{}
+
+// SetOutput send the logs, the requests included, to the writer instead of stdout.
+func SetOutput(w io.Writer) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	output = w
+	log.SetOutput(w)
+}
+
+// Writer return the writer the logs are sent to.
+func Writer() io.Writer {
+	outputLock.RLock()
+	defer outputLock.RUnlock()
+
+	return output
+}
+
+// RotatingFile is a log file renamed with a timestamp suffix when it reaches its maximum size,
+// the rotated files older than the maximum age are removed.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenFile open the log file in append mode, rotated at maxSizeMB megabytes and whose
+// rotated files are kept for maxAge, no rotation or removal when they are zero.
+func OpenFile(path string, maxSizeMB int, maxAge time.Duration) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: int64(maxSizeMB) * 1024 * 1024, maxAge: maxAge}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.removeExpired()
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open the log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("unable to open the log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+// Write append to the log file, rotating it first when the write would exceed its maximum size.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation: %s\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// rotate rename the log file with the current time and open a new one, lock must be held.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := f.path + "." + time.Now().Format(rotatedSuffixFormat)
+	renameErr := os.Rename(f.path, rotated)
+
+	// the logs keep going to a file even when the rename failed
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	go f.removeExpired()
+
+	return nil
+}
+
+// removeExpired remove the rotated log files older than the maximum age.
+func (f *RotatingFile) removeExpired() {
+	if f.maxAge <= 0 {
+		return
+	}
+
+	rotated, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+
+	for _, path := range rotated {
+		suffix := strings.TrimPrefix(path, f.path+".")
+		t, err := time.ParseInLocation(rotatedSuffixFormat, suffix, time.Local)
+		if err != nil || time.Since(t) < f.maxAge {
+			continue
+		}
+		_ = os.Remove(path)
+	}
+}
+
+// Close close the log file.
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.file.Close()
+}
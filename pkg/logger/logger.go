@@ -0,0 +1,101 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package logger is the leveled logging of iptv-proxy.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int32
+
+// Log levels, from the most verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+var current = int32(LevelInfo)
+
+// ParseLevel return the level named debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+
+	return LevelInfo, fmt.Errorf("invalid log level %q: expected debug, info, warn or error", name)
+}
+
+// SetLevel set the minimum level of the logged messages.
+func SetLevel(level Level) {
+	atomic.StoreInt32(&current, int32(level))
+}
+
+// Enabled report whether the messages of the level are logged.
+func Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&current))
+}
+
+func logf(level Level, format string, args ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+
+	log.Printf("[iptv-proxy] %v | %s | %s\n", time.Now().Format("2006/01/02 - 15:04:05"), levelNames[level], fmt.Sprintf(format, args...))
+}
+
+// Debugf log the details useful to trace a problem, e.g. each upstream segment.
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, format, args...)
+}
+
+// Infof log the normal operation of the proxy.
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+// Warnf log an unexpected situation the proxy recovered from.
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, format, args...)
+}
+
+// Errorf log a failure.
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+}
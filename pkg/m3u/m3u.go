@@ -32,6 +32,19 @@ type Track struct {
 	URI    string
 	Tags   []Tag
 	Group  string
+	// Options are the raw #EXTVLCOPT and #KODIPROP lines of the track
+	Options []string
+}
+
+// Tag returns the value of the tag with the given name, the lookup is case insensitive.
+func (t Track) Tag(name string) string {
+	for _, tag := range t.Tags {
+		if strings.EqualFold(tag.Name, name) {
+			return tag.Value
+		}
+	}
+
+	return ""
 }
 
 type VariantStream struct {
@@ -70,10 +83,61 @@ func Parse(fileName string) (Playlist, error) {
 	}
 	defer f.Close()
 
+	return Decode(f)
+}
+
+// utf8BOM is the byte order mark some providers prefix their playlists with.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// skipBOM return a reader of r without its leading utf-8 byte order mark.
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		_, _ = br.Discard(len(utf8BOM))
+	}
+
+	return br
+}
+
+// scanLines is a bufio.SplitFunc splitting the lines ended by "\n", "\r\n" or a lone "\r".
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// a "\r" at the end of the buffer may be followed by a "\n"
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// Decode parses an m3u playlist from the reader and returns a Playlist
+func Decode(r io.Reader) (Playlist, error) {
 	onFirstLine := true
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(skipBOM(r))
+	scanner.Split(scanLines)
 	tagsRegExp, _ := regexp.Compile("([a-zA-Z0-9-]+?)=\"([^\"]+)\"")
 	playlist := Playlist{}
+	// the #EXTVLCOPT and #KODIPROP lines read before the #EXTINF of their track
+	var options []string
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -95,7 +159,8 @@ func Parse(fileName string) (Playlist, error) {
 			if parseErr != nil {
 				return Playlist{}, errors.New("unable to parse length")
 			}
-			track := &Track{strings.Trim(trackInfo[1], " "), length, "", nil, ""}
+			track := &Track{strings.Trim(trackInfo[1], " "), length, "", nil, "", options}
+			options = nil
 			tagList := tagsRegExp.FindAllString(line, -1)
 			for i := range tagList {
 				tagInfo := strings.Split(tagList[i], "=")
@@ -174,6 +239,13 @@ func Parse(fileName string) (Playlist, error) {
 			line := strings.Replace(line, "#EXTINF:", "", -1)
 			playlist.Tracks[len(playlist.Tracks)-1].Group = strings.Trim(line, " ")
 
+		} else if strings.HasPrefix(line, "#EXTVLCOPT") || strings.HasPrefix(line, "#KODIPROP") {
+			// the options are written before or after the #EXTINF line, until the uri of the track
+			if n := len(playlist.Tracks); n > 0 && playlist.Tracks[n-1].URI == "" {
+				playlist.Tracks[n-1].Options = append(playlist.Tracks[n-1].Options, strings.TrimSpace(line))
+			} else {
+				options = append(options, strings.TrimSpace(line))
+			}
 		} else if strings.HasPrefix(line, "#") || line == "" {
 			continue
 		} else if len(playlist.Tracks) == 0 && len(playlist.VariantStreams) == 0 {
@@ -206,17 +278,17 @@ func MarshallInto(p Playlist, into *bufio.Writer) error {
 	_, _ = into.WriteString("#EXTM3U\n")
 	for _, track := range p.Tracks {
 		_, _ = into.WriteString("#EXTINF:")
-		_, _ = into.WriteString(fmt.Sprintf("%d ", track.Length))
+		_, _ = into.WriteString(fmt.Sprintf("%d", track.Length))
 		for i := range track.Tags {
-			if i == len(track.Tags)-1 {
-				_, _ = into.WriteString(fmt.Sprintf("%s=%q", track.Tags[i].Name, track.Tags[i].Value))
-				continue
-			}
-			_, _ = into.WriteString(fmt.Sprintf("%s=%q ", track.Tags[i].Name, track.Tags[i].Value))
+			_, _ = into.WriteString(fmt.Sprintf(" %s=%q", track.Tags[i].Name, track.Tags[i].Value))
 		}
-		_, _ = into.WriteString(", ")
+		_, _ = into.WriteString(",")
 
-		_, _ = into.WriteString(fmt.Sprintf("%s\n%s\n", track.Name, track.URI))
+		_, _ = into.WriteString(fmt.Sprintf("%s\n", track.Name))
+		for _, option := range track.Options {
+			_, _ = into.WriteString(fmt.Sprintf("%s\n", option))
+		}
+		_, _ = into.WriteString(fmt.Sprintf("%s\n", track.URI))
 	}
 
 	return into.Flush()
@@ -0,0 +1,180 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package m3u
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecodeLineEndings(t *testing.T) {
+	lines := []string{
+		"#EXTM3U",
+		`#EXTINF:-1 tvg-id="one" group-title="News",One`,
+		"http://upstream.tv/1.ts",
+		`#EXTINF:-1 tvg-id="two",Two`,
+		"http://upstream.tv/2.ts",
+	}
+
+	tests := []struct {
+		name     string
+		playlist string
+	}{
+		{name: "lf", playlist: strings.Join(lines, "\n") + "\n"},
+		{name: "crlf", playlist: strings.Join(lines, "\r\n") + "\r\n"},
+		{name: "cr", playlist: strings.Join(lines, "\r") + "\r"},
+		{name: "bom crlf", playlist: "\xEF\xBB\xBF" + strings.Join(lines, "\r\n") + "\r\n"},
+		{name: "bom crlf without final line ending", playlist: "\xEF\xBB\xBF" + strings.Join(lines, "\r\n")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the playlist is read a byte at a time so that the "\r\n" are split across the reads
+			p, err := Decode(iotest.OneByteReader(strings.NewReader(tt.playlist)))
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if len(p.Tracks) != 2 {
+				t.Fatalf("Decode() got %d tracks, want 2", len(p.Tracks))
+			}
+
+			first := p.Tracks[0]
+			if first.Name != "One" || first.URI != "http://upstream.tv/1.ts" || first.Tag("tvg-id") != "one" || first.Tag("group-title") != "News" {
+				t.Errorf("first track = %+v", first)
+			}
+			second := p.Tracks[1]
+			if second.Name != "Two" || second.URI != "http://upstream.tv/2.ts" {
+				t.Errorf("second track = %+v", second)
+			}
+		})
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	if _, err := Decode(strings.NewReader("\xEF\xBB\xBF#EXTINF:-1,One\r\nhttp://upstream.tv/1.ts\r\n")); err == nil {
+		t.Error("Decode() of a playlist without #EXTM3U header: expected an error")
+	}
+}
+
+// extinfRegExp matches the widely accepted form of the #EXTINF lines: #EXTINF:-1 tvg-id="..." group-title="...",Name
+var extinfRegExp = regexp.MustCompile(`^#EXTINF:-?\d+( [a-zA-Z0-9-]+="[^"]*")*,[^ ].*$`)
+
+func TestMarshallEXTINF(t *testing.T) {
+	tests := []struct {
+		name  string
+		track Track
+		want  string
+	}{
+		{
+			name:  "without tags",
+			track: Track{Name: "One", Length: -1, URI: "http://upstream.tv/1.ts"},
+			want:  "#EXTINF:-1,One",
+		},
+		{
+			name: "with tags",
+			track: Track{Name: "Two", Length: -1, URI: "http://upstream.tv/2.ts", Tags: []Tag{
+				{Name: "tvg-id", Value: "two"},
+				{Name: "group-title", Value: "News"},
+			}},
+			want: `#EXTINF:-1 tvg-id="two" group-title="News",Two`,
+		},
+		{
+			name:  "with a length",
+			track: Track{Name: "Three", Length: 120, URI: "http://upstream.tv/3.ts", Tags: []Tag{{Name: "tvg-id", Value: "three"}}},
+			want:  `#EXTINF:120 tvg-id="three",Three`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Marshall(Playlist{Tracks: []Track{tt.track}})
+			if err != nil {
+				t.Fatalf("Marshall() error = %v", err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lines := strings.Split(string(b), "\n")
+			if lines[1] != tt.want {
+				t.Errorf("Marshall() #EXTINF line = %q, want %q", lines[1], tt.want)
+			}
+			if !extinfRegExp.MatchString(lines[1]) {
+				t.Errorf("Marshall() #EXTINF line %q is not in the widely accepted form", lines[1])
+			}
+
+			// the written playlist is read back the same by the parser
+			p, err := Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if len(p.Tracks) != 1 {
+				t.Fatalf("Decode() got %d tracks, want 1", len(p.Tracks))
+			}
+			got := p.Tracks[0]
+			if got.Name != tt.track.Name || got.Length != tt.track.Length || got.URI != tt.track.URI || !reflect.DeepEqual(got.Tags, tt.track.Tags) {
+				t.Errorf("Decode() track = %+v, want %+v", got, tt.track)
+			}
+		})
+	}
+}
+
+func TestDecodeOptions(t *testing.T) {
+	playlist := strings.Join([]string{
+		"#EXTM3U",
+		"#KODIPROP:inputstream=inputstream.adaptive",
+		"#EXTVLCOPT:http-user-agent=One",
+		`#EXTINF:-1 tvg-id="one",One`,
+		"http://upstream.tv/1.mpd",
+		`#EXTINF:-1 tvg-id="two",Two`,
+		"#EXTVLCOPT:http-user-agent=Two",
+		"http://upstream.tv/2.ts",
+		"#EXTVLCOPT:http-referrer=http://three.tv/",
+		`#EXTINF:-1 tvg-id="three",Three`,
+		"http://upstream.tv/3.ts",
+		`#EXTINF:-1 tvg-id="four",Four`,
+		"http://upstream.tv/4.ts",
+	}, "\n") + "\n"
+
+	p, err := Decode(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	want := map[string][]string{
+		"One":   {"#KODIPROP:inputstream=inputstream.adaptive", "#EXTVLCOPT:http-user-agent=One"},
+		"Two":   {"#EXTVLCOPT:http-user-agent=Two"},
+		"Three": {"#EXTVLCOPT:http-referrer=http://three.tv/"},
+		"Four":  nil,
+	}
+	if len(p.Tracks) != len(want) {
+		t.Fatalf("Decode() got %d tracks, want %d", len(p.Tracks), len(want))
+	}
+	for _, track := range p.Tracks {
+		if !reflect.DeepEqual(track.Options, want[track.Name]) {
+			t.Errorf("track %s options = %q, want %q", track.Name, track.Options, want[track.Name])
+		}
+	}
+}
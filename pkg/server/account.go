@@ -0,0 +1,165 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+	xtreamapi "github.com/romaxa55/iptv-proxy/pkg/xtream-proxy"
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+// expiryCheckInterval is how often the expiry of the xtream account is checked.
+const expiryCheckInterval = 12 * time.Hour
+
+// xtreamAccount is the upstream xtream account, as returned by player_api.php without action:
+//
+//	{
+//	  "status": "Active", "auth": true, "is_trial": false,
+//	  "exp_date": "2024-06-01T00:00:00Z",  // null when the account never expires
+//	  "expires_in_days": 42,
+//	  "max_connections": 2, "active_connections": 1,
+//	  "allowed_output_formats": ["m3u8", "ts"],
+//	  "server": {"url": "proxy.lan", "port": 8080, "protocol": "http", "timezone": "UTC"}
+//	}
+//
+// The server is the proxy one, the upstream one with ?upstream=true.
+type xtreamAccount struct {
+	Status               string        `json:"status"`
+	Auth                 bool          `json:"auth"`
+	Message              string        `json:"message,omitempty"`
+	IsTrial              bool          `json:"is_trial"`
+	ExpDate              *time.Time    `json:"exp_date"`
+	ExpiresInDays        *int          `json:"expires_in_days"`
+	MaxConnections       int64         `json:"max_connections"`
+	ActiveConnections    int64         `json:"active_connections"`
+	AllowedOutputFormats []string      `json:"allowed_output_formats"`
+	Server               accountServer `json:"server"`
+}
+
+type accountServer struct {
+	URL      string `json:"url"`
+	Port     int64  `json:"port"`
+	Protocol string `json:"protocol"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// getXtreamAccount serve the status, the expiry and the connections of the upstream xtream account.
+func (c *Config) getXtreamAccount(ctx *gin.Context) {
+	upstream, _ := strconv.ParseBool(ctx.Query("upstream"))
+	client, err := c.xtreamClient(ctx)
+	if err != nil {
+		_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
+		return
+	}
+
+	info := client.UserInfo
+	account := xtreamAccount{
+		Status:               info.Status,
+		Auth:                 isSet(info.Auth),
+		Message:              info.Message,
+		IsTrial:              isSet(info.IsTrial),
+		MaxConnections:       int64(info.MaxConnections),
+		ActiveConnections:    int64(info.ActiveConnections),
+		AllowedOutputFormats: info.AllowedOutputFormats,
+		Server: accountServer{
+			URL:      c.HostConfig.Hostname,
+			Port:     int64(c.PublicPort()),
+			Protocol: "http",
+			Timezone: client.ServerInfo.Timezone,
+		},
+	}
+	if account.AllowedOutputFormats == nil {
+		account.AllowedOutputFormats = []string{}
+	}
+	if c.HTTPS {
+		account.Server.Protocol = "https"
+	}
+	if upstream {
+		account.Server.URL = client.ServerInfo.URL
+		account.Server.Port = int64(client.ServerInfo.Port)
+		account.Server.Protocol = client.ServerInfo.Protocol
+	}
+	if exp := accountExpiry(client); exp != nil {
+		days := int(time.Until(*exp).Hours() / 24)
+		account.ExpDate = exp
+		account.ExpiresInDays = &days
+	}
+
+	ctx.JSON(http.StatusOK, account)
+}
+
+// accountExpiry return the expiry date of the account, nil when it never expires.
+func accountExpiry(client *xtreamapi.Client) *time.Time {
+	exp := client.UserInfo.ExpDate
+	if exp == nil || exp.Unix() <= 0 {
+		return nil
+	}
+
+	t := exp.UTC()
+	return &t
+}
+
+// isSet return the value of the xtream boolean, only readable through its json encoding.
+func isSet(b xtream.ConvertibleBoolean) bool {
+	data, _ := b.MarshalJSON() // nolint: errcheck
+	return strings.Trim(string(data), `"`) == "1"
+}
+
+// watchXtreamExpiry log a warning when the xtream account expires within the configured window,
+// at startup and then periodically.
+func (c *Config) watchXtreamExpiry() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		c.checkXtreamExpiry()
+
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Config) checkXtreamExpiry() {
+	client, err := c.newXtreamClient("iptv-proxy")
+	if err != nil {
+		logger.Warnf("xtream account: %s", err)
+		return
+	}
+
+	exp := accountExpiry(client)
+	if exp == nil {
+		return
+	}
+
+	left := time.Until(*exp)
+	switch {
+	case left <= 0:
+		logger.Errorf("xtream account %s expired on %s", c.XtreamUser, exp.Format(time.RFC3339))
+	case left <= c.XtreamExpiryWarning:
+		logger.Warnf("xtream account %s expires on %s, in %d days", c.XtreamUser, exp.Format(time.RFC3339), int(left.Hours()/24))
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// channelMetadataProbes is the number of channels probed concurrently for their metadata.
+const channelMetadataProbes = 8
+
+type channelMetadata struct {
+	Resolution string `json:"resolution,omitempty"`
+	Codecs     string `json:"codecs,omitempty"`
+	Bandwidth  uint32 `json:"bandwidth,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type channelInfo struct {
+	Index    string           `json:"index"`
+	Name     string           `json:"name"`
+	Group    string           `json:"group,omitempty"`
+	TvgID    string           `json:"tvg_id,omitempty"`
+	URL      string           `json:"url"`
+	Metadata *channelMetadata `json:"metadata,omitempty"`
+
+	track *m3u.Track
+}
+
+// getChannels list the playlist channels with their proxyfied url, and the resolution,
+// codecs and bitrate of the hls channels when the metadata probing is enabled.
+func (c *Config) getChannels(ctx *gin.Context) {
+	channels := c.channelInfos(ctx)
+
+	if c.ChannelMetadataTTL > 0 {
+		c.probeChannelsMetadata(channels)
+	}
+
+	ctx.JSON(http.StatusOK, channels)
+}
+
+// getChannelsCSV export the playlist channels with their proxyfied url as csv.
+func (c *Config) getChannelsCSV(ctx *gin.Context) {
+	ctx.Header("Content-Disposition", `attachment; filename="channels.csv"`)
+	ctx.Header("Content-Type", "text/csv; charset=utf-8")
+	ctx.Status(http.StatusOK)
+
+	w := csv.NewWriter(ctx.Writer)
+	_ = w.Write([]string{"name", "group", "tvg-id", "url"}) // nolint: errcheck
+	for _, channel := range c.channelInfos(ctx) {
+		_ = w.Write([]string{channel.Name, channel.Group, channel.TvgID, channel.URL}) // nolint: errcheck
+	}
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		_ = ctx.Error(err) // nolint: errcheck
+	}
+}
+
+// channelInfos return the playlist channels with their url for the client.
+func (c *Config) channelInfos(ctx *gin.Context) []channelInfo {
+	rc := c.requestConfig(ctx)
+	tracks := c.tracks()
+
+	channels := make([]channelInfo, 0, len(tracks))
+	for i := range tracks {
+		track := &tracks[i]
+		u, err := rc.trackURL(track, i, false)
+		if err != nil {
+			continue
+		}
+
+		channels = append(channels, channelInfo{
+			Index: c.encodeTrackIndex(i, track.URI),
+			Name:  track.Name,
+			Group: trackGroup(track),
+			TvgID: track.Tag("tvg-id"),
+			URL:   u,
+			track: track,
+		})
+	}
+
+	return channels
+}
+
+// probeChannelsMetadata read the metadata of the hls channels from their upstream master playlist,
+// the results are cached for the channel metadata ttl.
+func (c *Config) probeChannelsMetadata(channels []channelInfo) {
+	sem := make(chan struct{}, channelMetadataProbes)
+	wg := sync.WaitGroup{}
+
+	for i := range channels {
+		if !strings.Contains(channels[i].track.URI, ".m3u8") {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(channel *channelInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			trackConfig := *c
+			trackConfig.track = channel.track
+
+			metadata := &channelMetadata{}
+			probe, err := trackConfig.cachedChannelProbe(channel.track.URI, c.ChannelMetadataTTL)
+			if err != nil {
+				metadata.Error = err.Error()
+			}
+			metadata.Resolution = probe.resolution
+			metadata.Codecs = probe.codecs
+			metadata.Bandwidth = probe.bandwidth
+			channel.Metadata = metadata
+		}(&channels[i])
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,171 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// channelTestMaxPlaylists is the number of nested hls playlists followed to the first segment.
+const channelTestMaxPlaylists = 3
+
+// channelTestStep is the diagnostic of one upstream request of the playback chain.
+type channelTestStep struct {
+	Name        string  `json:"name"`
+	URL         string  `json:"url"`
+	Status      int     `json:"status,omitempty"`
+	ContentType string  `json:"content_type,omitempty"`
+	Size        int     `json:"size"`
+	DurationMs  float64 `json:"duration_ms"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// channelTest is the diagnostic of the playback chain of a channel.
+type channelTest struct {
+	Channel string            `json:"channel"`
+	Passed  bool              `json:"passed"`
+	Steps   []channelTestStep `json:"steps"`
+}
+
+// getChannelTest fetch the upstream url of the channel, follow its hls playlists and
+// download the first segment, the diagnostics of each request are returned as json.
+func (c *Config) getChannelTest(ctx *gin.Context) {
+	track, ok := c.trackByIndex(ctx.Param("index"))
+	if !ok {
+		_ = ctx.AbortWithError(http.StatusNotFound, fmt.Errorf("unknown channel %q", ctx.Param("index"))) // nolint: errcheck
+		return
+	}
+
+	trackConfig := *c
+	trackConfig.track = &track
+
+	result := channelTest{Channel: track.Name}
+
+	u, err := url.Parse(track.URI)
+	if err != nil {
+		result.Steps = append(result.Steps, channelTestStep{Name: "channel", URL: track.URI, Error: err.Error()})
+		ctx.JSON(http.StatusOK, result)
+		return
+	}
+
+	name := "channel"
+	for i := 0; ; i++ {
+		step, body := trackConfig.channelTestGet(ctx, name, u)
+		result.Steps = append(result.Steps, step)
+		if step.Error != "" {
+			break
+		}
+
+		if !isHLSPlaylist(u, step.ContentType, body) {
+			result.Passed = true
+			break
+		}
+
+		if i == channelTestMaxPlaylists {
+			result.Steps = append(result.Steps, channelTestStep{Name: "segment", Error: "too many nested hls playlists"})
+			break
+		}
+
+		uri := firstURI(body)
+		if uri == "" {
+			result.Steps = append(result.Steps, channelTestStep{Name: "segment", Error: "no uri in the hls playlist"})
+			break
+		}
+		ref, err := url.Parse(uri)
+		if err != nil {
+			result.Steps = append(result.Steps, channelTestStep{Name: "segment", URL: uri, Error: err.Error()})
+			break
+		}
+
+		u = u.ResolveReference(ref)
+		name = "segment"
+		if strings.Contains(u.Path, ".m3u8") {
+			name = "playlist"
+		}
+	}
+
+	ctx.JSON(http.StatusOK, result)
+}
+
+// channelTestGet request the upstream url as the proxy does, a segment is read up to selfTestReadBytes,
+// the read body is returned along the diagnostic.
+func (c *Config) channelTestGet(ctx *gin.Context, name string, u *url.URL) (channelTestStep, []byte) {
+	step := channelTestStep{Name: name, URL: u.String()}
+
+	start := time.Now()
+	body, err := c.channelTestFetch(ctx, &step, u)
+	step.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	return step, body
+}
+
+// channelTestFetch send the upstream request and fill the status and the content of the diagnostic.
+func (c *Config) channelTestFetch(ctx *gin.Context, step *channelTestStep, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setChannelHeaders(req.Header)
+
+	resp, err := c.upstreamDo(upstreamClient, withSelectedUpstream(ctx, req))
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	step.Status = resp.StatusCode
+	step.ContentType = resp.Header.Get("Content-Type")
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, selfTestReadBytes))
+	step.Size = len(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return body, nil
+}
+
+// isHLSPlaylist report whether the upstream response is an hls playlist.
+func isHLSPlaylist(u *url.URL, contentType string, body []byte) bool {
+	contentType = strings.ToLower(contentType)
+
+	return strings.Contains(contentType, "mpegurl") ||
+		strings.HasSuffix(u.Path, ".m3u8") ||
+		bytes.HasPrefix(bytes.TrimSpace(body), []byte("#EXTM3U"))
+}
@@ -0,0 +1,96 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+type chunkInfo struct {
+	Chunk    int    `json:"chunk"`
+	Channels int    `json:"channels"`
+	Path     string `json:"path"`
+}
+
+// playlistChunks return the number of chunks of the playlist.
+func (c *Config) playlistChunks(tracks int) int {
+	return (tracks + c.PlaylistChunkSize - 1) / c.PlaylistChunkSize
+}
+
+// getChunks list the chunks of the playlist with their path.
+func (c *Config) getChunks(ctx *gin.Context) {
+	tracks := len(c.tracks())
+	chunks := make([]chunkInfo, 0, c.playlistChunks(tracks))
+
+	for n := 1; n <= c.playlistChunks(tracks); n++ {
+		channels := c.PlaylistChunkSize
+		if last := tracks - (n-1)*c.PlaylistChunkSize; last < channels {
+			channels = last
+		}
+
+		chunks = append(chunks, chunkInfo{
+			Chunk:    n,
+			Channels: channels,
+			Path:     c.endpointPath(fmt.Sprintf("/playlist/%d.m3u", n)),
+		})
+	}
+
+	ctx.JSON(http.StatusOK, chunks)
+}
+
+// getChunkM3U serve a playlist with only the tracks of the requested chunk, numbered from 1.
+// The tracks keep their index in the whole playlist, so the urls are the same in every chunk.
+func (c *Config) getChunkM3U(ctx *gin.Context) {
+	name := strings.TrimSuffix(ctx.Param("chunk"), ".m3u")
+	tracks := c.tracks()
+
+	n, err := strconv.Atoi(name)
+	if err != nil || n < 1 || n > c.playlistChunks(len(tracks)) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	first := (n - 1) * c.PlaylistChunkSize
+	last := first + c.PlaylistChunkSize
+	if last > len(tracks) {
+		last = len(tracks)
+	}
+
+	inChunk := make(map[*m3u.Track]bool, last-first)
+	for i := first; i < last; i++ {
+		inChunk[&tracks[i]] = true
+	}
+
+	ctx.Header("Content-Disposition", c.playlistFileDisposition(name+".m3u"))
+	ctx.Header("Content-Type", "application/octet-stream")
+	ctx.Status(http.StatusOK)
+
+	keep := func(track *m3u.Track) bool {
+		return inChunk[track]
+	}
+	if err := c.requestConfig(ctx).writeTracks(ctx.Writer, tracks, false, keep); err != nil {
+		_ = ctx.Error(err) // nolint: errcheck
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestChunkPaths(t *testing.T) {
+	tracks := make([]m3u.Track, 5)
+	for i := range tracks {
+		tracks[i] = m3u.Track{Name: fmt.Sprintf("Channel %d", i), Length: -1, URI: fmt.Sprintf("http://upstream.tv/live/%d.ts", i)}
+	}
+
+	for _, endpoint := range []string{"", "custom"} {
+		t.Run("endpoint "+endpoint, func(t *testing.T) {
+			c := newTestConfig(tracks...)
+			c.CustomEndpoint = endpoint
+			c.PlaylistChunkSize = 2
+			prefix := c.endpointPath("")
+
+			w := serveTest(c, httptest.NewRequest(http.MethodGet, prefix+"/playlists?username=user&password=pass", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /playlists status = %d", w.Code)
+			}
+			var chunks []chunkInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &chunks); err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) != 3 {
+				t.Fatalf("got %d chunks, want 3", len(chunks))
+			}
+
+			// every listed path serves the channels of its chunk
+			for _, chunk := range chunks {
+				if want := fmt.Sprintf("%s/playlist/%d.m3u", prefix, chunk.Chunk); chunk.Path != want {
+					t.Errorf("chunk %d path = %q, want %q", chunk.Chunk, chunk.Path, want)
+				}
+
+				w := serveTest(c, httptest.NewRequest(http.MethodGet, chunk.Path+"?username=user&password=pass", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("GET %s status = %d, want %d", chunk.Path, w.Code, http.StatusOK)
+					continue
+				}
+				if n := strings.Count(w.Body.String(), "#EXTINF"); n != chunk.Channels {
+					t.Errorf("GET %s served %d channels, want %d", chunk.Path, n, chunk.Channels)
+				}
+			}
+		})
+	}
+}
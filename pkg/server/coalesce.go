@@ -0,0 +1,141 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// segmentDownloadTimeout bound the shared segment downloads, they don't end with a client
+	segmentDownloadTimeout = time.Minute
+	// maxCoalescedSegmentSize is the largest segment held in memory for the waiting requests
+	maxCoalescedSegmentSize = 64 << 20
+)
+
+// segmentCall is an upstream segment download shared by the identical concurrent requests.
+type segmentCall struct {
+	done chan struct{}
+
+	request *http.Request
+	status  int
+	header  http.Header
+	body    []byte
+	err     error
+}
+
+// segmentCalls are the segment downloads in progress by upstream url.
+var segmentCalls = map[string]*segmentCall{}
+var segmentCallsLock = sync.Mutex{}
+
+// segmentRequest request the segment upstream, the identical concurrent requests share a
+// single download when the coalescing is enabled, its error included.
+// The range requests and the HEAD requests are always sent on their own.
+func (c *Config) segmentRequest(ctx *gin.Context, u *url.URL) (*http.Response, error) {
+	if !c.CoalesceSegments || ctx.Request.Method != http.MethodGet || ctx.GetHeader("Range") != "" {
+		return c.streamRequest(ctx, u)
+	}
+
+	key := segmentCallKey(ctx, u)
+
+	segmentCallsLock.Lock()
+	call, ok := segmentCalls[key]
+	if !ok {
+		call = &segmentCall{done: make(chan struct{})}
+		segmentCalls[key] = call
+	}
+	segmentCallsLock.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+		case <-ctx.Request.Context().Done():
+			return nil, ctx.Request.Context().Err()
+		}
+	} else {
+		c.downloadSegment(ctx, u, call)
+
+		segmentCallsLock.Lock()
+		delete(segmentCalls, key)
+		segmentCallsLock.Unlock()
+		close(call.done)
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	return call.response(), nil
+}
+
+// segmentCallKey identify the download of the segment, by upstream url and selected upstream.
+func segmentCallKey(ctx *gin.Context, u *url.URL) string {
+	if base, ok := ctx.Get(upstreamHeader); ok {
+		return fmt.Sprintf("%v %s", base, u.String())
+	}
+
+	return u.String()
+}
+
+// response return a response of the downloaded segment, each with its own body.
+func (call *segmentCall) response() *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", call.status, http.StatusText(call.status)),
+		StatusCode:    call.status,
+		Header:        call.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(call.body)),
+		ContentLength: int64(len(call.body)),
+		Request:       call.request,
+	}
+}
+
+// downloadSegment download the whole segment into the call. The download is detached from the
+// request of the client starting it, the other clients still get the segment when it disconnects.
+func (c *Config) downloadSegment(ctx *gin.Context, u *url.URL, call *segmentCall) {
+	downloadCtx, cancel := context.WithTimeout(context.Background(), segmentDownloadTimeout)
+	defer cancel()
+
+	resp, err := c.upstreamRequestContext(downloadCtx, ctx, http.MethodGet, u)
+	if err != nil {
+		call.err = err
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	call.body, call.err = io.ReadAll(io.LimitReader(resp.Body, maxCoalescedSegmentSize+1))
+	if call.err == nil && len(call.body) > maxCoalescedSegmentSize {
+		call.body = nil
+		call.err = fmt.Errorf("%s: segment larger than %d bytes", u.Redacted(), maxCoalescedSegmentSize)
+		return
+	}
+	call.request = resp.Request
+	call.status = resp.StatusCode
+	call.header = resp.Header
+}
@@ -0,0 +1,121 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hlsdownloadsContentTypes is the content type of the files written by ffmpeg by extension.
+var hlsdownloadsContentTypes = map[string]string{
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".aac":  "audio/aac",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".vtt":  "text/vtt",
+	".mpd":  "application/dash+xml",
+}
+
+// hlsdownloadsContentType return the content type of the hlsdownloads file, mpeg-ts by default.
+func hlsdownloadsContentType(filePath string) string {
+	if contentType, ok := hlsdownloadsContentTypes[strings.ToLower(filepath.Ext(filePath))]; ok {
+		return contentType
+	}
+
+	return "video/mp2t"
+}
+
+// isCompressible report whether the content type is text based, the media segments barely compress.
+func isCompressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "mpegurl") ||
+		strings.HasSuffix(contentType, "+xml")
+}
+
+// serveCompressed serve the file gzip-compressed to the clients accepting it, the compressed
+// copy is stored aside the file and written again when the file is more recent.
+func (c *Config) serveCompressed(ctx *gin.Context, filePath, contentType string) {
+	if !strings.Contains(ctx.GetHeader("Accept-Encoding"), "gzip") {
+		ctx.File(filePath)
+		return
+	}
+
+	gzPath := filePath + ".gz"
+	if err := c.compressFile(filePath, gzPath); err != nil {
+		_ = ctx.Error(err) // nolint: errcheck
+		ctx.File(filePath)
+		return
+	}
+
+	ctx.Header("Content-Type", contentType)
+	ctx.Header("Content-Encoding", "gzip")
+	ctx.Header("Vary", "Accept-Encoding")
+	ctx.File(gzPath)
+}
+
+// compressFile write the gzip-compressed copy of the file unless it is up to date.
+func (c *Config) compressFile(filePath, gzPath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if gzInfo, err := os.Stat(gzPath); err == nil && !gzInfo.ModTime().Before(info.ModTime()) {
+		return nil
+	}
+
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func(src *os.File) {
+		_ = src.Close()
+	}(src)
+
+	// the copy is written to a temporary file of its own and renamed once complete, so that a concurrent
+	// request never serves it partially written and the concurrent first requests don't write the same file
+	dst, err := os.CreateTemp(filepath.Dir(gzPath), filepath.Base(gzPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := dst.Name()
+
+	err = dst.Chmod(c.DownloadFileMode)
+	if err == nil {
+		zw := gzip.NewWriter(dst)
+		if _, err = io.Copy(zw, src); err == nil {
+			err = zw.Close()
+		}
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, gzPath)
+}
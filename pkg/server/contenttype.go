@@ -0,0 +1,81 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// forceContentType replace the content type of the upstream stream response by the one
+// configured for the channel or for all the streams, for the players rejecting the
+// application/octet-stream streams. The playlists, manifests and guides keep theirs.
+func (c *Config) forceContentType(ctx *gin.Context, resp *http.Response) {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return
+	}
+	if isDocumentResponse(resp) {
+		return
+	}
+
+	if contentType := c.streamContentType(); contentType != "" {
+		ctx.Header("Content-Type", contentType)
+	}
+}
+
+// streamContentType return the content type forced on the streams of the channel,
+// by tvg-id, name or group in that order, else the one forced on all the streams.
+func (c *Config) streamContentType() string {
+	if c.track != nil {
+		for _, key := range []string{c.track.Tag("tvg-id"), c.track.Name, trackGroup(c.track)} {
+			if key == "" {
+				continue
+			}
+			for name, contentType := range c.StreamContentTypeByChannel {
+				if strings.EqualFold(name, key) {
+					return contentType
+				}
+			}
+		}
+	}
+
+	return c.ForceStreamContentType
+}
+
+// isDocumentResponse report whether the upstream response is a playlist, a manifest or a guide.
+func isDocumentResponse(resp *http.Response) bool {
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	if strings.Contains(contentType, "mpegurl") || strings.Contains(contentType, "xml") {
+		return true
+	}
+
+	if resp.Request == nil {
+		return false
+	}
+
+	switch strings.ToLower(path.Ext(resp.Request.URL.Path)) {
+	case ".m3u8", ".m3u", ".mpd", ".xml":
+		return true
+	}
+
+	return false
+}
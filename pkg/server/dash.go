@@ -0,0 +1,243 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dashURLAttributeRegexp match the segment url attributes holding an absolute url.
+var dashURLAttributeRegexp = regexp.MustCompile(`\b(media|initialization|index|sourceURL)="(https?://[^"]*)"`)
+
+// dashEdit replace the bytes of the manifest between start and end.
+type dashEdit struct {
+	start, end int
+	text       string
+}
+
+// dashProxy serve the channel DASH manifest with its urls rewritten to the proxy.
+func (c *Config) dashProxy(ctx *gin.Context) {
+	rpURL, err := url.Parse(c.track.URI)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	req, err := http.NewRequest("GET", rpURL.String(), nil)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	req.Header.Set("User-Agent", ctx.Request.UserAgent())
+	c.setChannelHeaders(req.Header)
+
+	resp, err := c.upstreamDo(upstreamClient, withSelectedUpstream(ctx, req))
+	if err != nil {
+		_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		ctx.AbortWithStatus(resp.StatusCode)
+		return
+	}
+
+	body, err := c.readUpstreamBody(resp)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+
+	// urls are relative to the url after the redirects
+	manifest, err := c.rewriteDASHManifest(body, resp.Request.URL)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+
+	ctx.Data(http.StatusOK, "application/dash+xml", manifest)
+}
+
+// rewriteDASHManifest rewrite the manifest fetched from base so the segments are requested through the proxy.
+// Every BaseURL is resolved and replaced by a proxy url of the same upstream directory, so the relative
+// segment templates keep working, and a BaseURL of the manifest directory is added when the MPD has none.
+func (c *Config) rewriteDASHManifest(body []byte, base *url.URL) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+
+	var edits []dashEdit
+	// resolved base url of each open element
+	bases := []*url.URL{base}
+	inBaseURL := false
+	mpdEnd, mpdHasBaseURL := -1, false
+
+	for {
+		start := int(decoder.InputOffset())
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := int(decoder.InputOffset())
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			parent := bases[len(bases)-1]
+			bases = append(bases, parent)
+
+			if t.Name.Local == "MPD" && mpdEnd < 0 {
+				mpdEnd = end
+			}
+			if t.Name.Local == "BaseURL" {
+				inBaseURL = true
+				if len(bases) == 3 {
+					mpdHasBaseURL = true
+				}
+			}
+
+			raw := string(body[start:end])
+			rewritten := dashURLAttributeRegexp.ReplaceAllStringFunc(raw, func(attr string) string {
+				m := dashURLAttributeRegexp.FindStringSubmatch(attr)
+				return fmt.Sprintf(`%s="%s"`, m[1], c.proxyDASHURL(m[2]))
+			})
+			if rewritten != raw {
+				edits = append(edits, dashEdit{start, end, rewritten})
+			}
+
+			// a self closing element has no end element token with RawToken
+			if strings.HasSuffix(raw, "/>") {
+				bases = bases[:len(bases)-1]
+				inBaseURL = false
+			}
+		case xml.EndElement:
+			if len(bases) > 1 {
+				bases = bases[:len(bases)-1]
+			}
+			inBaseURL = false
+		case xml.CharData:
+			if !inBaseURL {
+				continue
+			}
+
+			ref, err := url.Parse(strings.TrimSpace(string(t)))
+			if err != nil {
+				continue
+			}
+			// the BaseURL applies to its parent element and the following siblings
+			resolved := bases[len(bases)-2].ResolveReference(ref)
+			bases[len(bases)-2] = resolved
+			edits = append(edits, dashEdit{start, end, c.proxyDASHURL(resolved.String())})
+		}
+	}
+
+	if mpdEnd >= 0 && !mpdHasBaseURL {
+		edits = append(edits, dashEdit{mpdEnd, mpdEnd, fmt.Sprintf("<BaseURL>%s</BaseURL>", c.proxyDASHURL(base.ResolveReference(&url.URL{Path: "./"}).String()))})
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+
+	var buffer bytes.Buffer
+	last := 0
+	for _, edit := range edits {
+		buffer.Write(body[last:edit.start]) // nolint: errcheck
+		buffer.WriteString(edit.text)       // nolint: errcheck
+		last = edit.end
+	}
+	buffer.Write(body[last:]) // nolint: errcheck
+
+	return buffer.Bytes(), nil
+}
+
+// proxyDASHURL return the proxy url of an absolute upstream url, the upstream directory is registered
+// and the file name is kept so the DASH templates like $Number$ still expand.
+func (c *Config) proxyDASHURL(upstream string) string {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return upstream
+	}
+
+	dir, file := path.Split(u.EscapedPath())
+	dirURL := *u
+	dirURL.RawPath = ""
+	dirURL.Path = ""
+	dirURL.RawQuery = ""
+	dirURL.Fragment = ""
+	if unescaped, err := url.PathUnescape(dir); err == nil {
+		dirURL.Path = unescaped
+		dirURL.RawPath = dir
+	}
+
+	key := registerHLSResource(hlsResource{url: dirURL.String(), track: c.track})
+
+	// the segment urls expanded from the templates keep the signature of the directory in their path
+	dirProxyURL, err := url.Parse(fmt.Sprintf("%s%s/dash/%s", c.baseURL(), c.proxyPath(), key))
+	if err != nil {
+		return upstream
+	}
+	proxyURL := fmt.Sprintf("%s/%s/%s", dirProxyURL, c.pathSignature(dirProxyURL), file)
+	if u.RawQuery != "" {
+		proxyURL += "?" + u.RawQuery
+	}
+
+	return proxyURL
+}
+
+// dashResourceHandler serve a file of an upstream directory registered by a rewritten manifest.
+// The segment urls are expanded by the players from the templates, the signature of the directory
+// is checked instead.
+func (c *Config) dashResourceHandler(ctx *gin.Context) {
+	res, ok := getHLSResource(ctx.Param("key"))
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	dirURL, err := url.Parse(res.url)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	ref, err := url.Parse(strings.TrimPrefix(ctx.Param("path"), "/"))
+	if err != nil || ref.IsAbs() || strings.HasPrefix(ref.Path, "/") {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ref.RawQuery = ctx.Request.URL.RawQuery
+
+	trackConfig := *c
+	trackConfig.track = res.track
+
+	trackConfig.streamSegment(ctx, dirURL.ResolveReference(ref))
+}
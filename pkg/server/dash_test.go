@@ -0,0 +1,97 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+var dashBaseURLRegexp = regexp.MustCompile(`<BaseURL>([^<]*)</BaseURL>`)
+
+func TestDASHSignedSegments(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		secret     string
+		tamper     func(baseURL string) string
+		wantStatus int
+	}{
+		{name: "unsigned", wantStatus: http.StatusOK},
+		{name: "signed", secret: "secret", wantStatus: http.StatusOK},
+		{name: "tampered directory", secret: "secret", tamper: func(baseURL string) string {
+			return strings.Replace(baseURL, "/dash/", "/dash/0", 1)
+		}, wantStatus: http.StatusForbidden},
+		{name: "signature removed", secret: "secret", tamper: func(baseURL string) string {
+			i := strings.Index(baseURL, "/dash/") + len("/dash/")
+			key := baseURL[i : i+strings.Index(baseURL[i:], "/")]
+			return baseURL[:i] + key + "/" + unsignedPath + "/"
+		}, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(m3u.Track{Name: "One", Length: -1, URI: upstream.URL + "/live/manifest.mpd"})
+			c.URLSigningSecret = tt.secret
+			c.URLSignTTL = time.Hour
+			proxy := httptest.NewServer(c.router())
+			defer proxy.Close()
+
+			base, _ := url.Parse(upstream.URL + "/live/manifest.mpd")
+			manifest, err := c.rewriteDASHManifest([]byte(`<MPD><Period><AdaptationSet><SegmentTemplate media="seg-$Number$.m4s"/></AdaptationSet></Period></MPD>`), base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := dashBaseURLRegexp.FindStringSubmatch(string(manifest))
+			if m == nil {
+				t.Fatalf("manifest %q has no BaseURL", manifest)
+			}
+			baseURL := m[1]
+			if tt.tamper != nil {
+				baseURL = tt.tamper(baseURL)
+			}
+
+			// the player expands the template against the BaseURL
+			segmentURL := strings.Replace(baseURL, "http://proxy.local:8080", proxy.URL, 1) + "seg-1.m4s"
+			resp, err := http.Get(segmentURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("GET %s status = %d, want %d", segmentURL, resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && string(body) != "/live/seg-1.m4s" {
+				t.Errorf("GET %s body = %q, want the upstream segment", segmentURL, body)
+			}
+		})
+	}
+}
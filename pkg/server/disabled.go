@@ -0,0 +1,181 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// disabledChannels is the channels hidden from the playlists, by tvg-id or upstream url
+// so that they stay disabled across the playlist refreshes.
+var disabledChannels = map[string]struct{}{}
+var disabledChannelsLock = sync.RWMutex{}
+
+type channelState struct {
+	Index    string `json:"index"`
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+}
+
+// isChannelDisabled report whether the channel is hidden from the playlists.
+func isChannelDisabled(track *m3u.Track) bool {
+	disabledChannelsLock.RLock()
+	defer disabledChannelsLock.RUnlock()
+
+	_, ok := disabledChannels[diffKey(track)]
+	return ok
+}
+
+// loadDisabledChannels read the channels disabled before a restart, nil when the file is not configured
+// or missing, so that the current ones are kept.
+func loadDisabledChannels(filePath string) (map[string]struct{}, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("invalid disabled channels file %s: %w", filePath, err)
+	}
+
+	disabled := map[string]struct{}{}
+	for _, key := range keys {
+		disabled[key] = struct{}{}
+	}
+
+	return disabled, nil
+}
+
+// setDisabledChannels replace the disabled channels.
+func setDisabledChannels(disabled map[string]struct{}) {
+	disabledChannelsLock.Lock()
+	defer disabledChannelsLock.Unlock()
+
+	disabledChannels = disabled
+}
+
+// saveDisabledChannels persist the disabled channels, when configured.
+func (c *Config) saveDisabledChannels() error {
+	if c.DisabledChannelsFile == "" {
+		return nil
+	}
+
+	disabledChannelsLock.RLock()
+	keys := make([]string, 0, len(disabledChannels))
+	for key := range disabledChannels {
+		keys = append(keys, key)
+	}
+	disabledChannelsLock.RUnlock()
+	sort.Strings(keys)
+
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := c.DisabledChannelsFile + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, c.DisabledChannelsFile)
+}
+
+// postChannelDisable hide the channel from the playlists, its streams are answered 403.
+func (c *Config) postChannelDisable(ctx *gin.Context) {
+	c.setChannelDisabled(ctx, true)
+}
+
+// postChannelEnable serve the disabled channel again.
+func (c *Config) postChannelEnable(ctx *gin.Context) {
+	c.setChannelDisabled(ctx, false)
+}
+
+func (c *Config) setChannelDisabled(ctx *gin.Context, disabled bool) {
+	index := ctx.Param("index")
+	track, ok := c.trackByIndex(index)
+	if !ok {
+		_ = ctx.AbortWithError(http.StatusNotFound, fmt.Errorf("unknown channel %q", index)) // nolint: errcheck
+		return
+	}
+
+	disabledChannelsLock.Lock()
+	if disabled {
+		disabledChannels[diffKey(&track)] = struct{}{}
+	} else {
+		delete(disabledChannels, diffKey(&track))
+	}
+	disabledChannelsLock.Unlock()
+
+	if disabled {
+		logger.Infof("%s | channel %s disabled", ctx.ClientIP(), track.Name)
+	} else {
+		logger.Infof("%s | channel %s enabled", ctx.ClientIP(), track.Name)
+	}
+
+	if err := c.saveDisabledChannels(); err != nil {
+		logger.Errorf("disabled channels: %s", err)
+	}
+	if err := c.rewritePlaylistFile(); err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	ctx.JSON(http.StatusOK, channelState{Index: index, Name: track.Name, Disabled: disabled})
+}
+
+// rewritePlaylistFile write the cached playlist again from the current tracks.
+func (c *Config) rewritePlaylistFile() error {
+	if !c.PlaylistFileCache {
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(c.proxyfiedM3UPath), filepath.Base(c.proxyfiedM3UPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = c.writeTracks(f, c.tracks(), false, nil)
+	_ = f.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	playlistLock.Lock()
+	defer playlistLock.Unlock()
+
+	return os.Rename(f.Name(), c.proxyfiedM3UPath)
+}
@@ -0,0 +1,67 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestDisabledChannelsHidden(t *testing.T) {
+	enabled := m3u.Track{Name: "Enabled", URI: "http://upstream.tv/1.m3u8"}
+	disabled := m3u.Track{Name: "Disabled", URI: "http://upstream.tv/2.m3u8"}
+	c := newTestConfig(enabled, disabled)
+	c.HDHomeRun = true
+	c.TimeshiftBufferByChannel = map[string]time.Duration{"Disabled": time.Hour}
+
+	setDisabledChannels(map[string]struct{}{diffKey(&disabled): {}})
+	defer setDisabledChannels(map[string]struct{}{})
+
+	t.Run("hdhomerun lineup", func(t *testing.T) {
+		w := serveTest(c, httptest.NewRequest(http.MethodGet, "/lineup.json?username=user&password=pass", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+
+		var lineup []hdhrLineupEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &lineup); err != nil {
+			t.Fatal(err)
+		}
+		if len(lineup) != 1 || lineup[0].GuideName != "Enabled" {
+			t.Errorf("lineup = %+v, want the enabled channel only", lineup)
+		}
+	})
+
+	t.Run("timeshift", func(t *testing.T) {
+		dvrBuffersLock.Lock()
+		dvrBuffers[diffKey(&disabled)] = &dvrBuffer{dir: t.TempDir()}
+		dvrBuffersLock.Unlock()
+		defer removeTimeshiftBuffers(nil)
+
+		w := serveTest(c, httptest.NewRequest(http.MethodGet, c.proxyPath()+"/timeshift/1/playlist.m3u8", nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+		}
+	})
+}
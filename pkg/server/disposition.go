@@ -0,0 +1,55 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import "fmt"
+
+const (
+	// dispositionAttachment let the browsers save the playlist as a file, the default
+	dispositionAttachment = "attachment"
+	// dispositionInline let the browsers display the playlist
+	dispositionInline = "inline"
+)
+
+// validDisposition report whether the playlist Content-Disposition type is supported.
+func validDisposition(disposition string) bool {
+	switch disposition {
+	case dispositionAttachment, dispositionInline:
+		return true
+	default:
+		return false
+	}
+}
+
+// playlistDisposition return the Content-Disposition of the playlist,
+// named after the m3u file name unless a playlist filename is set.
+func (c *Config) playlistDisposition() string {
+	name := c.M3UFileName
+	if c.PlaylistFilename != "" {
+		name = c.PlaylistFilename
+	}
+
+	return c.playlistFileDisposition(name)
+}
+
+// playlistFileDisposition return the Content-Disposition of a playlist served as the file name,
+// e.g. the playlists of a group or a chunk.
+func (c *Config) playlistFileDisposition(name string) string {
+	return fmt.Sprintf(`%s; filename=%q`, c.PlaylistDisposition, name)
+}
@@ -0,0 +1,53 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestPlaylistDisposition(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/iptv.m3u", want: `inline; filename="iptv.m3u"`},
+		{path: "/group/News.m3u", want: `inline; filename="News.m3u"`},
+		{path: "/playlist/1.m3u", want: `inline; filename="1.m3u"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			c := newTestConfig(m3u.Track{Name: "One", Length: -1, URI: "http://upstream.tv/1.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "News"}}})
+			c.PlaylistDisposition = dispositionInline
+			c.PlaylistChunkSize = 1
+
+			w := serveTest(c, httptest.NewRequest(http.MethodGet, tt.path+"?username=user&password=pass", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s status = %d, want %d", tt.path, w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Content-Disposition"); got != tt.want {
+				t.Errorf("GET %s Content-Disposition = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
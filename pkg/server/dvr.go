@@ -0,0 +1,725 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grafov/m3u8"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// dvrRetryDelay is the delay before polling again the playlist of a channel whose recording failed.
+const dvrRetryDelay = 10 * time.Second
+
+// dvrRequestTimeout bound the upstream playlist and segment requests of the recordings.
+const dvrRequestTimeout = 30 * time.Second
+
+// dvrSegment is a segment of a channel recorded in its timeshift buffer.
+type dvrSegment struct {
+	seq uint64
+	// media sequence number of the segment upstream, the implicit IV of its key
+	upstreamSeq   uint64
+	file          string
+	duration      float64
+	size          int64
+	discontinuity bool
+	// the key of an encrypted segment, its uri pointing at the upstream
+	key *m3u8.Key
+	time.Time
+}
+
+// dvrBuffer is the rolling timeshift buffer of a channel, the segments of the last retention
+// period recorded on disk, the oldest first.
+type dvrBuffer struct {
+	lock      sync.RWMutex
+	dir       string
+	retention time.Duration
+	segments  []dvrSegment
+	// files is the path of the buffered segments by file name, the segments requested by the players
+	files map[string]string
+	// local sequence number of the next segment, the upstream numbering restarts with the provider
+	next           uint64
+	targetDuration float64
+	// upstream sequence number of the last segment recorded, kept across the reloads
+	// so that the new recorder goes on where the previous one stopped
+	lastSeq  uint64
+	recorded bool
+	// held while the segments are recorded, the recorder of the previous configuration
+	// may still be finishing a segment after a reload
+	recording sync.Mutex
+}
+
+// dvrBuffers are the timeshift buffers by channel key, kept across the reloads.
+var dvrBuffers = map[string]*dvrBuffer{}
+var dvrBuffersLock = sync.Mutex{}
+
+// timeshiftRetention return the retention of the timeshift buffer of the channel,
+// by tvg-id, name or group in that order, zero when the channel is not buffered.
+func (c *Config) timeshiftRetention(track *m3u.Track) time.Duration {
+	for _, key := range []string{track.Tag("tvg-id"), track.Name, trackGroup(track)} {
+		if key == "" {
+			continue
+		}
+		for name, retention := range c.TimeshiftBufferByChannel {
+			if strings.EqualFold(name, key) {
+				return retention
+			}
+		}
+	}
+
+	return 0
+}
+
+// startTimeshiftBuffers start recording the hls channels with a timeshift buffer,
+// until the configuration is replaced. The buffers of the channels no longer buffered are removed.
+func (c *Config) startTimeshiftBuffers() {
+	buffered := map[string]struct{}{}
+	defer removeTimeshiftBuffers(buffered)
+	if len(c.TimeshiftBufferByChannel) == 0 {
+		return
+	}
+
+	tracks := c.tracks()
+	for i := range tracks {
+		track := tracks[i]
+		retention := c.timeshiftRetention(&track)
+		if retention <= 0 {
+			continue
+		}
+		if c.knownStreamType(track.URI) != streamTypeHLS {
+			logger.Warnf("timeshift buffer of %s: only the hls channels are buffered", track.Name)
+			continue
+		}
+
+		key := diffKey(&track)
+		buffered[key] = struct{}{}
+		buffer, err := c.dvrBuffer(key, retention)
+		if err != nil {
+			logger.Errorf("timeshift buffer of %s: %s", track.Name, err)
+			continue
+		}
+
+		trackConfig := *c
+		trackConfig.track = &track
+		go trackConfig.recordTimeshift(key, buffer)
+	}
+}
+
+// removeTimeshiftBuffers remove the buffers of the channels other than the buffered ones, with their segments.
+func removeTimeshiftBuffers(buffered map[string]struct{}) {
+	dvrBuffersLock.Lock()
+	defer dvrBuffersLock.Unlock()
+
+	for key, buffer := range dvrBuffers {
+		if _, ok := buffered[key]; ok {
+			continue
+		}
+
+		delete(dvrBuffers, key)
+		buffer.lock.Lock()
+		buffer.segments = nil
+		buffer.files = nil
+		buffer.lock.Unlock()
+		if err := os.RemoveAll(buffer.dir); err != nil {
+			logger.Errorf("timeshift buffer %s: %s", buffer.dir, err)
+		}
+	}
+}
+
+// dvrBuffer return the buffer of the channel, a new one recorded in an empty directory.
+func (c *Config) dvrBuffer(key string, retention time.Duration) (*dvrBuffer, error) {
+	dvrBuffersLock.Lock()
+	defer dvrBuffersLock.Unlock()
+
+	if buffer, ok := dvrBuffers[key]; ok {
+		buffer.lock.Lock()
+		buffer.retention = retention
+		buffer.lock.Unlock()
+		return buffer, nil
+	}
+
+	sum := sha1.Sum([]byte(key))
+	dir := filepath.Join(c.TimeshiftDir, hex.EncodeToString(sum[:8]))
+	// the segments left by a previous run are not indexed
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, c.DownloadDirMode); err != nil {
+		return nil, err
+	}
+
+	buffer := &dvrBuffer{dir: dir, retention: retention}
+	dvrBuffers[key] = buffer
+
+	return buffer, nil
+}
+
+// recordTimeshift poll the media playlist of the channel and download its new segments
+// into the buffer, until the configuration is replaced.
+func (c *Config) recordTimeshift(key string, buffer *dvrBuffer) {
+	logger.Infof("timeshift buffer of %s started, retention %s", c.track.Name, buffer.retention)
+
+	var mediaURL string
+	for {
+		// the url of the channel changes with the playlist refresh
+		if track, ok := c.trackByKey(key); ok && track.URI != c.track.URI {
+			c.track = &track
+			mediaURL = ""
+		}
+
+		delay := dvrRetryDelay
+		mediaList, u, err := c.fetchMediaPlaylist(mediaURL)
+		if err != nil {
+			logger.Warnf("timeshift buffer of %s: %s", c.track.Name, err)
+		} else {
+			mediaURL = u.String()
+			c.recordSegments(buffer, mediaList, u)
+			if mediaList.TargetDuration > 0 {
+				delay = time.Duration(mediaList.TargetDuration * float64(time.Second))
+			}
+			pruneTimeshiftBuffers(int64(c.TimeshiftMaxSizeMB) << 20)
+		}
+
+		select {
+		case <-c.stop:
+			logger.Infof("timeshift buffer of %s stopped", c.track.Name)
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// trackByKey return the current track of the channel key.
+func (c *Config) trackByKey(key string) (m3u.Track, bool) {
+	tracks := c.tracks()
+	for i := range tracks {
+		if diffKey(&tracks[i]) == key {
+			return tracks[i], true
+		}
+	}
+
+	return m3u.Track{}, false
+}
+
+// fetchMediaPlaylist fetch the media playlist of the channel, the variant of the highest
+// bandwidth of a master playlist, or the media playlist already resolved.
+func (c *Config) fetchMediaPlaylist(mediaURL string) (*m3u8.MediaPlaylist, *url.URL, error) {
+	if mediaURL == "" {
+		mediaURL = c.track.URI
+	}
+
+	for level := 0; level < 2; level++ {
+		ctx, cancel := context.WithTimeout(context.Background(), dvrRequestTimeout)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		c.setChannelHeaders(req.Header)
+
+		resp, err := c.upstreamDo(upstreamClient, req)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		body := newMaxBytesReader(resp.Body, c.MaxSegmentBytes)
+		p, listType, err := m3u8.DecodeFrom(bufio.NewReader(body), true)
+		_ = resp.Body.Close()
+		cancel()
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("upstream playlist %s: unexpected status %s", mediaURL, resp.Status)
+		}
+		if body.exceeded() {
+			return nil, nil, fmt.Errorf("upstream playlist %s: %w: more than %d bytes", mediaURL, errTooLarge, c.MaxSegmentBytes)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if listType == m3u8.MEDIA {
+			return p.(*m3u8.MediaPlaylist), resp.Request.URL, nil
+		}
+
+		var best *m3u8.Variant
+		for _, variant := range p.(*m3u8.MasterPlaylist).Variants {
+			if variant != nil && !variant.Iframe && (best == nil || variant.Bandwidth > best.Bandwidth) {
+				best = variant
+			}
+		}
+		if best == nil {
+			return nil, nil, fmt.Errorf("upstream playlist %s has no variant", mediaURL)
+		}
+		ref, err := url.Parse(best.URI)
+		if err != nil {
+			return nil, nil, err
+		}
+		mediaURL = resp.Request.URL.ResolveReference(ref).String()
+	}
+
+	return nil, nil, fmt.Errorf("upstream playlist %s: nested master playlists", c.track.URI)
+}
+
+// recordSegments download the segments of the media playlist newer than the last recorded one,
+// and keep the upstream sequence number of the last one recorded in the buffer.
+func (c *Config) recordSegments(buffer *dvrBuffer, mediaList *m3u8.MediaPlaylist, base *url.URL) {
+	var segments []*m3u8.MediaSegment
+	for _, segment := range mediaList.Segments {
+		if segment != nil {
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 {
+		return
+	}
+
+	buffer.recording.Lock()
+	defer buffer.recording.Unlock()
+
+	buffer.lock.RLock()
+	lastSeq, recorded := buffer.lastSeq, buffer.recorded
+	buffer.lock.RUnlock()
+
+	first := mediaList.SeqNo
+	newest := first + uint64(len(segments)) - 1
+	// the provider restarted the numbering, the buffer goes on from the current segments
+	restarted := recorded && newest < lastSeq
+	var key *m3u8.Key
+	for i, segment := range segments {
+		seq := first + uint64(i)
+		if segment.Key != nil {
+			key = absoluteKey(segment.Key, base)
+		}
+		if recorded && !restarted && seq <= lastSeq {
+			continue
+		}
+
+		ref, err := url.Parse(segment.URI)
+		if err != nil {
+			continue
+		}
+		// a gap in the recording, the segments expired from the upstream playlist meanwhile
+		gap := recorded && (restarted || seq > lastSeq+1)
+		if err := c.recordSegment(buffer, base.ResolveReference(ref), seq, segment, key, gap || segment.Discontinuity); err != nil {
+			logger.Warnf("timeshift buffer of %s: segment %s: %s", c.track.Name, segment.URI, err)
+		}
+		lastSeq, recorded, restarted = seq, true, false
+		buffer.lock.Lock()
+		buffer.lastSeq, buffer.recorded = lastSeq, recorded
+		buffer.lock.Unlock()
+
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+	}
+
+	buffer.lock.Lock()
+	buffer.targetDuration = mediaList.TargetDuration
+	buffer.lock.Unlock()
+	buffer.expire()
+}
+
+// absoluteKey return the key with its uri resolved against the playlist url.
+func absoluteKey(key *m3u8.Key, base *url.URL) *m3u8.Key {
+	abs := *key
+	if ref, err := url.Parse(key.URI); err == nil && key.URI != "" {
+		abs.URI = base.ResolveReference(ref).String()
+	}
+
+	return &abs
+}
+
+// recordSegment download the segment into the buffer directory.
+func (c *Config) recordSegment(buffer *dvrBuffer, u *url.URL, upstreamSeq uint64, segment *m3u8.MediaSegment, key *m3u8.Key, discontinuity bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dvrRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	c.setChannelHeaders(req.Header)
+
+	resp, err := c.upstreamDo(upstreamClient, req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	ext := path.Ext(u.Path)
+	if ext == "" {
+		ext = ".ts"
+	}
+
+	buffer.lock.Lock()
+	seq := buffer.next
+	buffer.next++
+	buffer.lock.Unlock()
+
+	file := filepath.Join(buffer.dir, strconv.FormatUint(seq, 10)+ext)
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, c.DownloadFileMode)
+	if err != nil {
+		return err
+	}
+	// the partial file of a segment larger than the maximum is removed, the error logged by the recorder
+	size, err := io.Copy(f, newMaxBytesReader(resp.Body, c.MaxSegmentBytes))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file)
+		return err
+	}
+
+	buffer.lock.Lock()
+	buffer.addSegment(dvrSegment{
+		seq:           seq,
+		upstreamSeq:   upstreamSeq,
+		file:          file,
+		duration:      segment.Duration,
+		size:          size,
+		discontinuity: discontinuity,
+		key:           key,
+		Time:          time.Now(),
+	})
+	buffer.lock.Unlock()
+
+	return nil
+}
+
+// addSegment add the newest segment to the buffer, its lock must be held.
+func (b *dvrBuffer) addSegment(segment dvrSegment) {
+	if b.files == nil {
+		b.files = map[string]string{}
+	}
+	b.segments = append(b.segments, segment)
+	b.files[filepath.Base(segment.file)] = segment.file
+}
+
+// expire remove the segments older than the retention of the buffer.
+func (b *dvrBuffer) expire() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var kept float64
+	i := len(b.segments)
+	for i > 0 && kept+b.segments[i-1].duration <= b.retention.Seconds() {
+		kept += b.segments[i-1].duration
+		i--
+	}
+	b.removeOldest(i)
+}
+
+// removeOldest remove the n oldest segments of the buffer, its lock must be held.
+func (b *dvrBuffer) removeOldest(n int) {
+	for _, segment := range b.segments[:n] {
+		_ = os.Remove(segment.file)
+		delete(b.files, filepath.Base(segment.file))
+	}
+	b.segments = b.segments[n:]
+}
+
+// pruneTimeshiftBuffers remove the oldest segments of all the buffers until their total size
+// is within the maximum, zero for no maximum.
+func pruneTimeshiftBuffers(maxSize int64) {
+	if maxSize <= 0 {
+		return
+	}
+
+	// the buffers lock is held so that a single pruning locks all the buffers at a time
+	dvrBuffersLock.Lock()
+	defer dvrBuffersLock.Unlock()
+
+	buffers := make([]*dvrBuffer, 0, len(dvrBuffers))
+	for _, buffer := range dvrBuffers {
+		buffer.lock.Lock()
+		buffers = append(buffers, buffer)
+	}
+	defer func() {
+		for _, buffer := range buffers {
+			buffer.lock.Unlock()
+		}
+	}()
+
+	var total int64
+	for _, buffer := range buffers {
+		for _, segment := range buffer.segments {
+			total += segment.size
+		}
+	}
+
+	for total > maxSize {
+		var oldest *dvrBuffer
+		for _, buffer := range buffers {
+			if len(buffer.segments) > 0 && (oldest == nil || buffer.segments[0].Time.Before(oldest.segments[0].Time)) {
+				oldest = buffer
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		total -= oldest.segments[0].size
+		oldest.removeOldest(1)
+	}
+}
+
+// timeshiftChannel is a channel of the timeshift buffers api.
+type timeshiftChannel struct {
+	Index    string     `json:"index"`
+	Name     string     `json:"name"`
+	Playlist string     `json:"playlist"`
+	From     *time.Time `json:"from,omitempty"`
+	To       *time.Time `json:"to,omitempty"`
+	Segments int        `json:"segments"`
+}
+
+// getTimeshiftChannels list the channels with a timeshift buffer and the period they hold.
+func (c *Config) getTimeshiftChannels(ctx *gin.Context) {
+	rc := c.requestConfig(ctx)
+	tracks := c.tracks()
+
+	channels := make([]timeshiftChannel, 0)
+	dvrBuffersLock.Lock()
+	defer dvrBuffersLock.Unlock()
+	for i := range tracks {
+		buffer, ok := dvrBuffers[diffKey(&tracks[i])]
+		if !ok {
+			continue
+		}
+
+		index := c.encodeTrackIndex(i, tracks[i].URI)
+		channel := timeshiftChannel{Index: index, Name: tracks[i].Name, Playlist: rc.timeshiftURL(index, "playlist.m3u8")}
+		buffer.lock.RLock()
+		if n := len(buffer.segments); n > 0 {
+			from := buffer.segments[0].Time.Add(-time.Duration(buffer.segments[0].duration * float64(time.Second)))
+			to := buffer.segments[n-1].Time
+			channel.From, channel.To, channel.Segments = &from, &to, n
+		}
+		buffer.lock.RUnlock()
+		channels = append(channels, channel)
+	}
+
+	ctx.JSON(http.StatusOK, channels)
+}
+
+// timeshiftURL return the signed url of a file of the timeshift buffer of the channel.
+func (c *Config) timeshiftURL(index, file string) string {
+	u, err := url.Parse(fmt.Sprintf("%s%s/timeshift/%s/%s", c.baseURL(), c.proxyPath(), index, file))
+	if err != nil {
+		return ""
+	}
+	c.signURL(u)
+
+	return u.String()
+}
+
+// timeshiftHandler serve the playlist of the timeshift buffer of the channel, or one of its segments.
+func (c *Config) timeshiftHandler(ctx *gin.Context) {
+	index := ctx.Param("index")
+	track, ok := c.trackByIndex(index)
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if isChannelDisabled(&track) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	dvrBuffersLock.Lock()
+	buffer, ok := dvrBuffers[diffKey(&track)]
+	dvrBuffersLock.Unlock()
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if file := ctx.Param("file"); file != "playlist.m3u8" {
+		buffer.serveSegment(ctx, file)
+		return
+	}
+
+	trackConfig := *c.requestConfig(ctx)
+	trackConfig.track = &track
+	trackConfig.serveTimeshiftPlaylist(ctx, index, buffer)
+}
+
+// serveTimeshiftPlaylist serve the buffered segments from the start query, a unix time,
+// or else from the offset query, a duration before now redirected to its start.
+// The playlist grows with the recording and starts the players at its beginning.
+func (c *Config) serveTimeshiftPlaylist(ctx *gin.Context, index string, buffer *dvrBuffer) {
+	var start time.Time
+	if offset := ctx.Query("offset"); offset != "" {
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid offset %q: %w", offset, err)) // nolint: errcheck
+			return
+		}
+		u, err := url.Parse(c.timeshiftURL(index, "playlist.m3u8"))
+		if err != nil {
+			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		q := u.Query()
+		q.Set("start", strconv.FormatInt(time.Now().Add(-d).Unix(), 10))
+		u.RawQuery = q.Encode()
+		ctx.Redirect(http.StatusFound, u.String())
+		return
+	}
+	if s := ctx.Query("start"); s != "" {
+		unix, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid start %q: expected a unix time", s)) // nolint: errcheck
+			return
+		}
+		start = time.Unix(unix, 0)
+	}
+
+	buffer.lock.RLock()
+	defer buffer.lock.RUnlock()
+
+	// the segment being played at the start
+	from := sort.Search(len(buffer.segments), func(i int) bool {
+		return !buffer.segments[i].Time.Before(start)
+	})
+	segments := buffer.segments[from:]
+	if len(segments) == 0 {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	targetDuration := buffer.targetDuration
+	for _, segment := range segments {
+		if segment.duration > targetDuration {
+			targetDuration = segment.duration
+		}
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(targetDuration+0.999))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].seq)
+	b.WriteString("#EXT-X-START:TIME-OFFSET=0,PRECISE=YES\n")
+
+	var key *m3u8.Key
+	for _, segment := range segments {
+		if segment.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if segmentKey := segment.explicitKey(); !sameKey(segmentKey, key) {
+			key = segmentKey
+			c.writeKey(&b, key)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", segment.duration, c.timeshiftURL(index, filepath.Base(segment.file)))
+	}
+
+	ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(b.String()))
+}
+
+func sameKey(a, b *m3u8.Key) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// explicitKey return the key of the segment with its IV, the players derive a missing one
+// from the media sequence number, which the buffer renumbers.
+func (s *dvrSegment) explicitKey() *m3u8.Key {
+	if s.key == nil || s.key.IV != "" || s.key.Method != "AES-128" {
+		return s.key
+	}
+
+	key := *s.key
+	key.IV = fmt.Sprintf("0x%032X", s.upstreamSeq)
+
+	return &key
+}
+
+// writeKey write the EXT-X-KEY tag of the following segments, the key goes through the proxy
+// as its upstream uri may carry the provider credentials.
+func (c *Config) writeKey(b *strings.Builder, key *m3u8.Key) {
+	if key == nil {
+		b.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+		return
+	}
+
+	fmt.Fprintf(b, "#EXT-X-KEY:METHOD=%s", key.Method)
+	if key.URI != "" {
+		uri, _ := c.hlsResourceURL(hlsResource{url: key.URI, level: 1, track: c.track})
+		fmt.Fprintf(b, ",URI=%q", uri)
+	}
+	if key.IV != "" {
+		fmt.Fprintf(b, ",IV=%s", key.IV)
+	}
+	if key.Keyformat != "" {
+		fmt.Fprintf(b, ",KEYFORMAT=%q", key.Keyformat)
+	}
+	if key.Keyformatversions != "" {
+		fmt.Fprintf(b, ",KEYFORMATVERSIONS=%q", key.Keyformatversions)
+	}
+	b.WriteString("\n")
+}
+
+// segmentFile return the path of the buffered segment by its file name.
+func (b *dvrBuffer) segmentFile(name string) (string, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	file, ok := b.files[name]
+
+	return file, ok
+}
+
+// serveSegment serve a segment of the buffer, 404 once it has expired.
+func (b *dvrBuffer) serveSegment(ctx *gin.Context, file string) {
+	found, ok := b.segmentFile(file)
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.Header("Content-Type", hlsdownloadsContentType(found))
+	ctx.File(found)
+}
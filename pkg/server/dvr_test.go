@@ -0,0 +1,206 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grafov/m3u8"
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestRecordSegmentsResumesAfterReload(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	mediaList, err := m3u8.NewMediaPlaylist(5, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaList.SeqNo = 3
+	for i := 3; i <= 7; i++ {
+		if err := mediaList.Append("segment.ts", 4, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base, _ := url.Parse(upstream.URL + "/index.m3u8")
+
+	// the previous recorder stopped after the segment 5
+	buffer := &dvrBuffer{dir: t.TempDir(), retention: time.Hour, lastSeq: 5, recorded: true}
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{DownloadFileMode: 0o644},
+		track:       &m3u.Track{Name: "channel"},
+		stop:        make(chan struct{}),
+	}
+	c.recordSegments(buffer, mediaList, base)
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("downloaded %d segments, want the 2 newer than the last recorded", n)
+	}
+	if len(buffer.segments) != 2 || buffer.segments[0].discontinuity {
+		t.Errorf("recorded %+v, want 2 segments without discontinuity", buffer.segments)
+	}
+	if buffer.lastSeq != 7 {
+		t.Errorf("last sequence = %d, want 7", buffer.lastSeq)
+	}
+}
+
+func TestRemoveTimeshiftBuffers(t *testing.T) {
+	dir := t.TempDir()
+	kept := &dvrBuffer{dir: filepath.Join(dir, "kept")}
+	removed := &dvrBuffer{dir: filepath.Join(dir, "removed")}
+	for _, buffer := range []*dvrBuffer{kept, removed} {
+		if err := os.MkdirAll(buffer.dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dvrBuffersLock.Lock()
+	dvrBuffers = map[string]*dvrBuffer{"kept": kept, "removed": removed}
+	dvrBuffersLock.Unlock()
+	defer func() {
+		dvrBuffersLock.Lock()
+		dvrBuffers = map[string]*dvrBuffer{}
+		dvrBuffersLock.Unlock()
+	}()
+
+	removeTimeshiftBuffers(map[string]struct{}{"kept": {}})
+
+	if _, ok := dvrBuffers["removed"]; ok {
+		t.Error("the buffer of the unconfigured channel is kept")
+	}
+	if _, ok := dvrBuffers["kept"]; !ok {
+		t.Error("the buffer of the configured channel is removed")
+	}
+	if _, err := os.Stat(removed.dir); !os.IsNotExist(err) {
+		t.Errorf("the directory of the removed buffer is kept: %v", err)
+	}
+	if _, err := os.Stat(kept.dir); err != nil {
+		t.Errorf("the directory of the kept buffer is removed: %v", err)
+	}
+}
+
+// newTestDVRBuffer return a buffer of n segments of a second, the files are not written.
+func newTestDVRBuffer(dir string, n int) *dvrBuffer {
+	buffer := &dvrBuffer{dir: dir, retention: time.Hour}
+	for i := 0; i < n; i++ {
+		buffer.addSegment(dvrSegment{seq: uint64(i), file: filepath.Join(dir, fmt.Sprintf("%d.ts", i)), duration: 1, Time: time.Now()})
+	}
+
+	return buffer
+}
+
+func TestTimeshiftServeSegment(t *testing.T) {
+	buffer := newTestDVRBuffer(t.TempDir(), 3)
+	for _, segment := range buffer.segments {
+		if err := os.WriteFile(segment.file, []byte(filepath.Base(segment.file)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffer.lock.Lock()
+	buffer.removeOldest(1)
+	buffer.lock.Unlock()
+
+	tests := []struct {
+		file       string
+		wantStatus int
+	}{
+		{file: "0.ts", wantStatus: http.StatusNotFound},
+		{file: "1.ts", wantStatus: http.StatusOK},
+		{file: "2.ts", wantStatus: http.StatusOK},
+		{file: "3.ts", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/"+tt.file, nil)
+		buffer.serveSegment(ctx, tt.file)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("serveSegment(%q) status = %d, want %d", tt.file, w.Code, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusOK && w.Body.String() != tt.file {
+			t.Errorf("serveSegment(%q) body = %q", tt.file, w.Body.String())
+		}
+	}
+}
+
+func BenchmarkTimeshiftSegmentLookup(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			buffer := newTestDVRBuffer(b.TempDir(), n)
+			// the players mostly request the newest segments
+			file := filepath.Base(buffer.segments[n-1].file)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := buffer.segmentFile(file); !ok {
+					b.Fatalf("segment %s not found", file)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeshiftPlaylistKeys(t *testing.T) {
+	keyURI := "http://upstream.tv/key?username=provider&password=secret"
+	buffer := newTestDVRBuffer(t.TempDir(), 3)
+	for i := range buffer.segments {
+		buffer.segments[i].upstreamSeq = uint64(100 + i)
+		buffer.segments[i].key = &m3u8.Key{Method: "AES-128", URI: keyURI}
+	}
+	buffer.segments[2].key = &m3u8.Key{Method: "AES-128", URI: keyURI, IV: "0x0123456789ABCDEF0123456789ABCDEF"}
+
+	c := newTestConfig()
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/playlist.m3u8", nil)
+	c.serveTimeshiftPlaylist(ctx, "0", buffer)
+
+	body := w.Body.String()
+	// the players derive the IV from the media sequence, renumbered by the buffer
+	for _, iv := range []string{"IV=0x00000000000000000000000000000064", "IV=0x00000000000000000000000000000065", "IV=0x0123456789ABCDEF0123456789ABCDEF"} {
+		if !strings.Contains(body, iv) {
+			t.Errorf("playlist %q, want the key %s", body, iv)
+		}
+	}
+	if strings.Contains(body, "secret") {
+		t.Errorf("playlist %q, want the key uri through the proxy", body)
+	}
+	if !strings.Contains(body, `URI="http://proxy.local:8080/`+defaultEndpointAntiColision+`/user/pass/hls/`) {
+		t.Errorf("playlist %q, want the key uri through the proxy", body)
+	}
+}
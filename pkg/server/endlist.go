@@ -0,0 +1,59 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+const (
+	// endListAuto never end the served playlist of a live channel, a vod is served as ffmpeg wrote it
+	endListAuto = "auto"
+	// endListKeep serve the EXT-X-ENDLIST as ffmpeg wrote it, written when it exits
+	endListKeep = "keep"
+	// endListStrip never end the served playlist, all the channels are live
+	endListStrip = "strip"
+)
+
+// validEndList report whether the EXT-X-ENDLIST handling is supported.
+func validEndList(mode string) bool {
+	switch mode {
+	case endListAuto, endListKeep, endListStrip:
+		return true
+	default:
+		return false
+	}
+}
+
+// upstreamEndList return whether the playlist written by ffmpeg is served with EXT-X-ENDLIST,
+// nil to serve it as written. A live channel is never ended, even when ffmpeg exits.
+// A vod is served as written: ffmpeg keeps a sliding window of segments while it transcodes
+// and writes the EXT-X-ENDLIST once it exits, ending it before would stop the players
+// after the first segments.
+func (c *Config) upstreamEndList(probe channelProbe) *bool {
+	live := false
+	switch c.HLSEndList {
+	case endListStrip:
+		return &live
+	case endListAuto:
+		// the upstream master playlist doesn't tell, the variants are not fetched
+		if !probe.media || probe.closed {
+			return nil
+		}
+		return &live
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+)
+
+func TestUpstreamEndList(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		probe channelProbe
+		want  *bool
+	}{
+		{name: "auto live", mode: endListAuto, probe: channelProbe{media: true}, want: boolPtr(false)},
+		{name: "auto vod served as written", mode: endListAuto, probe: channelProbe{media: true, closed: true}, want: nil},
+		{name: "auto master", mode: endListAuto, probe: channelProbe{}, want: nil},
+		{name: "keep live", mode: endListKeep, probe: channelProbe{media: true}, want: nil},
+		{name: "keep vod", mode: endListKeep, probe: channelProbe{media: true, closed: true}, want: nil},
+		{name: "strip vod", mode: endListStrip, probe: channelProbe{media: true, closed: true}, want: boolPtr(false)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{ProxyConfig: &config.ProxyConfig{HLSEndList: tt.mode}}
+			got := c.upstreamEndList(tt.probe)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("upstreamEndList() = %v, want %v", fmtBoolPtr(got), fmtBoolPtr(tt.want))
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func fmtBoolPtr(b *bool) string {
+	if b == nil {
+		return "nil"
+	}
+	if *b {
+		return "true"
+	}
+	return "false"
+}
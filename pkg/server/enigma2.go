@@ -0,0 +1,81 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+const enigma2BouquetFileName = "userbouquet.iptv-proxy.tv"
+
+// enigma2ServiceTypes are the service types able to play an http stream,
+// 4097 is the gstreamer player, 5001 and 5002 are the exteplayer3 and gstplayer ones.
+var enigma2ServiceTypes = []int{1, 4097, 5001, 5002}
+
+func validEnigma2ServiceType(serviceType int) bool {
+	for _, t := range enigma2ServiceTypes {
+		if t == serviceType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enigma2Escape escape the characters which are separators in a bouquet service line.
+func enigma2Escape(s string) string {
+	return strings.ReplaceAll(s, ":", "%3a")
+}
+
+// getEnigma2Bouquet serve the playlist as an Enigma2 userbouquet file.
+func (c *Config) getEnigma2Bouquet(ctx *gin.Context) {
+	var buffer bytes.Buffer
+	buffer.WriteString("#NAME iptv-proxy\n") // nolint: errcheck
+
+	var group string
+	tracks := c.tracks()
+	for i := range tracks {
+		track := &tracks[i]
+
+		uri, err := c.trackURL(track, i, false)
+		if err != nil {
+			logger.Errorf("track: %s: %s", track.Name, err)
+			continue
+		}
+
+		// a marker line separates the groups in the bouquet
+		if g := trackGroup(track); g != "" && g != group {
+			group = g
+			buffer.WriteString(fmt.Sprintf("#SERVICE 1:64:0:0:0:0:0:0:0:0::%s\n", group)) // nolint: errcheck
+			buffer.WriteString(fmt.Sprintf("#DESCRIPTION %s\n", group))                   // nolint: errcheck
+		}
+
+		buffer.WriteString(fmt.Sprintf("#SERVICE %d:0:1:0:0:0:0:0:0:0:%s:%s\n", c.Enigma2ServiceType, enigma2Escape(uri), track.Name)) // nolint: errcheck
+		buffer.WriteString(fmt.Sprintf("#DESCRIPTION %s\n", track.Name))                                                               // nolint: errcheck
+	}
+
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, enigma2BouquetFileName))
+	ctx.Data(http.StatusOK, "application/octet-stream", buffer.Bytes())
+}
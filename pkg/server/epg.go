@@ -0,0 +1,95 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// xmltvDocument is a minimal XMLTV document without any programme.
+type xmltvDocument struct {
+	XMLName       xml.Name       `xml:"tv"`
+	GeneratorName string         `xml:"generator-info-name,attr"`
+	Channels      []xmltvChannel `xml:"channel"`
+}
+
+type xmltvChannel struct {
+	ID          string     `xml:"id,attr"`
+	DisplayName string     `xml:"display-name"`
+	Icon        *xmltvIcon `xml:"icon,omitempty"`
+}
+
+type xmltvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+func (c *Config) getEPG(ctx *gin.Context) {
+	if c.EpgURL == "" {
+		c.placeholderEPG(ctx)
+		return
+	}
+
+	if !strings.HasPrefix(c.EpgURL, "http://") && !strings.HasPrefix(c.EpgURL, "https://") {
+		ctx.Header("Content-Type", "application/xml")
+		ctx.File(c.EpgURL)
+		return
+	}
+
+	epgURL, err := url.Parse(c.EpgURL)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	c.stream(ctx, epgURL)
+}
+
+// placeholderEPG serve a valid XMLTV listing the playlist channels with no programme.
+func (c *Config) placeholderEPG(ctx *gin.Context) {
+	doc := xmltvDocument{GeneratorName: "iptv-proxy"}
+	tracks := c.tracks()
+	seen := make(map[string]bool, len(tracks))
+
+	for i, track := range tracks {
+		id := c.channelID(&track)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		channel := xmltvChannel{ID: id, DisplayName: track.Name}
+		if logo := c.logoURL(&track, i); logo != "" {
+			channel.Icon = &xmltvIcon{Src: logo}
+		}
+		doc.Channels = append(doc.Channels, channel)
+	}
+
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	ctx.Data(http.StatusOK, "application/xml", append([]byte(xml.Header), b...))
+}
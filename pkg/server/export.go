@@ -0,0 +1,118 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// playlistExport is the whole playlist served by the proxy, once filtered, for the backups
+// and the external tools:
+//
+//	{
+//	  "exported_at": "2024-01-02T15:04:05Z",
+//	  "source": "http://provider/get.php?...",  // the m3u url or file
+//	  "channels": 2,
+//	  "tracks": [{
+//	    "index": "0",                             // as in the proxyfied urls
+//	    "name": "France 2", "length": -1, "group": "News",
+//	    "tags": [{"name": "tvg-id", "value": "France2.fr"}],
+//	    "options": ["#EXTVLCOPT:http-user-agent=VLC"],
+//	    "upstream_url": "http://provider/live/1.ts",
+//	    "url": "http://proxy:8080/.../0/1.ts",  // the url served to the players
+//	    "direct_play": false
+//	  }]
+//	}
+type playlistExport struct {
+	ExportedAt time.Time     `json:"exported_at"`
+	Source     string        `json:"source"`
+	Channels   int           `json:"channels"`
+	Tracks     []exportTrack `json:"tracks"`
+}
+
+type exportTrack struct {
+	Index       string      `json:"index"`
+	Name        string      `json:"name"`
+	Length      int         `json:"length"`
+	Group       string      `json:"group,omitempty"`
+	Tags        []exportTag `json:"tags"`
+	Options     []string    `json:"options,omitempty"`
+	UpstreamURL string      `json:"upstream_url"`
+	URL         string      `json:"url,omitempty"`
+	DirectPlay  bool        `json:"direct_play"`
+}
+
+type exportTag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// getExport serve the whole filtered playlist as json, the upstream urls included.
+func (c *Config) getExport(ctx *gin.Context) {
+	rc := c.requestConfig(ctx)
+	tracks := c.tracks()
+
+	export := playlistExport{
+		ExportedAt: time.Now().UTC(),
+		Source:     c.RemoteURL.String(),
+		Channels:   len(tracks),
+		Tracks:     make([]exportTrack, 0, len(tracks)),
+	}
+
+	for i := range tracks {
+		track := &tracks[i]
+		export.Tracks = append(export.Tracks, exportTrack{
+			Index:       c.encodeTrackIndex(i, track.URI),
+			Name:        track.Name,
+			Length:      track.Length,
+			Group:       trackGroup(track),
+			Tags:        exportTags(track.Tags),
+			Options:     track.Options,
+			UpstreamURL: track.URI,
+			URL:         exportURL(rc, track, i),
+			DirectPlay:  c.isDirectPlay(track),
+		})
+	}
+
+	ctx.Header("Content-Disposition", `attachment; filename="playlist.json"`)
+	ctx.JSON(http.StatusOK, export)
+}
+
+func exportTags(tags []m3u.Tag) []exportTag {
+	exported := make([]exportTag, 0, len(tags))
+	for _, tag := range tags {
+		exported = append(exported, exportTag{Name: tag.Name, Value: tag.Value})
+	}
+
+	return exported
+}
+
+// exportURL return the proxyfied url of the track, empty when it can't be built.
+func exportURL(c *Config, track *m3u.Track, index int) string {
+	u, err := c.trackURL(track, index, false)
+	if err != nil {
+		return ""
+	}
+
+	return u
+}
@@ -0,0 +1,91 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// watchDownloadModes give the download file mode to the files created in the ffmpeg output
+// directory as they are created, ffmpeg creates them with the default mode. The playlist
+// written aside and renamed is created again on every update. The watch ends when stop is
+// called or the directory is removed.
+func (c *Config) watchDownloadModes(dirPath string) (stop func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(dirPath)
+		if err != nil {
+			_ = watcher.Close()
+		}
+	}
+	if err != nil {
+		logger.Warnf("unable to watch %s, its files keep the default mode: %s", dirPath, err)
+		return func() {}
+	}
+
+	// the files created before the watch
+	if entries, err := os.ReadDir(dirPath); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				_ = os.Chmod(filepath.Join(dirPath, entry.Name()), c.DownloadFileMode)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer func() {
+			_ = watcher.Close()
+		}()
+
+		for {
+			select {
+			case <-done:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Remove) && filepath.Clean(event.Name) == filepath.Clean(dirPath) {
+					return
+				}
+				if event.Has(fsnotify.Create) {
+					_ = os.Chmod(event.Name, c.DownloadFileMode)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Debugf("watch of %s: %s", dirPath, err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
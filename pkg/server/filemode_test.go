@@ -0,0 +1,98 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+)
+
+// waitFileMode wait for the file to get the mode, it return the last one read.
+func waitFileMode(t *testing.T, file string, mode os.FileMode) os.FileMode {
+	t.Helper()
+
+	var got os.FileMode
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got = info.Mode().Perm(); got == mode {
+			break
+		}
+	}
+
+	return got
+}
+
+func TestWatchDownloadModes(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{ProxyConfig: &config.ProxyConfig{DownloadFileMode: 0o640}}
+
+	before := filepath.Join(dir, "before.ts")
+	if err := os.WriteFile(before, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := c.watchDownloadModes(dir)
+	defer stop()
+
+	if got := waitFileMode(t, before, 0o640); got != 0o640 {
+		t.Errorf("mode of the file created before the watch = %o, want 640", got)
+	}
+
+	// ffmpeg writes the playlist aside and renames it
+	segment := filepath.Join(dir, "0.ts")
+	if err := os.WriteFile(segment, []byte("segment"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, "stream.m3u8.tmp")
+	if err := os.WriteFile(tmp, []byte("#EXTM3U\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	playlist := filepath.Join(dir, "stream.m3u8")
+	if err := os.Rename(tmp, playlist); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{segment, playlist} {
+		if got := waitFileMode(t, file, 0o640); got != 0o640 {
+			t.Errorf("mode of %s = %o, want 640", filepath.Base(file), got)
+		}
+	}
+
+	// the files created once stopped keep their mode
+	stop()
+	after := filepath.Join(dir, "1.ts")
+	if err := os.WriteFile(after, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	info, err := os.Stat(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != 0o600 {
+		t.Errorf("mode of the file created once stopped = %o, want 600", got)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// Rules of the group names normalization, applied in the configured order.
+const (
+	groupRuleTrim            = "trim"
+	groupRuleCollapseSpaces  = "collapse-spaces"
+	groupRuleStripSeparators = "strip-separators"
+	groupRuleLower           = "lower"
+	groupRuleUpper           = "upper"
+	groupRuleTitle           = "title"
+)
+
+var groupRules = []string{groupRuleTrim, groupRuleCollapseSpaces, groupRuleStripSeparators, groupRuleLower, groupRuleUpper, groupRuleTitle}
+
+// groupSeparators are the characters the providers use between the parts of the group names.
+const groupSeparators = "|:-_/"
+
+func validateGroupRules(rules []string) error {
+	for _, rule := range rules {
+		valid := false
+		for _, known := range groupRules {
+			valid = valid || rule == known
+		}
+		if !valid {
+			return fmt.Errorf("invalid group normalization rule %q: expected one of %v", rule, groupRules)
+		}
+	}
+
+	return nil
+}
+
+// normalizeGroupName apply the rules to the group name, e.g. "US | SPORTS" becomes
+// "Us Sports" with strip-separators, collapse-spaces and title.
+func normalizeGroupName(name string, rules []string) string {
+	for _, rule := range rules {
+		switch rule {
+		case groupRuleTrim:
+			name = strings.TrimSpace(name)
+		case groupRuleCollapseSpaces:
+			name = strings.Join(strings.Fields(name), " ")
+		case groupRuleStripSeparators:
+			name = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(groupSeparators, r) {
+					return ' '
+				}
+				return r
+			}, name)
+		case groupRuleLower:
+			name = strings.ToLower(name)
+		case groupRuleUpper:
+			name = strings.ToUpper(name)
+		case groupRuleTitle:
+			name = titleCase(name)
+		}
+	}
+
+	return name
+}
+
+// titleCase upper the first letter of the words and lower the others.
+func titleCase(s string) string {
+	start := true
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			start = true
+			return r
+		}
+		if start {
+			start = false
+			return unicode.ToUpper(r)
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// normalizeGroup return the track with its group-title tag and #EXTGRP line normalized,
+// the tracks are returned as is without rules.
+func (c *Config) normalizeGroup(track m3u.Track) m3u.Track {
+	if len(c.GroupNormalization) == 0 {
+		return track
+	}
+
+	// the tags are shared with the fetched playlist, they are copied before being changed
+	tags := make([]m3u.Tag, len(track.Tags))
+	for i, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, "group-title") {
+			tag.Value = normalizeGroupName(tag.Value, c.GroupNormalization)
+		}
+		tags[i] = tag
+	}
+	track.Tags = tags
+
+	if strings.HasPrefix(track.Group, "#EXTGRP:") {
+		track.Group = "#EXTGRP:" + normalizeGroupName(strings.TrimPrefix(track.Group, "#EXTGRP:"), c.GroupNormalization)
+	}
+
+	return track
+}
@@ -0,0 +1,87 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestNormalizeGroupName(t *testing.T) {
+	cleanup := []string{groupRuleStripSeparators, groupRuleCollapseSpaces, groupRuleTrim, groupRuleTitle}
+
+	tests := []struct {
+		name  string
+		group string
+		rules []string
+		want  string
+	}{
+		{name: "no rule", group: " US | SPORTS ", rules: nil, want: " US | SPORTS "},
+		{name: "trim", group: "  Sports\t", rules: []string{groupRuleTrim}, want: "Sports"},
+		{name: "collapse spaces", group: "US   Sports \t HD", rules: []string{groupRuleCollapseSpaces}, want: "US Sports HD"},
+		{name: "strip separators", group: "US|Sports:HD", rules: []string{groupRuleStripSeparators}, want: "US Sports HD"},
+		{name: "lower", group: "US Sports", rules: []string{groupRuleLower}, want: "us sports"},
+		{name: "upper", group: "us sports", rules: []string{groupRuleUpper}, want: "US SPORTS"},
+		{name: "title", group: "US SPORTS", rules: []string{groupRuleTitle}, want: "Us Sports"},
+		{name: "title unicode", group: "ÉMISSIONS ÉTÉ", rules: []string{groupRuleTitle}, want: "Émissions Été"},
+		{name: "cleanup provider separators", group: "US | SPORTS", rules: cleanup, want: "Us Sports"},
+		{name: "cleanup lower", group: "us sports", rules: cleanup, want: "Us Sports"},
+		{name: "cleanup dashes", group: " us -- sports_hd ", rules: cleanup, want: "Us Sports Hd"},
+		// the rules apply in order, the spaces left by the separators are kept without a collapse after them
+		{name: "order", group: "US | SPORTS", rules: []string{groupRuleCollapseSpaces, groupRuleStripSeparators}, want: "US   SPORTS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeGroupName(tt.group, tt.rules); got != tt.want {
+				t.Errorf("normalizeGroupName(%q, %v) = %q, want %q", tt.group, tt.rules, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateGroupRules(t *testing.T) {
+	if err := validateGroupRules(groupRules); err != nil {
+		t.Errorf("validateGroupRules(%v) error = %v", groupRules, err)
+	}
+	if err := validateGroupRules([]string{groupRuleTrim, "capitalize"}); err == nil {
+		t.Error("validateGroupRules() of an unknown rule: expected an error")
+	}
+}
+
+func TestNormalizeGroup(t *testing.T) {
+	c := newTestConfig()
+	c.GroupNormalization = []string{groupRuleStripSeparators, groupRuleCollapseSpaces, groupRuleTrim, groupRuleTitle}
+
+	tags := []m3u.Tag{{Name: "tvg-id", Value: "ONE"}, {Name: "group-title", Value: "US | SPORTS"}}
+	track := m3u.Track{Name: "One", Tags: tags, Group: "#EXTGRP:US | SPORTS"}
+
+	got := c.normalizeGroup(track)
+	if got.Tag("group-title") != "Us Sports" || got.Group != "#EXTGRP:Us Sports" {
+		t.Errorf("normalizeGroup() group-title = %q, #EXTGRP = %q, want Us Sports", got.Tag("group-title"), got.Group)
+	}
+	if got.Tag("tvg-id") != "ONE" {
+		t.Errorf("normalizeGroup() changed the tvg-id to %q", got.Tag("tvg-id"))
+	}
+	// the tags of the fetched playlist are left untouched
+	if tags[1].Value != "US | SPORTS" {
+		t.Errorf("normalizeGroup() changed the source tags: %q", tags[1].Value)
+	}
+}
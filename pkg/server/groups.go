@@ -0,0 +1,101 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+type groupInfo struct {
+	Name     string `json:"name"`
+	Channels int    `json:"channels"`
+	Path     string `json:"path"`
+}
+
+// trackGroup return the group of the track from its group-title tag or its #EXTGRP line.
+func trackGroup(track *m3u.Track) string {
+	if group := track.Tag("group-title"); group != "" {
+		return group
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(track.Group, "#EXTGRP:"))
+}
+
+// getGroups list the playlist groups with the path of their playlist.
+func (c *Config) getGroups(ctx *gin.Context) {
+	groups := make([]groupInfo, 0)
+	index := map[string]int{}
+
+	tracks := c.tracks()
+	for i := range tracks {
+		name := trackGroup(&tracks[i])
+		if name == "" {
+			continue
+		}
+
+		if j, ok := index[name]; ok {
+			groups[j].Channels++
+			continue
+		}
+
+		index[name] = len(groups)
+		groups = append(groups, groupInfo{
+			Name:     name,
+			Channels: 1,
+			Path:     c.endpointPath("/group/" + url.PathEscape(name) + ".m3u"),
+		})
+	}
+
+	ctx.JSON(http.StatusOK, groups)
+}
+
+// getGroupM3U serve a playlist with only the tracks of the requested group.
+func (c *Config) getGroupM3U(ctx *gin.Context) {
+	// the group names may hold slashes, the route catches the rest of the path
+	name := strings.TrimSuffix(strings.TrimPrefix(ctx.Param("name"), "/"), ".m3u")
+	inGroup := func(track *m3u.Track) bool {
+		return strings.EqualFold(trackGroup(track), name)
+	}
+
+	found := false
+	tracks := c.tracks()
+	for i := range tracks {
+		if inGroup(&tracks[i]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.Header("Content-Disposition", c.playlistFileDisposition(name+".m3u"))
+	ctx.Header("Content-Type", "application/octet-stream")
+	ctx.Status(http.StatusOK)
+
+	if err := c.requestConfig(ctx).writeTracks(ctx.Writer, tracks, false, inGroup); err != nil {
+		_ = ctx.Error(err) // nolint: errcheck
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestGroupPaths(t *testing.T) {
+	names := []string{"News", "Sports/HD", "Movies & Series?", "100% #1"}
+	tracks := make([]m3u.Track, 0, len(names))
+	for i, name := range names {
+		tracks = append(tracks, m3u.Track{Name: "Channel " + name, Length: -1, URI: fmt.Sprintf("http://upstream.tv/live/%d.ts", i), Tags: []m3u.Tag{{Name: "group-title", Value: name}}})
+	}
+
+	for _, endpoint := range []string{"", "custom"} {
+		t.Run("endpoint "+endpoint, func(t *testing.T) {
+			c := newTestConfig(tracks...)
+			c.CustomEndpoint = endpoint
+			prefix := c.endpointPath("")
+
+			w := serveTest(c, httptest.NewRequest(http.MethodGet, prefix+"/groups?username=user&password=pass", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /groups status = %d", w.Code)
+			}
+			var groups []groupInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil {
+				t.Fatal(err)
+			}
+			if len(groups) != len(names) {
+				t.Fatalf("got %d groups, want %d", len(groups), len(names))
+			}
+
+			// every listed path serves the playlist of its group
+			for i, group := range groups {
+				if !strings.HasPrefix(group.Path, prefix+"/group/") {
+					t.Errorf("group %q path = %q, want it under %s/group/", group.Name, group.Path, prefix)
+				}
+
+				w := serveTest(c, httptest.NewRequest(http.MethodGet, group.Path+"?username=user&password=pass", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("GET %s status = %d, want %d", group.Path, w.Code, http.StatusOK)
+					continue
+				}
+				if body := w.Body.String(); !strings.Contains(body, ",Channel "+names[i]+"\n") || strings.Count(body, "#EXTINF") != 1 {
+					t.Errorf("GET %s body = %q, want the channel of the group %q only", group.Path, body, names[i])
+				}
+			}
+		})
+	}
+}
@@ -21,12 +21,15 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	_ "embed"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/grafov/m3u8"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -34,6 +37,7 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -50,15 +54,130 @@ var (
 type FFmpegProcess struct {
 	Cmd      *exec.Cmd
 	LastPath string
+	// EXT-X-ENDLIST of the served playlist, nil to serve it as ffmpeg wrote it
+	EndList *bool
+	// StopModes stop applying the download file mode to the files ffmpeg creates
+	StopModes func()
+}
+
+// ping answer the load balancers probes without doing any work,
+// it also answers the favicon requests.
+func ping(ctx *gin.Context) {
+	ctx.Status(http.StatusNoContent)
 }
 
 func (c *Config) getM3U(ctx *gin.Context) {
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
+	c.revalidatePlaylist()
+	if c.emptyPlaylist(ctx) {
+		return
+	}
+
+	ctx.Header("Content-Disposition", c.playlistDisposition())
 	ctx.Header("Content-Type", "application/octet-stream")
 
+	// the signatures expire, the playlist is written with fresh ones,
+	// and the playlist file is not written without track
+	if c.URLSigningSecret != "" || ctx.GetBool(credentiallessKey) || !c.PlaylistFileCache || len(c.tracks()) == 0 {
+		if err := c.requestConfig(ctx).writeTracks(ctx.Writer, c.tracks(), false, nil); err != nil {
+			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		}
+		return
+	}
+
 	ctx.File(c.proxyfiedM3UPath)
 }
 
+// hostnameRegexp match a dns name or an ipv4 address.
+var hostnameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+// getM3UForHost serve the playlist with the urls pointing at the host, port and scheme of the query
+// instead of the advertised ones.
+func (c *Config) getM3UForHost(ctx *gin.Context) {
+	c.revalidatePlaylist()
+	if c.emptyPlaylist(ctx) {
+		return
+	}
+
+	scheme := ctx.DefaultQuery("scheme", "http")
+	if scheme != "http" && scheme != "https" {
+		_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid scheme %q: expected http or https", scheme)) // nolint: errcheck
+		return
+	}
+
+	host := ctx.Query("host")
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	} else if !hostnameRegexp.MatchString(host) {
+		_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid host %q", host)) // nolint: errcheck
+		return
+	}
+
+	port := 80
+	if scheme == "https" {
+		port = 443
+	}
+	if p := ctx.Query("port"); p != "" {
+		var err error
+		port, err = strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid port %q", p)) // nolint: errcheck
+			return
+		}
+	}
+
+	hostConfig := *c.HostConfig
+	hostConfig.Hostname = host
+	proxyConfig := *c.ProxyConfig
+	proxyConfig.HostConfig = &hostConfig
+	proxyConfig.AdvertisedPort = port
+	proxyConfig.HTTPS = scheme == "https"
+	hostConfigured := *c.requestConfig(ctx)
+	hostConfigured.ProxyConfig = &proxyConfig
+
+	ctx.Header("Content-Disposition", c.playlistDisposition())
+	ctx.Header("Content-Type", "application/octet-stream")
+
+	if err := hostConfigured.writeTracks(ctx.Writer, c.tracks(), false, nil); err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+	}
+}
+
+// trackHandler proxy the track matching the index of the url.
+func (c *Config) trackHandler(ctx *gin.Context) {
+	track, ok := c.trackByIndex(ctx.Param("index"))
+	if !ok {
+		c.channelNotFound(ctx)
+		return
+	}
+	if isChannelDisabled(&track) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	trackConfig := *c
+	trackConfig.track = &track
+
+	switch trackConfig.streamType(ctx) {
+	case streamTypeHLS:
+		if c.hlsRewriteDepth() > 0 {
+			trackConfig.hlsRewriteProxy(ctx)
+			return
+		}
+		trackConfig.m3u8ReverseProxy(ctx)
+		return
+	case streamTypeDASH:
+		trackConfig.dashProxy(ctx)
+		return
+	}
+
+	if ctx.Param("id") != path.Base(track.URI) {
+		c.channelNotFound(ctx)
+		return
+	}
+
+	trackConfig.reverseProxy(ctx)
+}
+
 func (c *Config) reverseProxy(ctx *gin.Context) {
 	rpURL, err := url.Parse(c.track.URI)
 	if err != nil {
@@ -66,10 +185,15 @@ func (c *Config) reverseProxy(ctx *gin.Context) {
 		return
 	}
 
+	if c.isTranscoded() {
+		c.transcode(ctx, rpURL)
+		return
+	}
+
 	c.stream(ctx, rpURL)
 }
 func (c *Config) tsHandler(ctx *gin.Context) {
-	log.Println("tsHandler called")
+	logger.Debugf("tsHandler called")
 	streamID := ctx.Param("streamID")
 	tsID := ctx.Param("tsID")
 	// Путь к каталогу hlsdownloads
@@ -77,11 +201,23 @@ func (c *Config) tsHandler(ctx *gin.Context) {
 
 	// Проверка существования файла
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		// downloaded by another replica
+		if c.serveStoredSegment(ctx, filePath) {
+			return
+		}
 		// Если файла нет, отдаем фейковый файл
 		ctx.Data(http.StatusOK, "video/MP2T", fakeTS)
 		return
 	}
 
+	contentType := hlsdownloadsContentType(filePath)
+	c.setSegmentCacheHeaders(ctx, contentType)
+
+	if c.CompressSegments && isCompressible(contentType) {
+		c.serveCompressed(ctx, filePath, contentType)
+		return
+	}
+
 	// Отдаем реальный файл
 	ctx.File(filePath)
 }
@@ -98,6 +234,7 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 				return
 			}
 			_, _ = currentProcess.Cmd.Process.Wait()
+			currentProcess.StopModes()
 			removeDirectoryFromPath(currentProcess.LastPath)
 			currentProcess = nil
 		}
@@ -122,11 +259,15 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 	// Создание каталога, если он не существует
 	dirPath := fmt.Sprintf("hlsdownloads/%s/stream", idStream)
 	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		err = os.MkdirAll(dirPath, 0755)
+		err = os.MkdirAll(dirPath, c.DownloadDirMode)
 		if err != nil {
 			// Обработка ошибки
 			log.Fatal(err)
 		}
+		// the mode given to MkdirAll is masked by the umask
+		for dir := dirPath; dir != "hlsdownloads" && dir != "."; dir = filepath.Dir(dir) {
+			_ = os.Chmod(dir, c.DownloadDirMode)
+		}
 	}
 
 	outputPath := fmt.Sprintf("%s/stream.m3u8", dirPath)
@@ -134,50 +275,32 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 	if currentProcess != nil {
 		if currentProcess.LastPath == rpURL.Path {
 			// Если путь не изменился, просто отдаем файл
-			ModifyAndSendPlaylist(ctx, outputPath)
+			c.storeSegments(dirPath, outputPath)
+			ModifyAndSendPlaylist(ctx, outputPath, currentProcess.EndList)
 			return
 		} else {
 			// Если путь изменился, завершаем текущий процесс
 			if err := currentProcess.Cmd.Process.Kill(); err != nil {
 				// Обработка ошибки, например, запись в лог
-				log.Println("Failed to kill process:", err)
+				logger.Errorf("Failed to kill process: %v", err)
 			}
 			if _, err := currentProcess.Cmd.Process.Wait(); err != nil {
 				// Обработка ошибки, например, запись в лог
-				log.Println("Failed to wait for process:", err)
+				logger.Errorf("Failed to wait for process: %v", err)
 			}
 
+			currentProcess.StopModes()
 			removeDirectoryFromPath(currentProcess.LastPath)
 			currentProcess = nil
 		}
 	}
 
-	resp, err := http.Get(fullURL)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
-
-	p, listType, err := m3u8.DecodeFrom(bufio.NewReader(resp.Body), true)
+	probe, err := c.probeChannel(fullURL)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	var hlsTime, hlsListSize string
-
-	if listType == m3u8.MEDIA {
-		mediaList := p.(*m3u8.MediaPlaylist)
-		hlsTime = fmt.Sprintf("%.0f", mediaList.TargetDuration)
-		var count int
-		for _, segment := range mediaList.Segments {
-			if segment != nil {
-				count++
-			}
-		}
-		hlsListSize = fmt.Sprintf("%d", count)
+		_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
+		return
 	}
+	hlsTime, hlsListSize := probe.hlsTime, probe.hlsListSize
 
 	// Считываем переменные окружения
 	bitrateVideo := os.Getenv("BITRATE_VIDEO")
@@ -205,14 +328,14 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 		preset = "ultrafast" // значение по умолчанию
 	}
 
-	fmt.Println("CRF:", crf)
-	fmt.Println("SCALE:", scale)
-	fmt.Println("BITRATE_VIDEO:", bitrateVideo)
-	fmt.Println("BITRATE_AUDIO:", bitrateAudio)
-	fmt.Println("HLS_TIME:", hlsTime)
-	fmt.Println("HLS_LIST_SIZE:", hlsListSize)
+	logger.Debugf("CRF: %s", crf)
+	logger.Debugf("SCALE: %s", scale)
+	logger.Debugf("BITRATE_VIDEO: %s", bitrateVideo)
+	logger.Debugf("BITRATE_AUDIO: %s", bitrateAudio)
+	logger.Debugf("HLS_TIME: %s", hlsTime)
+	logger.Debugf("HLS_LIST_SIZE: %s", hlsListSize)
 	// Запуск ffmpeg для трансляции
-	cmd := exec.Command("ffmpeg", "-i", fullURL,
+	args := append(c.ffmpegHeaders(), "-i", fullURL,
 		"-c:v", "libx265", "-preset", preset, "-tune", "zerolatency", "-crf", crf,
 		"-vf", "scale="+scale,
 		"-b:v", bitrateVideo,
@@ -220,9 +343,11 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 		"-hls_time", hlsTime,
 		"-hls_list_size", hlsListSize,
 		"-hls_segment_type", "mpegts",
-		"-hls_segment_filename", dirPath+"/data%02d.ts", // Сегменты сохраняются в папке stream
+		"-hls_segment_filename", dirPath+"/"+c.segmentFilename(ctx.Param("index"), fullURL), // Сегменты сохраняются в папке stream
 		"-hls_flags", "independent_segments+delete_segments",
 		outputPath)
+	stopModes := c.watchDownloadModes(dirPath)
+	cmd := exec.Command("ffmpeg", args...)
 	cmd.Stdout = os.Stdout // Перенаправляем стандартный вывод
 	cmd.Stderr = os.Stderr // Перенаправляем стандартный вывод ошибок
 
@@ -247,10 +372,13 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 	}
 	// Сохраняем информацию о текущем процессе
 	currentProcess = &FFmpegProcess{
-		Cmd:      cmd,
-		LastPath: rpURL.Path,
+		Cmd:       cmd,
+		LastPath:  rpURL.Path,
+		EndList:   c.upstreamEndList(probe),
+		StopModes: stopModes,
 	}
-	ModifyAndSendPlaylist(ctx, outputPath)
+	c.storeSegments(dirPath, outputPath)
+	ModifyAndSendPlaylist(ctx, outputPath, currentProcess.EndList)
 }
 
 func removeDirectoryFromPath(path string) {
@@ -265,12 +393,15 @@ func removeDirectoryFromPath(path string) {
 		// Удаление каталога
 		if err := os.RemoveAll(dirPath); err != nil {
 			// Обработка ошибки, например, запись в лог
-			log.Println("Failed to remove directory:", err)
+			logger.Errorf("Failed to remove directory: %v", err)
 		}
+		forgetStoredSegments(segmentKey(dirPath)+"/", nil)
 	}
 }
 
-func ModifyAndSendPlaylist(ctx *gin.Context, outputPath string) {
+// ModifyAndSendPlaylist serve the playlist written by ffmpeg, ended by EXT-X-ENDLIST
+// as endList tells unless it is nil.
+func ModifyAndSendPlaylist(ctx *gin.Context, outputPath string, endList *bool) {
 	// Откройте файл для чтения
 	file, err := os.Open(outputPath)
 	if err != nil {
@@ -296,6 +427,9 @@ func ModifyAndSendPlaylist(ctx *gin.Context, outputPath string) {
 
 			}
 		}
+		if endList != nil {
+			mediaList.Closed = *endList
+		}
 
 		// Генерируйте новый плейлист
 		modifiedPlaylist := mediaList.Encode().Bytes()
@@ -306,27 +440,76 @@ func ModifyAndSendPlaylist(ctx *gin.Context, outputPath string) {
 }
 
 func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", oriURL.String(), nil)
+	resp, err := c.streamRequest(ctx, oriURL)
 	if err != nil {
-		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
 		return
 	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
 
-	mergeHttpHeader(req.Header, ctx.Request.Header)
+	c.streamResponse(ctx, resp)
+}
 
-	resp, err := client.Do(req)
+// streamRequest send the client request to the upstream url.
+func (c *Config) streamRequest(ctx *gin.Context, oriURL *url.URL) (*http.Response, error) {
+	// a HEAD is forwarded as is so that the players get the size of the vod without downloading it
+	if ctx.Request.Method == http.MethodHead {
+		resp, err := c.upstreamRequest(ctx, http.MethodHead, oriURL)
+		if err != nil || (resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented) {
+			return resp, err
+		}
+		// the upstream doesn't support HEAD, the headers of the GET response are relayed
+		_ = resp.Body.Close()
+	}
+
+	return c.upstreamRequest(ctx, http.MethodGet, oriURL)
+}
+
+// upstreamRequest send the request of the client to the upstream url with the channel headers,
+// the upstream request is canceled when the client goes away.
+func (c *Config) upstreamRequest(ctx *gin.Context, method string, oriURL *url.URL) (*http.Response, error) {
+	return c.upstreamRequestContext(ctx.Request.Context(), ctx, method, oriURL)
+}
+
+// upstreamRequestContext send the request of the client to the upstream url with the channel headers,
+// the upstream request is bound to reqCtx.
+func (c *Config) upstreamRequestContext(reqCtx context.Context, ctx *gin.Context, method string, oriURL *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(reqCtx, method, oriURL.String(), nil)
 	if err != nil {
-		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-		return
+		return nil, err
 	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
 
+	mergeHttpHeader(req.Header, ctx.Request.Header)
+	c.setChannelHeaders(req.Header)
+
+	return c.upstreamDo(upstreamClient, withSelectedUpstream(ctx, req))
+}
+
+// streamResponse relay the upstream response to the client.
+func (c *Config) streamResponse(ctx *gin.Context, resp *http.Response) {
 	mergeHttpHeader(ctx.Writer.Header(), resp.Header)
+	c.forceContentType(ctx, resp)
+	c.relayBody(ctx, resp)
+}
+
+// relayBody send the status and the body of the upstream response to the client.
+func (c *Config) relayBody(ctx *gin.Context, resp *http.Response) {
 	ctx.Status(resp.StatusCode)
+
+	if ctx.Request.Method == http.MethodHead {
+		return
+	}
+
+	stopWatch := c.watchIdleStream(ctx, resp.Body)
+	defer stopWatch()
+
+	if c.StreamHeartbeat > 0 && resp.StatusCode == http.StatusOK && isTSStream(resp) {
+		c.copyWithHeartbeat(ctx, resp.Body)
+		return
+	}
+
 	ctx.Stream(func(w io.Writer) bool {
 		_, _ = io.Copy(w, resp.Body) // nolint: errcheck
 		return false
@@ -374,10 +557,17 @@ type authRequest struct {
 
 func (c *Config) authenticate(ctx *gin.Context) {
 	var authReq authRequest
-	if err := ctx.Bind(&authReq); err != nil {
+	if err := ctx.ShouldBind(&authReq); err != nil {
+		// the missing credentials are an authorization failure for the protected playlists
+		if c.ProtectPlaylist {
+			_ = ctx.AbortWithError(http.StatusUnauthorized, err) // nolint: errcheck
+			return
+		}
 		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
 		return
 	}
+	// the credentials of the client are refused with 401, 403 is left to the upstream
+	// refusing the provider credentials
 	if c.ProxyConfig.User.String() != authReq.Username || c.ProxyConfig.Password.String() != authReq.Password {
 		ctx.AbortWithStatus(http.StatusUnauthorized)
 	}
@@ -399,7 +589,7 @@ func (c *Config) appAuthenticate(ctx *gin.Context) {
 		_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("bad body url query parameters")) // nolint: errcheck
 		return
 	}
-	log.Printf("[iptv-proxy] %v | %s |App Auth\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
+	logger.Infof("%s |App Auth", ctx.ClientIP())
 	if c.ProxyConfig.User.String() != q["username"][0] || c.ProxyConfig.Password.String() != q["password"][0] {
 		ctx.AbortWithStatus(http.StatusUnauthorized)
 	}
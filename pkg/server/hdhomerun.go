@@ -0,0 +1,142 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// hdhrDiscover is the HDHomeRun device description read by Plex and other DVRs.
+type hdhrDiscover struct {
+	FriendlyName    string
+	Manufacturer    string
+	ModelNumber     string
+	FirmwareName    string
+	FirmwareVersion string
+	DeviceID        string
+	DeviceAuth      string
+	TunerCount      int
+	BaseURL         string
+	LineupURL       string
+}
+
+type hdhrLineupStatus struct {
+	ScanInProgress int
+	ScanPossible   int
+	Source         string
+	SourceList     []string
+}
+
+type hdhrLineupEntry struct {
+	GuideNumber string
+	GuideName   string
+	URL         string
+}
+
+// hdhomerunRoutes register the HDHomeRun emulation. The lineup lists the channel urls, it is
+// served without credentials to the trusted clients only, the DVRs which don't send credentials,
+// and with them to the authenticated ones.
+func (c *Config) hdhomerunRoutes(r *gin.RouterGroup) {
+	r.GET("/discover.json", c.hdhrDiscover)
+	r.GET("/lineup_status.json", c.hdhrLineupStatus)
+	r.GET("/lineup.json", c.authenticatePlaylist, c.hdhrLineup)
+	r.POST("/lineup.post", c.hdhrLineupPost)
+}
+
+// hdhrDeviceID return a stable device id for the advertised host.
+func (c *Config) hdhrDeviceID() string {
+	return fmt.Sprintf("%08X", crc32.ChecksumIEEE([]byte(c.baseURL())))
+}
+
+// hdhrDevice return the description of the emulated device, served on /discover.json
+// and advertised with mDNS.
+func (c *Config) hdhrDevice() hdhrDiscover {
+	tunerCount := c.HDHomeRunTunerCount
+	if tunerCount <= 0 {
+		tunerCount = 1
+	}
+
+	return hdhrDiscover{
+		FriendlyName:    "iptv-proxy",
+		Manufacturer:    "Silicondust",
+		ModelNumber:     "HDTC-2US",
+		FirmwareName:    "hdhomeruntc_atsc",
+		FirmwareVersion: "20150826",
+		DeviceID:        c.hdhrDeviceID(),
+		DeviceAuth:      "iptv-proxy",
+		TunerCount:      tunerCount,
+		BaseURL:         c.baseURL(),
+		LineupURL:       c.baseURL() + "/lineup.json",
+	}
+}
+
+func (c *Config) hdhrDiscover(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, c.hdhrDevice())
+}
+
+func (c *Config) hdhrLineupStatus(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, hdhrLineupStatus{
+		ScanInProgress: 0,
+		ScanPossible:   1,
+		Source:         "Cable",
+		SourceList:     []string{"Cable"},
+	})
+}
+
+func (c *Config) hdhrLineup(ctx *gin.Context) {
+	rc := c.requestConfig(ctx)
+	tracks := c.tracks()
+	lineup := make([]hdhrLineupEntry, 0, len(tracks))
+
+	for i, track := range tracks {
+		if isChannelDisabled(&track) {
+			continue
+		}
+
+		uri, err := rc.trackURL(&track, i, false)
+		if err != nil {
+			logger.Errorf("track: %s: %s", track.Name, err)
+			continue
+		}
+
+		number := track.Tag("tvg-chno")
+		if number == "" {
+			number = strconv.Itoa(i + 1)
+		}
+
+		lineup = append(lineup, hdhrLineupEntry{
+			GuideNumber: number,
+			GuideName:   track.Name,
+			URL:         uri,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, lineup)
+}
+
+// hdhrLineupPost acknowledge the channel scan requests, the lineup is always up to date.
+func (c *Config) hdhrLineupPost(ctx *gin.Context) {
+	ctx.Status(http.StatusOK)
+}
@@ -0,0 +1,72 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestHDHomeRunCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		trusted    bool
+		wantStatus int
+	}{
+		{name: "discover", path: "/discover.json", wantStatus: http.StatusOK},
+		{name: "lineup status", path: "/lineup_status.json", wantStatus: http.StatusOK},
+		{name: "lineup without credentials", path: "/lineup.json", wantStatus: http.StatusBadRequest},
+		{name: "lineup with wrong credentials", path: "/lineup.json?username=user&password=wrong", wantStatus: http.StatusUnauthorized},
+		{name: "lineup with credentials", path: "/lineup.json?username=user&password=pass", wantStatus: http.StatusOK},
+		{name: "lineup to a trusted client", path: "/lineup.json", trusted: true, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(m3u.Track{Name: "Channel", Length: -1, URI: "http://upstream.tv/live/1.ts"})
+			c.HDHomeRun = true
+			if tt.trusted {
+				// the address of the test requests
+				c.trustedNetworks, _ = parseTrustedNetworks([]string{"192.0.2.0/24"})
+			}
+
+			w := serveTest(c, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("GET %s status = %d, want %d", tt.path, w.Code, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			// the credentials are only served to the clients which sent them
+			sent := strings.Contains(tt.path, "password=pass")
+			if body := w.Body.String(); strings.Contains(body, "/pass/") != sent {
+				t.Errorf("GET %s body = %s, want the credentials only when sent", tt.path, body)
+			}
+			if tt.path == "/lineup.json" && !strings.Contains(w.Body.String(), `"GuideName":"Channel"`) {
+				t.Errorf("GET %s body = %s, want the channel", tt.path, w.Body.String())
+			}
+		})
+	}
+}
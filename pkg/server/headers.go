@@ -0,0 +1,135 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// allChannelsKey is the channel headers key applied to every channel.
+const allChannelsKey = "*"
+
+// loadChannelHeaders read the json file mapping a tvg-id or a channel name to the headers
+// sent to its upstream, e.g. {"*": {"User-Agent": "VLC"}, "news.fr": {"Referer": "https://..."}}.
+func loadChannelHeaders(filePath string) (map[string]map[string]string, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]map[string]string{}
+	if err := json.Unmarshal(b, &headers); err != nil {
+		return nil, fmt.Errorf("invalid channel headers file %s: %w", filePath, err)
+	}
+
+	return headers, nil
+}
+
+// channelHeaders return the upstream headers of the current track,
+// the tvg-id headers override the name ones which override the headers for all channels.
+func (c *Config) channelHeaders() map[string]string {
+	if len(c.upstreamHeaders) == 0 {
+		return nil
+	}
+
+	headers := map[string]string{}
+	keys := []string{allChannelsKey}
+	if c.track != nil {
+		keys = append(keys, c.track.Name, c.track.Tag("tvg-id"))
+	}
+
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		for name, value := range c.upstreamHeaders[key] {
+			headers[name] = value
+		}
+	}
+
+	return headers
+}
+
+// setChannelHeaders set the upstream headers of the current track on the request.
+func (c *Config) setChannelHeaders(h http.Header) {
+	for name, value := range c.channelHeaders() {
+		h.Set(name, value)
+	}
+}
+
+// ffmpegHeaders return the ffmpeg input options sending the upstream headers of the current track.
+func (c *Config) ffmpegHeaders() []string {
+	headers := c.channelHeaders()
+	if len(headers) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(fmt.Sprintf("%s: %s\r\n", name, headers[name])) // nolint: errcheck
+	}
+
+	return []string{"-headers", b.String()}
+}
+
+// redirectHeadersKey is the request context key of the headers set again on the redirects.
+type redirectHeadersKey struct{}
+
+// withRedirectHeaders keep the injected upstream headers across the redirects,
+// the http client drops the credentials when a redirect leaves the host.
+func withRedirectHeaders(req *http.Request, headers map[string]string) *http.Request {
+	if len(headers) == 0 {
+		return req
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), redirectHeadersKey{}, headers))
+}
+
+// keepRedirectHeaders is the redirect policy of the upstream clients,
+// the injected headers are set again on the redirected request.
+func keepRedirectHeaders(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	if headers, ok := req.Context().Value(redirectHeadersKey{}).(map[string]string); ok {
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+)
+
+// redirectingUpstream return an upstream redirecting to a second host checking the Authorization header,
+// the second host is reached as localhost so that the http client sees another host.
+func redirectingUpstream(t *testing.T) (string, func()) {
+	t.Helper()
+
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("#EXTM3U\n#EXTINF:-1,Channel\nhttp://cdn.tv/1.ts\n"))
+	}))
+	cdnURL, err := url.Parse(cdn.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdnURL.Host = "localhost:" + cdnURL.Port()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, cdnURL.String()+r.URL.Path, http.StatusFound)
+	}))
+
+	return origin.URL, func() {
+		origin.Close()
+		cdn.Close()
+	}
+}
+
+func TestRedirectKeepsPlaylistFetchHeaders(t *testing.T) {
+	origin, closeUpstream := redirectingUpstream(t)
+	defer closeUpstream()
+
+	clients, err := newUpstreamClients(&config.ProxyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.ProxyConfig{PlaylistFetchHeaders: map[string]string{"Authorization": "Bearer token"}}
+	p, err := fetchPlaylist(clients.upstream, conf, origin+"/playlist.m3u")
+	if err != nil {
+		t.Fatalf("fetchPlaylist() error = %v", err)
+	}
+	if len(p.Tracks) != 1 {
+		t.Errorf("fetchPlaylist() got %d tracks, want 1", len(p.Tracks))
+	}
+}
+
+func TestRedirectKeepsChannelHeaders(t *testing.T) {
+	origin, closeUpstream := redirectingUpstream(t)
+	defer closeUpstream()
+
+	clients, err := newUpstreamClients(&config.ProxyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestConfig()
+	c.upstreamHeaders = map[string]map[string]string{allChannelsKey: {"Authorization": "Bearer token"}}
+
+	req, err := http.NewRequest(http.MethodGet, origin+"/1.m3u8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.setChannelHeaders(req.Header)
+
+	resp, err := c.upstreamDo(clients.upstream, req)
+	if err != nil {
+		t.Fatalf("upstreamDo() error = %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status after the redirect = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestRedirectWithoutInjectedHeaders(t *testing.T) {
+	origin, closeUpstream := redirectingUpstream(t)
+	defer closeUpstream()
+
+	clients, err := newUpstreamClients(&config.ProxyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the headers of the request itself are dropped by the client when the redirect leaves the host
+	req, err := http.NewRequest(http.MethodGet, origin+"/1.m3u8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+
+	resp, err := clients.upstream.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status after the redirect = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const tsPacketSize = 188
+
+// tsNullPacket is an MPEG-TS packet of the null PID, the players discard it.
+var tsNullPacket = func() []byte {
+	p := make([]byte, tsPacketSize)
+	for i := range p {
+		p[i] = 0xFF
+	}
+	p[0], p[1], p[2], p[3] = 0x47, 0x1F, 0xFF, 0x10
+
+	return p
+}()
+
+// isTSStream report whether the upstream response is an MPEG-TS stream.
+func isTSStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "video/mp2t") || path.Ext(resp.Request.URL.Path) == ".ts"
+}
+
+// copyWithHeartbeat copy the MPEG-TS stream to the client and write a null packet
+// each time the upstream stalls for the heartbeat interval, so the players keep the connection.
+// The null packets are only written between two whole packets of the stream.
+func (c *Config) copyWithHeartbeat(ctx *gin.Context, body io.Reader) {
+	chunks := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := body.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- buf[:n]:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(c.StreamHeartbeat)
+	defer ticker.Stop()
+
+	var written int64
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return
+			}
+			if _, err := ctx.Writer.Write(chunk); err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+			written += int64(len(chunk))
+			ticker.Reset(c.StreamHeartbeat)
+		case <-ticker.C:
+			if written%tsPacketSize != 0 {
+				continue
+			}
+			if _, err := ctx.Writer.Write(tsNullPacket); err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+			written += tsPacketSize
+		case <-ctx.Request.Context().Done():
+			return
+		}
+	}
+}
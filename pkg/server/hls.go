@@ -0,0 +1,422 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// hlsResourceTTL is how long a rewritten uri can be requested after its playlist has been served.
+const hlsResourceTTL = 10 * time.Minute
+
+var uriAttributeRegexp = regexp.MustCompile(`URI="([^"]*)"`)
+var extensionRegexp = regexp.MustCompile(`^\.[A-Za-z0-9]{1,5}$`)
+
+// hlsResource is an upstream uri referenced by a rewritten playlist.
+type hlsResource struct {
+	url string
+	// nesting level of the playlist when the resource is itself a playlist.
+	level    int
+	playlist bool
+	// upstream playlist of a segment, re-fetched when the segment url has expired.
+	parent string
+	// channel of the playlist, its upstream headers are sent for the resource.
+	track *m3u.Track
+	// keys of the segments following the segment in its playlist, prefetched when it is requested.
+	next []string
+	time.Time
+}
+
+var hlsResources = map[string]hlsResource{}
+var hlsResourcesLock = sync.RWMutex{}
+var hlsResourcesPurge time.Time
+
+// registerHLSResource store the upstream uri and return the key to request it through the proxy.
+func registerHLSResource(res hlsResource) string {
+	u, err := url.Parse(res.url)
+	ext := ""
+	if err == nil && extensionRegexp.MatchString(path.Ext(u.Path)) {
+		ext = path.Ext(u.Path)
+	}
+
+	sum := sha1.Sum([]byte(res.url))
+	key := hex.EncodeToString(sum[:8]) + ext
+
+	hlsResourcesLock.Lock()
+	defer hlsResourcesLock.Unlock()
+
+	if time.Since(hlsResourcesPurge) > time.Minute {
+		for k, r := range hlsResources {
+			if time.Since(r.Time) > hlsResourceTTL {
+				delete(hlsResources, k)
+			}
+		}
+		hlsResourcesPurge = time.Now()
+	}
+
+	res.Time = time.Now()
+	hlsResources[key] = res
+
+	return key
+}
+
+// linkHLSSegments record the segments following each segment of a playlist, in its order.
+func linkHLSSegments(keys []string, count int) {
+	hlsResourcesLock.Lock()
+	defer hlsResourcesLock.Unlock()
+
+	for i, key := range keys {
+		res, ok := hlsResources[key]
+		if !ok {
+			continue
+		}
+		end := i + 1 + count
+		if end > len(keys) {
+			end = len(keys)
+		}
+		res.next = keys[i+1 : end]
+		hlsResources[key] = res
+	}
+}
+
+// updateHLSResource replace the upstream uri of a registered resource.
+func updateHLSResource(key, uri string) {
+	hlsResourcesLock.Lock()
+	defer hlsResourcesLock.Unlock()
+
+	if res, ok := hlsResources[key]; ok {
+		res.url = uri
+		hlsResources[key] = res
+	}
+}
+
+func getHLSResource(key string) (hlsResource, bool) {
+	hlsResourcesLock.RLock()
+	defer hlsResourcesLock.RUnlock()
+
+	res, ok := hlsResources[key]
+	if !ok || time.Since(res.Time) > hlsResourceTTL {
+		return hlsResource{}, false
+	}
+
+	return res, true
+}
+
+// hlsRewriteProxy serve the channel playlist with its uris rewritten to the proxy.
+func (c *Config) hlsRewriteProxy(ctx *gin.Context) {
+	rpURL, err := url.Parse(strings.ReplaceAll(c.track.URI, path.Base(c.track.URI), ctx.Param("id")))
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	c.hlsPlaylistProxy(ctx, rpURL, 1)
+}
+
+// hlsSegmentProxy serve a segment, the segment url is refreshed from its playlist
+// when the upstream answers it has expired.
+func (c *Config) hlsSegmentProxy(ctx *gin.Context, key string, res hlsResource) {
+	u, err := url.Parse(res.url)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	c.prefetchSegments(ctx, res.next)
+	if c.servePrefetched(ctx, u) {
+		return
+	}
+
+	resp, err := c.segmentRequest(ctx, u)
+	if err != nil {
+		_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
+		return
+	}
+
+	if (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusGone) && c.HLSSegmentRefresh && res.parent != "" {
+		if fresh, ok := c.refreshHLSSegment(ctx, res); ok {
+			logger.Infof("%s | segment url expired, refreshed from %s", ctx.ClientIP(), res.parent)
+			updateHLSResource(key, fresh.String())
+
+			_ = resp.Body.Close()
+			resp, err = c.segmentRequest(ctx, fresh)
+			if err != nil {
+				_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
+				return
+			}
+		}
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	c.streamSegmentResponse(ctx, resp)
+}
+
+// refreshHLSSegment fetch again the playlist of the segment and return the segment url
+// found in it, the segments are matched by path as only the token of the url changes.
+func (c *Config) refreshHLSSegment(ctx *gin.Context, res hlsResource) (*url.URL, bool) {
+	old, err := url.Parse(res.url)
+	if err != nil {
+		return nil, false
+	}
+
+	req, err := http.NewRequest("GET", res.parent, nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set("User-Agent", ctx.Request.UserAgent())
+	c.setChannelHeaders(req.Header)
+
+	resp, err := c.upstreamDo(upstreamClient, withSelectedUpstream(ctx, req))
+	if err != nil {
+		return nil, false
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+
+	body, err := c.readUpstreamBody(resp)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ref, err := url.Parse(line)
+		if err != nil {
+			continue
+		}
+
+		if fresh := resp.Request.URL.ResolveReference(ref); fresh.Host == old.Host && fresh.Path == old.Path {
+			return fresh, true
+		}
+	}
+
+	return nil, false
+}
+
+// hlsResourceHandler serve a resource referenced by a rewritten playlist.
+func (c *Config) hlsResourceHandler(ctx *gin.Context) {
+	res, ok := getHLSResource(ctx.Param("key"))
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	trackConfig := *c
+	trackConfig.track = res.track
+
+	if !res.playlist {
+		trackConfig.hlsSegmentProxy(ctx, ctx.Param("key"), res)
+		return
+	}
+
+	u, err := url.Parse(res.url)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	trackConfig.hlsPlaylistProxy(ctx, u, res.level)
+}
+
+// hlsPlaylistProxy fetch the upstream playlist and serve it rewritten.
+// The LL-HLS tags are kept, their uris rewritten like the others, and the blocking
+// reload query of the player is forwarded so the upstream holds the playlist update.
+func (c *Config) hlsPlaylistProxy(ctx *gin.Context, u *url.URL, level int) {
+	req, err := http.NewRequest("GET", withLowLatencyQuery(u, ctx.Request.URL.Query()).String(), nil)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	req.Header.Set("User-Agent", ctx.Request.UserAgent())
+	c.setChannelHeaders(req.Header)
+
+	resp, err := c.upstreamDo(upstreamClient, withSelectedUpstream(ctx, req))
+	if err != nil {
+		_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		ctx.AbortWithStatus(resp.StatusCode)
+		return
+	}
+
+	body, err := c.readUpstreamBody(resp)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+
+	// uris are relative to the url after the redirects
+	ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", c.rewriteHLSPlaylist(body, resp.Request.URL, u.String(), level))
+}
+
+// withLowLatencyQuery return the url with the LL-HLS delivery directives of the player query,
+// _HLS_msn, _HLS_part and _HLS_skip, replacing the ones of the url.
+func withLowLatencyQuery(u *url.URL, query url.Values) *url.URL {
+	directives := url.Values{}
+	for name, values := range query {
+		if strings.HasPrefix(name, "_HLS_") {
+			directives[name] = values
+		}
+	}
+	if len(directives) == 0 {
+		return u
+	}
+
+	upstreamQuery := u.Query()
+	for name, values := range directives {
+		upstreamQuery[name] = values
+	}
+	withQuery := *u
+	withQuery.RawQuery = upstreamQuery.Encode()
+
+	return &withQuery
+}
+
+// rewriteHLSPlaylist rewrite the uris of the parent playlist fetched from base at the given nesting level.
+// The uris of a playlist deeper than the rewrite depth are only made absolute and point to the upstream.
+func (c *Config) rewriteHLSPlaylist(body []byte, base *url.URL, parent string, level int) []byte {
+	lines := strings.Split(string(body), "\n")
+	nextIsPlaylist := false
+	// the segments in their order, for the prefetch
+	var segments []string
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "#"):
+			isPlaylist := strings.HasPrefix(trimmed, "#EXT-X-MEDIA:") ||
+				strings.HasPrefix(trimmed, "#EXT-X-I-FRAME-STREAM-INF:") ||
+				strings.HasPrefix(trimmed, "#EXT-X-RENDITION-REPORT:")
+			if strings.HasPrefix(trimmed, "#EXT-X-STREAM-INF:") {
+				nextIsPlaylist = true
+			}
+
+			lines[i] = uriAttributeRegexp.ReplaceAllStringFunc(trimmed, func(attr string) string {
+				uri := uriAttributeRegexp.FindStringSubmatch(attr)[1]
+				proxied, _ := c.proxyHLSURI(uri, base, parent, level, isPlaylist)
+				return fmt.Sprintf("URI=%q", proxied)
+			})
+		default:
+			var key string
+			lines[i], key = c.proxyHLSURI(trimmed, base, parent, level, nextIsPlaylist)
+			if key != "" && !nextIsPlaylist {
+				segments = append(segments, key)
+			}
+			nextIsPlaylist = false
+		}
+	}
+
+	if c.SegmentPrefetch > 0 {
+		linkHLSSegments(segments, c.SegmentPrefetch)
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// hlsRewriteDepth return the number of nested playlist levels rewritten,
+// with the segment passthrough the master and media playlists are rewritten by default.
+func (c *Config) hlsRewriteDepth() int {
+	if c.HLSRewriteDepth == 0 && c.SegmentPassthrough {
+		return 2
+	}
+
+	return c.HLSRewriteDepth
+}
+
+// proxyHLSURI return the uri to write in a playlist for an upstream uri,
+// and the key of the resource when it goes through the proxy.
+func (c *Config) proxyHLSURI(uri string, base *url.URL, parent string, level int, isPlaylist bool) (string, string) {
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return uri, ""
+	}
+	abs := base.ResolveReference(ref)
+
+	if level > c.hlsRewriteDepth() {
+		return abs.String(), ""
+	}
+
+	res := hlsResource{
+		url:      abs.String(),
+		level:    level + 1,
+		playlist: isPlaylist || strings.HasSuffix(abs.Path, ".m3u8"),
+		track:    c.track,
+	}
+	// only the playlists go through the proxy, the players fetch the segments from the upstream
+	if !res.playlist && c.SegmentPassthrough {
+		return abs.String(), ""
+	}
+
+	if !res.playlist {
+		res.parent = parent
+	}
+
+	proxied, key := c.hlsResourceURL(res)
+	if key == "" {
+		return abs.String(), ""
+	}
+
+	return proxied, key
+}
+
+// hlsResourceURL register the resource and return its signed proxy url and its key,
+// no key when the url can't be built.
+func (c *Config) hlsResourceURL(res hlsResource) (string, string) {
+	key := registerHLSResource(res)
+
+	proxyURL, err := url.Parse(fmt.Sprintf("%s%s/hls/%s", c.baseURL(), c.proxyPath(), key))
+	if err != nil {
+		return "", ""
+	}
+	c.signURL(proxyURL)
+
+	return proxyURL.String(), key
+}
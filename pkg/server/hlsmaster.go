@@ -0,0 +1,61 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// getHLSMaster serve an hls master playlist listing every hls channel as a variant stream.
+func (c *Config) getHLSMaster(ctx *gin.Context) {
+	var buffer bytes.Buffer
+	buffer.WriteString("#EXTM3U\n")          // nolint: errcheck
+	buffer.WriteString("#EXT-X-VERSION:3\n") // nolint: errcheck
+
+	tracks := c.tracks()
+	for i := range tracks {
+		track := &tracks[i]
+		if !strings.HasSuffix(track.URI, ".m3u8") {
+			continue
+		}
+
+		uri, err := c.trackURL(track, i, false)
+		if err != nil {
+			logger.Errorf("track: %s: %s", track.Name, err)
+			continue
+		}
+
+		attributes := fmt.Sprintf("BANDWIDTH=%d", c.HLSMasterBandwidth)
+		if c.HLSMasterResolution != "" {
+			attributes += fmt.Sprintf(",RESOLUTION=%s", c.HLSMasterResolution)
+		}
+		// the quotes are not allowed in a quoted-string attribute
+		attributes += fmt.Sprintf(`,NAME="%s"`, strings.ReplaceAll(track.Name, `"`, "'"))
+
+		buffer.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:%s\n%s\n", attributes, uri)) // nolint: errcheck
+	}
+
+	ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", buffer.Bytes())
+}
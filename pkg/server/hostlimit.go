@@ -0,0 +1,140 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// hostSlots is the limits of the concurrent upstream requests by host,
+// so that a slow host doesn't hold the requests to the others.
+var hostSlots = map[string]*slotLimit{}
+var hostSlotsLock = sync.Mutex{}
+
+// errHostBusy is returned for a speculative request to a host which has its maximum of concurrent requests.
+var errHostBusy = errors.New("maximum of concurrent requests reached, speculative request skipped")
+
+// speculativeKey is the context key of the speculative upstream requests, e.g. the segment prefetches.
+type speculativeKey struct{}
+
+// withSpeculative return a context marking the upstream requests as speculative, they take no host slot.
+func withSpeculative(ctx context.Context) context.Context {
+	return context.WithValue(ctx, speculativeKey{}, true)
+}
+
+// hostConcurrency is the configured maximum of concurrent requests by host and for the other hosts.
+var hostConcurrency int
+var hostConcurrencyByHost map[string]int
+
+func configureHostLimit(max int, byHost map[string]int) {
+	hostSlotsLock.Lock()
+	defer hostSlotsLock.Unlock()
+
+	hostConcurrency = max
+	hostConcurrencyByHost = map[string]int{}
+	for host, n := range byHost {
+		hostConcurrencyByHost[strings.ToLower(host)] = n
+	}
+
+	// the limits are kept with the requests in flight they count, only their maximum changes
+	for host, slots := range hostSlots {
+		slots.setMax(hostMax(host))
+	}
+}
+
+// hostMax return the configured maximum of concurrent requests of the host,
+// the hosts are configured with or without their port.
+func hostMax(host string) int {
+	max, ok := hostConcurrencyByHost[host]
+	if !ok {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			max, ok = hostConcurrencyByHost[hostname]
+		}
+	}
+	if !ok {
+		max = hostConcurrency
+	}
+
+	return max
+}
+
+// hostLimit return the limit of the concurrent requests of the host.
+func hostLimit(host string) *slotLimit {
+	host = strings.ToLower(host)
+
+	hostSlotsLock.Lock()
+	defer hostSlotsLock.Unlock()
+
+	if slots, ok := hostSlots[host]; ok {
+		return slots
+	}
+
+	slots := newSlotLimit(hostMax(host))
+	hostSlots[host] = slots
+
+	return slots
+}
+
+// acquireHostSlot wait for a free slot of the host until the request is canceled,
+// the returned function release it.
+func acquireHostSlot(ctx context.Context, host string) (func(), error) {
+	slots := hostLimit(host)
+	if !slots.tryAcquire() {
+		logger.Debugf("%s: maximum of %d concurrent requests reached, waiting", host, slots.limit())
+		if err := slots.acquire(ctx); err != nil {
+			return nil, fmt.Errorf("%s: waiting for a request slot: %w", host, err)
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(slots.release) }, nil
+}
+
+// hostSlot return the function releasing the host slot of the request, waiting for a free one.
+// The speculative requests take no slot, so that they never hold the players requests back,
+// and are not sent while the host has its maximum of concurrent requests.
+func hostSlot(req *http.Request, host string) (func(), error) {
+	if speculative, _ := req.Context().Value(speculativeKey{}).(bool); speculative {
+		if !hostLimit(host).hasFree() {
+			return nil, fmt.Errorf("%s: %w", host, errHostBusy)
+		}
+		return func() {}, nil
+	}
+
+	return acquireHostSlot(req.Context(), host)
+}
+
+// slotBody release the host slot once the response body is closed, the streams hold it until they end.
+type slotBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *slotBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,96 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// idleWriter record the time of the last write to the client.
+type idleWriter struct {
+	gin.ResponseWriter
+	lastWrite int64
+}
+
+func (w *idleWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(&w.lastWrite, time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+func (w *idleWriter) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&w.lastWrite)))
+}
+
+// watchIdleStream abort the stream when no byte reaches the client for the stream idle timeout,
+// a client which stops reading without closing the connection would otherwise hold the
+// upstream connection forever. The returned function stops the watch once the stream ends.
+func (c *Config) watchIdleStream(ctx *gin.Context, body io.Closer) func() {
+	if c.StreamIdleTimeout <= 0 {
+		return func() {}
+	}
+
+	w := &idleWriter{ResponseWriter: ctx.Writer, lastWrite: time.Now().UnixNano()}
+	ctx.Writer = w
+
+	// a timeout below 4ns would give the ticker a zero interval, which panics
+	interval := c.StreamIdleTimeout / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if w.idle() < c.StreamIdleTimeout {
+					continue
+				}
+
+				logger.Warnf("%s | no data sent to the client for %s, stream aborted", ctx.ClientIP(), c.StreamIdleTimeout)
+				// closing the upstream body ends the copy, the write deadline unblocks a write
+				// stuck on a client not reading
+				_ = body.Close()
+				if err := http.NewResponseController(w.ResponseWriter).SetWriteDeadline(time.Now()); err != nil {
+					logger.Debugf("stream idle timeout: %s", err)
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// closeNotifier is an io.Closer reporting its close.
+type closeNotifier chan struct{}
+
+func (c closeNotifier) Close() error {
+	close(c)
+	return nil
+}
+
+func TestWatchIdleStreamTinyTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{time.Nanosecond, 3 * time.Nanosecond, time.Microsecond} {
+		c := newTestConfig()
+		c.StreamIdleTimeout = timeout
+
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/1.ts", nil)
+		body := make(closeNotifier)
+		stop := c.watchIdleStream(ctx, body)
+
+		select {
+		case <-body:
+		case <-time.After(5 * time.Second):
+			t.Errorf("stream idle timeout %s: the idle stream is not aborted", timeout)
+		}
+		stop()
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startedAt is when the proxy started, for its uptime.
+var startedAt = time.Now()
+
+// indexLink is an endpoint listed on the index page.
+type indexLink struct {
+	path        string
+	description string
+	// the credentials are added to the query of the authenticated endpoints
+	authenticated bool
+}
+
+// getIndex list the endpoints of the proxy for the authenticated users,
+// the others get a 404 so that the page does not disclose the proxy.
+func (c *Config) getIndex(ctx *gin.Context) {
+	authorized := c.isTrusted(ctx) ||
+		(ctx.Query("username") == c.User.String() && ctx.Query("password") == c.Password.String())
+	if !authorized {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	prefix := c.endpointPath("")
+
+	links := []indexLink{{"/ping", "Health check", false}}
+	if c.Metrics {
+		links = append(links, indexLink{"/metrics", "Prometheus metrics", false})
+	}
+
+	if c.XtreamBaseURL != "" {
+		links = append(links,
+			indexLink{prefix + "/get.php", "Xtream m3u playlist", true},
+			indexLink{prefix + "/player_api.php", "Xtream player api", true},
+			indexLink{prefix + "/xmltv.php", "Xtream epg", true},
+		)
+	}
+
+	links = append(links,
+		indexLink{prefix + "/" + c.M3UFileName, "M3U playlist", true},
+		indexLink{prefix + "/epg.xml", "Epg", true},
+		indexLink{prefix + "/groups", "Channel groups", true},
+		indexLink{prefix + "/master.m3u8", "Hls master playlist of the channels", true},
+		indexLink{prefix + "/userbouquet.tv", "Enigma2 bouquet", true},
+		indexLink{prefix + "/api/channels", "Channels with their proxyfied url", true},
+		indexLink{prefix + "/api/channels.csv", "Channels with their proxyfied url as csv", true},
+		indexLink{prefix + "/api/diff", "Channel changes of the last playlist refresh", true},
+		indexLink{prefix + "/api/channel/0/test", "Playback chain test of a channel, by its index in the stream urls", true},
+	)
+
+	if c.HDHomeRun {
+		links = append(links, indexLink{prefix + "/discover.json", "HDHomeRun discovery", false})
+	}
+
+	query := ""
+	if !c.isTrusted(ctx) {
+		query = "?" + url.Values{"username": {c.User.String()}, "password": {c.Password.String()}}.Encode()
+	}
+
+	lastRefresh := "never"
+	if t := lastPlaylistRefresh(); !t.IsZero() {
+		lastRefresh = t.Format(time.RFC1123)
+	}
+
+	var page strings.Builder
+	page.WriteString("<!DOCTYPE html>\n<html>\n<head><title>iptv-proxy</title></head>\n<body>\n<h1>iptv-proxy</h1>\n")
+	page.WriteString(fmt.Sprintf("<p>%d channels, playlist loaded %s, up for %s</p>\n", len(c.tracks()), html.EscapeString(lastRefresh), time.Since(startedAt).Round(time.Second)))
+	page.WriteString("<ul>\n")
+	for _, link := range links {
+		href := link.path
+		if link.authenticated {
+			href += query
+		}
+		page.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a> %s</li>\n", html.EscapeString(href), html.EscapeString(link.path), html.EscapeString(link.description)))
+	}
+	page.WriteString("</ul>\n</body>\n</html>\n")
+
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page.String()))
+}
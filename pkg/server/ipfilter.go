@@ -0,0 +1,91 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// clientFilter is the networks the clients are allowed from and denied from.
+type clientFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseClientFilter parse the client allowlist and denylist, nil when both are empty.
+func parseClientFilter(config *config.ProxyConfig) (*clientFilter, error) {
+	if len(config.ClientAllowlist) == 0 && len(config.ClientDenylist) == 0 {
+		return nil, nil
+	}
+
+	allow, err := parseNetworks("client allowlist network", config.ClientAllowlist)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseNetworks("client denylist network", config.ClientDenylist)
+	if err != nil {
+		return nil, err
+	}
+
+	return &clientFilter{allow: allow, deny: deny}, nil
+}
+
+// allowed report whether the client address passes the allowlist, when there is one, then the denylist.
+func (f *clientFilter) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+		return false
+	}
+
+	return !containsIP(f.deny, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterClients answer 403 to the clients out of the allowlist or in the denylist, before any other
+// handler. The forwarded headers give the client address only when sent by the trusted proxies.
+func (c *Config) filterClients(ctx *gin.Context) {
+	client := ctx.RemoteIP()
+	if len(c.TrustedProxies) > 0 {
+		client = ctx.ClientIP()
+	}
+
+	if c.clientFilter.allowed(net.ParseIP(client)) {
+		return
+	}
+
+	logger.Warnf("%s | denied %s %s", client, ctx.Request.Method, ctx.Request.URL.Path)
+	ctx.AbortWithStatus(http.StatusForbidden)
+}
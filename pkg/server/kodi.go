@@ -0,0 +1,52 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/url"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// Kodi's PVR IPTV Simple Client reads the xmltv url from the x-tvg-url attribute of the
+// m3u header and matches the channels of the m3u and the xmltv by their tvg-id, the
+// channels without tvg-id get one derived from their upstream url in both.
+
+// tvgURL return the url of the proxy xmltv announced in the m3u header,
+// without the credentials in a playlist served credential-less to a trusted client.
+func (c *Config) tvgURL() string {
+	if c.credentialless {
+		return c.baseURL() + "/epg.xml"
+	}
+
+	query := url.Values{}
+	query.Set("username", c.User.String())
+	query.Set("password", c.Password.String())
+
+	return c.baseURL() + "/epg.xml?" + query.Encode()
+}
+
+// channelID return the tvg-id of the track in the generated m3u and xmltv.
+func (c *Config) channelID(track *m3u.Track) string {
+	if id := track.Tag("tvg-id"); id != "" || !c.KodiPVR {
+		return id
+	}
+
+	return "iptv-proxy." + hashTrackURI(track.URI)
+}
@@ -0,0 +1,60 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestKodiTrustedClients(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantTvgURL string
+	}{
+		{name: "credential-less", wantTvgURL: `#EXTM3U x-tvg-url="http://proxy.local:8080/epg.xml"`},
+		{name: "with credentials", query: "?username=user&password=pass", wantTvgURL: `#EXTM3U x-tvg-url="http://proxy.local:8080/epg.xml?password=pass&username=user"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(m3u.Track{Name: "One", Length: -1, URI: "http://upstream.tv/1.ts"})
+			c.KodiPVR = true
+			c.trustedNetworks, _ = parseTrustedNetworks([]string{"192.0.2.0/24"})
+
+			w := serveTest(c, httptest.NewRequest(http.MethodGet, "/iptv.m3u"+tt.query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /iptv.m3u status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if header := strings.SplitN(w.Body.String(), "\n", 2)[0]; header != tt.wantTvgURL {
+				t.Errorf("GET /iptv.m3u header = %q, want %q", header, tt.wantTvgURL)
+			}
+
+			// the epg announced to Kodi is served to the trusted clients as the playlist
+			w = serveTest(c, httptest.NewRequest(http.MethodGet, "/epg.xml"+tt.query, nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("GET /epg.xml status = %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// slotLimit count the slots in use against a maximum, no maximum when it is 0 or less.
+// The slots in use are counted whatever the maximum, so that a new maximum set by a reload
+// applies to the requests already in flight.
+type slotLimit struct {
+	lock sync.Mutex
+	max  int
+	used int
+	// closed and replaced when a slot is released or the maximum changes
+	freed chan struct{}
+}
+
+func newSlotLimit(max int) *slotLimit {
+	return &slotLimit{max: max, freed: make(chan struct{})}
+}
+
+// setMax change the maximum, the waiting requests are woken up to check it again.
+func (l *slotLimit) setMax(max int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.max = max
+	l.wake()
+}
+
+// tryAcquire take a slot and report whether one was free.
+func (l *slotLimit) tryAcquire() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.max > 0 && l.used >= l.max {
+		return false
+	}
+	l.used++
+
+	return true
+}
+
+// acquire wait for a free slot until the context is done.
+func (l *slotLimit) acquire(ctx context.Context) error {
+	for {
+		l.lock.Lock()
+		if l.max <= 0 || l.used < l.max {
+			l.used++
+			l.lock.Unlock()
+			return nil
+		}
+		freed := l.freed
+		l.lock.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release free a slot taken by tryAcquire or acquire.
+func (l *slotLimit) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.used--
+	l.wake()
+}
+
+// hasFree report whether a slot is free, without taking it.
+func (l *slotLimit) hasFree() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.max <= 0 || l.used < l.max
+}
+
+// limit return the maximum, 0 or less without.
+func (l *slotLimit) limit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.max
+}
+
+func (l *slotLimit) wake() {
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// streamSlots is the limit of the concurrent streams, kept across the reloads.
+var streamSlots = newSlotLimit(0)
+
+func configureStreamLimit(max int) {
+	streamSlots.setMax(max)
+}
+
+// limitStreams reject the stream request when the maximum of concurrent streams is reached,
+// the slot is held until the stream ends.
+func limitStreams(ctx *gin.Context) {
+	if !streamSlots.tryAcquire() {
+		logger.Warnf("%s | maximum of %d concurrent streams reached", ctx.ClientIP(), streamSlots.limit())
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	defer streamSlots.release()
+
+	ctx.Next()
+}
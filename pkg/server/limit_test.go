@@ -0,0 +1,90 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlotLimitKeepsUsageAcrossMaxChange(t *testing.T) {
+	l := newSlotLimit(2)
+	if !l.tryAcquire() || !l.tryAcquire() {
+		t.Fatal("expected 2 free slots")
+	}
+
+	// a reload lowering then raising the maximum keeps the slots in use
+	l.setMax(1)
+	if l.tryAcquire() {
+		t.Fatal("expected no free slot with 2 in use and a maximum of 1")
+	}
+	l.setMax(3)
+	if !l.tryAcquire() {
+		t.Fatal("expected a free slot with 2 in use and a maximum of 3")
+	}
+	if l.tryAcquire() {
+		t.Fatal("expected no free slot with 3 in use and a maximum of 3")
+	}
+
+	l.release()
+	if !l.tryAcquire() {
+		t.Fatal("expected the released slot to be free")
+	}
+}
+
+func TestSlotLimitUnlimited(t *testing.T) {
+	l := newSlotLimit(0)
+	for i := 0; i < 10; i++ {
+		if !l.tryAcquire() {
+			t.Fatalf("expected slot %d to be free without maximum", i)
+		}
+	}
+
+	// the slots taken while unlimited count once a maximum is set
+	l.setMax(10)
+	if l.tryAcquire() {
+		t.Fatal("expected no free slot with 10 in use and a maximum of 10")
+	}
+}
+
+func TestSlotLimitAcquireWaits(t *testing.T) {
+	l := newSlotLimit(1)
+	if !l.tryAcquire() {
+		t.Fatal("expected a free slot")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); err == nil {
+		t.Fatal("expected the wait to end with the context")
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- l.acquire(context.Background()) }()
+	l.release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting request to get the released slot")
+	}
+}
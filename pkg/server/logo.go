@@ -0,0 +1,267 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // register the gif logos decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// logoCacheSize is the maximum number of logos kept in memory.
+const logoCacheSize = 1024
+
+// logoMaxSize is the maximum size of an upstream logo.
+const logoMaxSize = 5 << 20
+
+// logoMaxPixels is the maximum number of pixels of an upstream logo, so that a small
+// compressed image doesn't decode to gigabytes.
+const logoMaxPixels = 4096 * 4096
+
+// errLogoTooLarge is returned for the logos larger than the maximum size or number of pixels.
+var errLogoTooLarge = errors.New("logo too large")
+
+type cachedLogo struct {
+	contentType string
+	data        []byte
+}
+
+var logoCache = map[string]cachedLogo{}
+var logoCacheLock = sync.RWMutex{}
+
+// resizesLogos report whether the logos are served resized by the proxy.
+func (c *Config) resizesLogos() bool {
+	return c.LogoMaxWidth > 0 || c.LogoMaxHeight > 0
+}
+
+// logoURL return the tvg-logo of the track in the generated playlists,
+// the proxy url of the resized logo when the logos are resized.
+func (c *Config) logoURL(track *m3u.Track, trackIndex int) string {
+	logo := track.Tag("tvg-logo")
+	if logo == "" || !c.resizesLogos() {
+		return logo
+	}
+
+	return c.baseURL() + path.Join(c.proxyPath(), "logo", c.encodeTrackIndex(trackIndex, track.URI))
+}
+
+// logoHandler serve the tvg-logo of the channel resized to the configured maximum dimensions,
+// the svg logos and the unknown formats are served as is.
+func (c *Config) logoHandler(ctx *gin.Context) {
+	track, ok := c.trackByIndex(ctx.Param("index"))
+	if !ok || track.Tag("tvg-logo") == "" {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	logo := track.Tag("tvg-logo")
+
+	key := fmt.Sprintf("%s %dx%d", logo, c.LogoMaxWidth, c.LogoMaxHeight)
+	logoCacheLock.RLock()
+	cached, ok := logoCache[key]
+	logoCacheLock.RUnlock()
+
+	if !ok {
+		trackConfig := *c
+		trackConfig.track = &track
+
+		var err error
+		cached, err = trackConfig.fetchLogo(logo)
+		if err != nil {
+			_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
+			return
+		}
+
+		logoCacheLock.Lock()
+		// the cache is dropped as a whole when full, the logos are fetched again on demand
+		if len(logoCache) >= logoCacheSize {
+			logoCache = map[string]cachedLogo{}
+		}
+		logoCache[key] = cached
+		logoCacheLock.Unlock()
+	}
+
+	ctx.Header("Cache-Control", "public, max-age=86400")
+	ctx.Data(http.StatusOK, cached.contentType, cached.data)
+}
+
+// fetchLogo download the logo and resize it when it is larger than the maximum dimensions.
+func (c *Config) fetchLogo(logo string) (cachedLogo, error) {
+	req, err := http.NewRequest("GET", logo, nil)
+	if err != nil {
+		return cachedLogo{}, err
+	}
+	c.setChannelHeaders(req.Header)
+
+	resp, err := c.upstreamDo(upstreamClient, req)
+	if err != nil {
+		return cachedLogo{}, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return cachedLogo{}, fmt.Errorf("logo %s: unexpected status %s", logo, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, logoMaxSize+1))
+	if err != nil {
+		return cachedLogo{}, err
+	}
+	if len(data) > logoMaxSize {
+		return cachedLogo{}, fmt.Errorf("logo %s: %w: more than %d bytes", logo, errLogoTooLarge, logoMaxSize)
+	}
+
+	original := cachedLogo{contentType: resp.Header.Get("Content-Type"), data: data}
+	if strings.Contains(original.contentType, "svg") {
+		return original, nil
+	}
+
+	img, format, err := decodeLogo(data)
+	if errors.Is(err, errLogoTooLarge) {
+		return cachedLogo{}, fmt.Errorf("logo %s: %w", logo, err)
+	}
+	if err != nil {
+		// unknown format
+		return original, nil
+	}
+
+	width, height, resize := c.logoSize(img.Bounds().Dx(), img.Bounds().Dy())
+	if !resize {
+		return original, nil
+	}
+
+	var buf bytes.Buffer
+	resized := resizeImage(img, width, height)
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 85})
+		original.contentType = "image/jpeg"
+	} else {
+		err = png.Encode(&buf, resized)
+		original.contentType = "image/png"
+	}
+	if err != nil {
+		return cachedLogo{}, err
+	}
+	original.data = buf.Bytes()
+
+	return original, nil
+}
+
+// decodeLogo decode the logo once its dimensions are checked against the maximum number of pixels.
+func decodeLogo(data []byte) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, "", fmt.Errorf("invalid logo dimensions %dx%d", config.Width, config.Height)
+	}
+	if config.Width > logoMaxPixels/config.Height {
+		return nil, "", fmt.Errorf("%w: %dx%d pixels", errLogoTooLarge, config.Width, config.Height)
+	}
+
+	return image.Decode(bytes.NewReader(data))
+}
+
+// logoSize return the dimensions of the logo fitting the maximum ones with the same aspect ratio,
+// resize is false when the logo already fits.
+func (c *Config) logoSize(width, height int) (int, int, bool) {
+	scale := 1.0
+	if c.LogoMaxWidth > 0 && width > c.LogoMaxWidth {
+		scale = float64(c.LogoMaxWidth) / float64(width)
+	}
+	if c.LogoMaxHeight > 0 && height > c.LogoMaxHeight {
+		if s := float64(c.LogoMaxHeight) / float64(height); s < scale {
+			scale = s
+		}
+	}
+	if scale == 1.0 {
+		return width, height, false
+	}
+
+	w, h := int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	return w, h, true
+}
+
+// resizeImage downscale the image by averaging the source pixels covered by each pixel.
+func resizeImage(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					// the colors are weighted by their alpha so that the transparent pixels don't darken the edges
+					r += uint64(c.R) * uint64(c.A)
+					g += uint64(c.G) * uint64(c.A)
+					b += uint64(c.B) * uint64(c.A)
+					a += uint64(c.A)
+					n++
+				}
+			}
+
+			if a == 0 {
+				continue
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / a >> 8),
+				G: uint8(g / a >> 8),
+				B: uint8(b / a >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,77 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestDecodeLogo(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 64, 32))); err != nil {
+		t.Fatal(err)
+	}
+
+	img, format, err := decodeLogo(buf.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if format != "png" || img.Bounds().Dx() != 64 || img.Bounds().Dy() != 32 {
+		t.Errorf("decodeLogo() = %s %v, want png 64x32", format, img.Bounds())
+	}
+}
+
+func TestDecodeLogoTooManyPixels(t *testing.T) {
+	// a png header announcing 100000x100000 pixels, it is refused before any pixel is decoded
+	_, _, err := decodeLogo(pngHeader(100000, 100000))
+	if !errors.Is(err, errLogoTooLarge) {
+		t.Fatalf("decodeLogo() error = %v, want %v", err, errLogoTooLarge)
+	}
+}
+
+func TestDecodeLogoUnknownFormat(t *testing.T) {
+	_, _, err := decodeLogo([]byte("<svg></svg>"))
+	if err == nil || errors.Is(err, errLogoTooLarge) {
+		t.Fatalf("decodeLogo() error = %v, want an unknown format error", err)
+	}
+}
+
+// pngHeader return the signature and IHDR chunk of a png of the given dimensions.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 6 // truecolor with alpha
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	_ = binary.Write(&buf, binary.BigEndian, uint32(13))
+	buf.Write(ihdr)
+	_ = binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+
+	return buf.Bytes()
+}
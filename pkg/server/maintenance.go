@@ -0,0 +1,107 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// maintenanceSince is when the maintenance mode was enabled, zero when it is off.
+// It is kept in memory only, a restart ends the maintenance.
+var maintenanceSince time.Time
+var maintenanceLock = sync.RWMutex{}
+
+// maintenanceState is the answer of the maintenance api.
+type maintenanceState struct {
+	Maintenance bool       `json:"maintenance"`
+	Since       *time.Time `json:"since,omitempty"`
+}
+
+// streams return the group of the stream routes, answering 503 during the maintenance.
+// The playlists, the api, the logos and the ping stay available.
+func (c *Config) streams(r *gin.RouterGroup) *gin.RouterGroup {
+	return r.Group("", c.checkMaintenance)
+}
+
+// checkMaintenance answer 503 with a Retry-After to the stream requests during the maintenance.
+func (c *Config) checkMaintenance(ctx *gin.Context) {
+	maintenanceLock.RLock()
+	active := !maintenanceSince.IsZero()
+	maintenanceLock.RUnlock()
+	if !active {
+		return
+	}
+
+	if c.MaintenanceRetryAfter > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(int(c.MaintenanceRetryAfter.Seconds())))
+	}
+	ctx.AbortWithStatus(http.StatusServiceUnavailable)
+}
+
+// getMaintenance serve the state of the maintenance mode.
+func (c *Config) getMaintenance(ctx *gin.Context) {
+	maintenanceLock.RLock()
+	defer maintenanceLock.RUnlock()
+
+	ctx.JSON(http.StatusOK, currentMaintenanceState())
+}
+
+// postMaintenance enable or disable the maintenance mode with the enabled query,
+// toggle it without.
+func (c *Config) postMaintenance(ctx *gin.Context) {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	enabled := maintenanceSince.IsZero()
+	if value := ctx.Query("enabled"); value != "" {
+		var err error
+		if enabled, err = strconv.ParseBool(value); err != nil {
+			_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid enabled %q: %w", value, err)) // nolint: errcheck
+			return
+		}
+	}
+
+	switch {
+	case enabled && maintenanceSince.IsZero():
+		maintenanceSince = time.Now()
+		logger.Warnf("%s | maintenance mode enabled, the streams are answered 503", ctx.ClientIP())
+	case !enabled && !maintenanceSince.IsZero():
+		logger.Infof("%s | maintenance mode disabled after %s", ctx.ClientIP(), time.Since(maintenanceSince).Round(time.Second))
+		maintenanceSince = time.Time{}
+	}
+
+	ctx.JSON(http.StatusOK, currentMaintenanceState())
+}
+
+// currentMaintenanceState return the state of the maintenance mode, under the lock.
+func currentMaintenanceState() maintenanceState {
+	if maintenanceSince.IsZero() {
+		return maintenanceState{}
+	}
+
+	since := maintenanceSince
+	return maintenanceState{Maintenance: true, Since: &since}
+}
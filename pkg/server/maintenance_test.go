@@ -0,0 +1,65 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceAuthentication(t *testing.T) {
+	tests := []struct {
+		name            string
+		method          string
+		query           string
+		protectPlaylist bool
+		wantStatus      int
+	}{
+		{name: "state without credentials", method: http.MethodGet, wantStatus: http.StatusBadRequest},
+		{name: "toggle without credentials", method: http.MethodPost, query: "?enabled=true", wantStatus: http.StatusBadRequest},
+		{name: "toggle without credentials, protected playlists", method: http.MethodPost, query: "?enabled=true", protectPlaylist: true, wantStatus: http.StatusUnauthorized},
+		{name: "toggle with wrong credentials", method: http.MethodPost, query: "?enabled=true&username=user&password=wrong", wantStatus: http.StatusUnauthorized},
+		{name: "state with credentials", method: http.MethodGet, query: "?username=user&password=pass", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig()
+			// the trusted clients get the playlists without credentials, not the maintenance api
+			c.trustedNetworks, _ = parseTrustedNetworks([]string{"192.0.2.0/24"})
+			c.ProtectPlaylist = tt.protectPlaylist
+
+			w := serveTest(c, httptest.NewRequest(tt.method, "/api/maintenance"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("%s /api/maintenance%s status = %d, want %d", tt.method, tt.query, w.Code, tt.wantStatus)
+			}
+
+			maintenanceLock.RLock()
+			since := maintenanceSince
+			maintenanceLock.RUnlock()
+			if !since.IsZero() {
+				t.Error("the maintenance mode is enabled by an unauthenticated request")
+				maintenanceLock.Lock()
+				maintenanceSince = time.Time{}
+				maintenanceLock.Unlock()
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// errTooLarge is returned when an upstream response is larger than the maximum segment bytes.
+var errTooLarge = errors.New("upstream response too large")
+
+// maxBytesReader fail with errTooLarge once more than max bytes are read, no maximum when it is 0 or less.
+// A malicious or broken upstream can't make the proxy fill its memory or its disk.
+type maxBytesReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func newMaxBytesReader(r io.Reader, max int64) *maxBytesReader {
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+
+	return &maxBytesReader{r: r, max: max}
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.exceeded() {
+		return n - int(r.read-r.max), fmt.Errorf("%w: more than %d bytes", errTooLarge, r.max)
+	}
+
+	return n, err
+}
+
+// exceeded report whether more than the maximum was read, for the readers
+// like the m3u decoder which stop at the error without returning it.
+func (r *maxBytesReader) exceeded() bool {
+	return r.max > 0 && r.read > r.max
+}
+
+// readUpstreamBody read the whole upstream body, up to the maximum segment bytes.
+func (c *Config) readUpstreamBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(newMaxBytesReader(resp.Body, c.MaxSegmentBytes))
+	if errors.Is(err, errTooLarge) && resp.Request != nil {
+		logger.Warnf("upstream %s: %s, dropped", resp.Request.URL.Redacted(), err)
+	}
+
+	return body, err
+}
@@ -0,0 +1,95 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafov/m3u8"
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestMaxBytesReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		max     int64
+		want    string
+		wantErr bool
+	}{
+		{name: "smaller", body: "segment", max: 10, want: "segment"},
+		{name: "exactly the maximum", body: "segment", max: 7, want: "segment"},
+		{name: "larger", body: "segment", max: 4, want: "segm", wantErr: true},
+		{name: "no maximum", body: "segment", max: 0, want: "segment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newMaxBytesReader(strings.NewReader(tt.body), tt.max)
+			got, err := io.ReadAll(r)
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+			if errors.Is(err, errTooLarge) != tt.wantErr || r.exceeded() != tt.wantErr {
+				t.Errorf("error = %v, exceeded = %t, want too large %t", err, r.exceeded(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxSegmentBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("#EXTM3U\n#EXTINF:-1,One\nhttp://upstream.tv/1.ts\n"))
+	}))
+	defer upstream.Close()
+
+	t.Run("playlist", func(t *testing.T) {
+		_, err := fetchPlaylist(upstreamClient, &config.ProxyConfig{MaxSegmentBytes: 16}, upstream.URL)
+		if !errors.Is(err, errTooLarge) {
+			t.Errorf("fetchPlaylist error = %v, want %v", err, errTooLarge)
+		}
+	})
+
+	t.Run("timeshift segment", func(t *testing.T) {
+		buffer := &dvrBuffer{dir: t.TempDir(), retention: time.Hour}
+		c := &Config{
+			ProxyConfig: &config.ProxyConfig{DownloadFileMode: 0o644, MaxSegmentBytes: 16},
+			track:       &m3u.Track{Name: "channel"},
+		}
+		u, _ := url.Parse(upstream.URL + "/1.ts")
+		err := c.recordSegment(buffer, u, 1, &m3u8.MediaSegment{Duration: 4}, nil, false)
+		if !errors.Is(err, errTooLarge) {
+			t.Errorf("recordSegment error = %v, want %v", err, errTooLarge)
+		}
+		if len(buffer.segments) != 0 {
+			t.Errorf("recorded %+v, want no segment", buffer.segments)
+		}
+		if files, _ := os.ReadDir(buffer.dir); len(files) != 0 {
+			t.Errorf("the partial file is kept: %v", files)
+		}
+	})
+}
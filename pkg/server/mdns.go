@@ -0,0 +1,220 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsService is the service type of the HDHomeRun tuners on the local network.
+const mdnsService = "_hdhomerun._tcp.local."
+
+// mdnsTTL is the time to live of the advertised records, in seconds.
+const mdnsTTL = 120
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsAdvertiser answer the mDNS queries of the HDHomeRun tuner service with the emulated device.
+type mdnsAdvertiser struct {
+	conn     *net.UDPConn
+	instance string
+	host     string
+	ip       net.IP
+	port     uint16
+	txt      []string
+}
+
+// advertiseMDNS announce the emulated HDHomeRun tuner on the local network and answer
+// the mDNS queries until the configuration is replaced.
+func (c *Config) advertiseMDNS() {
+	device := c.hdhrDevice()
+
+	ip := mdnsIP(c.HostConfig.Hostname)
+	if ip == nil {
+		logger.Errorf("mdns: no ipv4 address to advertise, set the hostname to the lan address of the proxy")
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		logger.Errorf("mdns: %s", err)
+		return
+	}
+	// a DVR running on the same host gets the answers too
+	if err := ipv4.NewPacketConn(conn).SetMulticastLoopback(true); err != nil {
+		logger.Warnf("mdns: %s", err)
+	}
+	go func() {
+		<-c.stop
+		_ = conn.Close()
+	}()
+
+	name := "iptv-proxy-" + strings.ToLower(device.DeviceID)
+	a := &mdnsAdvertiser{
+		conn:     conn,
+		instance: name + "." + mdnsService,
+		host:     name + ".local.",
+		ip:       ip,
+		port:     uint16(c.PublicPort()),
+		txt: []string{
+			"DeviceID=" + device.DeviceID,
+			"ModelNumber=" + device.ModelNumber,
+			"FriendlyName=" + device.FriendlyName,
+			"TunerCount=" + strconv.Itoa(device.TunerCount),
+			"BaseURL=" + device.BaseURL,
+			"LineupURL=" + device.LineupURL,
+		},
+	}
+
+	logger.Infof("mdns: advertising %s on %s:%d", a.instance, a.ip, a.port)
+	a.announce()
+	a.serve()
+}
+
+// mdnsIP return the ipv4 address advertised for the hostname, the first lan address of the
+// host when the hostname isn't an ipv4 address.
+func mdnsIP(hostname string) net.IP {
+	if ip := net.ParseIP(hostname).To4(); ip != nil && !ip.IsLoopback() {
+		return ip
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			if ip := ipNet.IP.To4(); ip != nil {
+				return ip
+			}
+		}
+	}
+
+	return nil
+}
+
+// announce send the records of the service without being asked.
+func (a *mdnsAdvertiser) announce() {
+	msg, err := a.response(dnsmessage.TypeALL)
+	if err != nil {
+		logger.Errorf("mdns: %s", err)
+		return
+	}
+
+	_, _ = a.conn.WriteToUDP(msg, mdnsGroup) // nolint: errcheck
+}
+
+// serve answer the queries of the service, its instance or its host until the connection is closed.
+func (a *mdnsAdvertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		if err != nil || header.Response {
+			continue
+		}
+		questions, err := parser.AllQuestions()
+		if err != nil {
+			continue
+		}
+
+		for _, q := range questions {
+			if !a.matches(q) {
+				continue
+			}
+
+			msg, err := a.response(q.Type)
+			if err != nil {
+				logger.Errorf("mdns: %s", err)
+				continue
+			}
+			_, _ = a.conn.WriteToUDP(msg, mdnsGroup) // nolint: errcheck
+			break
+		}
+	}
+}
+
+// matches report whether the question is about the advertised service.
+func (a *mdnsAdvertiser) matches(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+	switch name {
+	case mdnsService, a.instance, a.host:
+		return true
+	}
+
+	return false
+}
+
+// response build the answer of the service records, the whole set for the service and
+// instance queries so that the clients don't need to ask again.
+func (a *mdnsAdvertiser) response(qtype dnsmessage.Type) ([]byte, error) {
+	service, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(a.instance)
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(a.host)
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	header := func(name dnsmessage.Name, t dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: t, Class: dnsmessage.ClassINET, TTL: mdnsTTL}
+	}
+
+	var ip [4]byte
+	copy(ip[:], a.ip.To4())
+
+	if qtype != dnsmessage.TypeA {
+		if err := b.PTRResource(header(service, dnsmessage.TypePTR), dnsmessage.PTRResource{PTR: instance}); err != nil {
+			return nil, err
+		}
+		if err := b.SRVResource(header(instance, dnsmessage.TypeSRV), dnsmessage.SRVResource{Port: a.port, Target: host}); err != nil {
+			return nil, err
+		}
+		if err := b.TXTResource(header(instance, dnsmessage.TypeTXT), dnsmessage.TXTResource{TXT: a.txt}); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.AResource(header(host, dnsmessage.TypeA), dnsmessage.AResource{A: ip}); err != nil {
+		return nil, err
+	}
+
+	return b.Finish()
+}
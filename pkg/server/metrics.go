@@ -0,0 +1,84 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Kinds of the upstream requests in the metrics.
+const (
+	upstreamKindPlaylist  = "playlist"
+	upstreamKindSegment   = "segment"
+	upstreamKindXtreamAPI = "xtream_api"
+)
+
+var upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "iptv_proxy",
+	Name:      "upstream_request_duration_seconds",
+	Help:      "Duration of the upstream requests until the response headers, by kind and host.",
+	Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+}, []string{"kind", "host"})
+
+// observeUpstream record the duration of an upstream request.
+func observeUpstream(kind, host string, start time.Time) {
+	upstreamDuration.WithLabelValues(kind, host).Observe(time.Since(start).Seconds())
+}
+
+// upstreamKindKey is the request context key of the upstream request kind.
+type upstreamKindKey struct{}
+
+// withUpstreamKind set the kind of the upstream request in the metrics.
+func withUpstreamKind(req *http.Request, kind string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), upstreamKindKey{}, kind))
+}
+
+// timedTransport record the duration of the requests in the upstream metrics.
+// Without a kind set on the transport or the request it is guessed from the url,
+// the playlists and manifests apart from the segments.
+type timedTransport struct {
+	kind string
+	next http.RoundTripper
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	kind := t.kind
+	if k, ok := req.Context().Value(upstreamKindKey{}).(string); ok {
+		kind = k
+	}
+	if kind == "" {
+		kind = upstreamKindSegment
+		switch path.Ext(req.URL.Path) {
+		case ".m3u8", ".m3u", ".mpd":
+			kind = upstreamKindPlaylist
+		}
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	observeUpstream(kind, req.URL.Host, start)
+
+	return resp, err
+}
@@ -0,0 +1,135 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// upstreamMirror is a base url serving the same content as the upstream, with its share of the requests.
+type upstreamMirror struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+
+	base    *url.URL
+	current int
+}
+
+// mirrorGroup is the mirrors of an upstream base url, balanced by smooth weighted round-robin.
+type mirrorGroup struct {
+	sync.Mutex
+	mirrors []*upstreamMirror
+	total   int
+}
+
+// loadUpstreamMirrors read the json file mapping an upstream base url to its mirrors, e.g.
+// {"http://provider.tv": [{"url": "http://provider.tv", "weight": 2}, {"url": "http://mirror.tv:8080", "weight": 1}]}.
+func loadUpstreamMirrors(filePath string) (map[string]*mirrorGroup, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string][]*upstreamMirror
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("invalid upstream mirrors file %s: %w", filePath, err)
+	}
+
+	groups := make(map[string]*mirrorGroup, len(raw))
+	for upstream, mirrors := range raw {
+		u, err := url.Parse(upstream)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream mirrors file %s: invalid upstream %q", filePath, upstream)
+		}
+
+		group := &mirrorGroup{}
+		for _, mirror := range mirrors {
+			mirror.base, err = url.Parse(mirror.URL)
+			if err != nil || mirror.base.Host == "" {
+				return nil, fmt.Errorf("invalid upstream mirrors file %s: invalid mirror %q", filePath, mirror.URL)
+			}
+			if mirror.Weight <= 0 {
+				mirror.Weight = 1
+			}
+			group.mirrors = append(group.mirrors, mirror)
+			group.total += mirror.Weight
+		}
+
+		if len(group.mirrors) > 0 {
+			groups[mirrorKey(u)] = group
+		}
+	}
+
+	return groups, nil
+}
+
+func mirrorKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// order return the mirrors to try for a request, the one picked by the weighted round-robin first
+// and the others after it as fallbacks.
+func (g *mirrorGroup) order() []*upstreamMirror {
+	g.Lock()
+	defer g.Unlock()
+
+	best := 0
+	for i, mirror := range g.mirrors {
+		mirror.current += mirror.Weight
+		if mirror.current > g.mirrors[best].current {
+			best = i
+		}
+	}
+	g.mirrors[best].current -= g.total
+
+	order := make([]*upstreamMirror, 0, len(g.mirrors))
+	for i := range g.mirrors {
+		order = append(order, g.mirrors[(best+i)%len(g.mirrors)])
+	}
+
+	return order
+}
+
+// mirrorURLs return the urls to try for an upstream url, the url itself when it has no mirror.
+func (c *Config) mirrorURLs(u *url.URL) []*url.URL {
+	group, ok := c.upstreamMirrors[mirrorKey(u)]
+	if !ok {
+		return []*url.URL{u}
+	}
+
+	mirrors := group.order()
+	urls := make([]*url.URL, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		mirrored := *u
+		mirrored.Scheme = mirror.base.Scheme
+		mirrored.Host = mirror.base.Host
+		urls = append(urls, &mirrored)
+	}
+
+	return urls
+}
@@ -0,0 +1,63 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// notFoundSegmentName is the name of the "channel not found" segment in the fallback hls playlist.
+const notFoundSegmentName = "notfound.ts"
+
+// loadNotFoundSegment read the mpeg-ts segment served for the unknown channels.
+func loadNotFoundSegment(filePath string) ([]byte, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	segment, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid not found segment: %w", err)
+	}
+
+	return segment, nil
+}
+
+// channelNotFound answer the request of an unknown channel with the "channel not found" segment
+// when it is configured, so that the players show it instead of an error, else with a 404.
+// The hls requests get a playlist of that segment.
+func (c *Config) channelNotFound(ctx *gin.Context) {
+	if c.notFoundSegment == nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if strings.HasSuffix(ctx.Param("id"), ".m3u8") {
+		playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:10.0,\n%s\n#EXT-X-ENDLIST\n", notFoundSegmentName)
+		ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist))
+		return
+	}
+
+	ctx.Data(http.StatusOK, "video/mp2t", c.notFoundSegment)
+}
@@ -0,0 +1,195 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// errEmptyPlaylist is reported when the m3u playlist parses without any track,
+// e.g. when the provider answers with an html error or login page.
+var errEmptyPlaylist = errors.New("the m3u playlist has no track, check the playlist url and the provider credentials")
+
+// Handling of the tracks of a merged playlist whose url is already in a previous one.
+const (
+	mergeDuplicatesKeep = "keep"
+	mergeDuplicatesDrop = "drop"
+)
+
+func validMergeDuplicates(duplicates string) bool {
+	switch duplicates {
+	case "", mergeDuplicatesKeep, mergeDuplicatesDrop:
+		return true
+	}
+
+	return false
+}
+
+// fetchPlaylists fetch the m3u playlist and the playlists merged after it into a single one.
+// The sources are fetched concurrently, up to the playlist fetch concurrency, each result is
+// kept at the position of its source so that the merge order doesn't depend on the fetch one.
+func fetchPlaylists(client *http.Client, config *config.ProxyConfig) (m3u.Playlist, error) {
+	sources := append([]string{config.RemoteURL.String()}, config.PlaylistMergeSources...)
+
+	playlists := make([]m3u.Playlist, len(sources))
+	errs := make([]error, len(sources))
+
+	workers := config.PlaylistFetchConcurrency
+	if workers > len(sources) {
+		workers = len(sources)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				playlists[i], errs[i] = fetchPlaylist(client, config, sources[i])
+			}
+		}()
+	}
+
+	for i := range sources {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	// the error of the first failing source is reported, whatever source failed first
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		// the merged sources are told apart by their position, their urls hold credentials
+		if i > 0 {
+			err = fmt.Errorf("merged playlist %d: %w", i, err)
+		}
+		return m3u.Playlist{}, err
+	}
+
+	return mergePlaylists(playlists, config.PlaylistMergeDuplicates), nil
+}
+
+// mergePlaylists append the tracks of the playlists in their configured order. The index of a
+// track is its position in the merged playlist, the tracks of a playlist are numbered after the
+// ones of the playlists before it so that the indexes stay unique across the sources.
+// The tracks whose url is already in a previous playlist are left out with the drop handling,
+// the duplicates within a playlist are kept as they are.
+func mergePlaylists(playlists []m3u.Playlist, duplicates string) m3u.Playlist {
+	if len(playlists) == 1 {
+		return playlists[0]
+	}
+
+	var merged m3u.Playlist
+	previous := map[string]struct{}{}
+	for i, p := range playlists {
+		for _, track := range p.Tracks {
+			if _, ok := previous[track.URI]; ok && duplicates == mergeDuplicatesDrop {
+				logger.Debugf("merged playlist %d: %q is already in a previous playlist, dropped", i, track.Name)
+				continue
+			}
+			merged.Tracks = append(merged.Tracks, track)
+		}
+		for _, track := range p.Tracks {
+			previous[track.URI] = struct{}{}
+		}
+		merged.VariantStreams = append(merged.VariantStreams, p.VariantStreams...)
+	}
+
+	return merged
+}
+
+// fetchPlaylist download or open the m3u playlist and parse it,
+// the configured headers are sent when it is downloaded.
+// The download, body included, is bounded by the playlist fetch timeout when set.
+func fetchPlaylist(client *http.Client, config *config.ProxyConfig, source string) (m3u.Playlist, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return m3u.Parse(source)
+	}
+
+	ctx := context.Background()
+	if config.PlaylistFetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.PlaylistFetchTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return m3u.Playlist{}, err
+	}
+
+	for name, value := range config.PlaylistFetchHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(withRedirectHeaders(withUpstreamKind(req, upstreamKindPlaylist), config.PlaylistFetchHeaders))
+	if err != nil {
+		return m3u.Playlist{}, fmt.Errorf("unable to open playlist URL: %w", err)
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return m3u.Playlist{}, fmt.Errorf("unable to open playlist URL: %w: %s", errUpstreamAuth, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return m3u.Playlist{}, fmt.Errorf("unable to open playlist URL: unexpected status %s", resp.Status)
+	}
+
+	body := newMaxBytesReader(resp.Body, config.MaxSegmentBytes)
+	p, err := m3u.Decode(body)
+	// the decoder stops at the first read error, a truncated playlist isn't served
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return m3u.Playlist{}, fmt.Errorf("unable to read playlist: timed out after %s: %w", config.PlaylistFetchTimeout, ctx.Err())
+	}
+	if body.exceeded() {
+		return m3u.Playlist{}, fmt.Errorf("unable to read playlist: %w: more than %d bytes", errTooLarge, config.MaxSegmentBytes)
+	}
+
+	return p, err
+}
+
+// emptyPlaylist answer the configured status to the playlist request when the playlist has no track,
+// and report whether it did. With the default 200 the empty playlist is served.
+func (c *Config) emptyPlaylist(ctx *gin.Context) bool {
+	if c.EmptyPlaylistStatus == http.StatusOK || len(c.tracks()) > 0 {
+		return false
+	}
+
+	_ = ctx.AbortWithError(c.EmptyPlaylistStatus, errEmptyPlaylist) // nolint: errcheck
+	return true
+}
@@ -0,0 +1,153 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// playlistServer serve the playlists by path, each of the given number of channels.
+func playlistServer(channels map[string]int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, ok := channels[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var b strings.Builder
+		b.WriteString("#EXTM3U\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "#EXTINF:-1,%s %d\nhttp://upstream.tv%s/%d.ts\n", r.URL.Path, i, r.URL.Path, i)
+		}
+		_, _ = w.Write([]byte(b.String()))
+	}))
+}
+
+func TestFetchPlaylists(t *testing.T) {
+	upstream := playlistServer(map[string]int{"/first.m3u": 2, "/second.m3u": 3})
+	defer upstream.Close()
+
+	tests := []struct {
+		name    string
+		merged  []string
+		want    []string
+		wantErr string
+	}{
+		{name: "single playlist", want: []string{"/first.m3u 0", "/first.m3u 1"}},
+		{name: "merged playlist", merged: []string{upstream.URL + "/second.m3u"}, want: []string{
+			"/first.m3u 0", "/first.m3u 1", "/second.m3u 0", "/second.m3u 1", "/second.m3u 2",
+		}},
+		{name: "missing merged playlist", merged: []string{upstream.URL + "/second.m3u", upstream.URL + "/missing.m3u"}, wantErr: "merged playlist 2: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig()
+			c.RemoteURL, _ = url.Parse(upstream.URL + "/first.m3u")
+			c.PlaylistMergeSources = tt.merged
+
+			p, err := fetchPlaylists(upstreamClient, c.ProxyConfig)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("fetchPlaylists() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchPlaylists() error = %v", err)
+			}
+
+			var names []string
+			for _, track := range p.Tracks {
+				names = append(names, track.Name)
+			}
+			if got, want := strings.Join(names, ","), strings.Join(tt.want, ","); got != want {
+				t.Errorf("tracks = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestFetchPlaylistsConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+
+		// the first sources answer last
+		i, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".m3u"))
+		time.Sleep(time.Duration(8-i) * 5 * time.Millisecond)
+		fmt.Fprintf(w, "#EXTM3U\n#EXTINF:-1,Channel %d\nhttp://upstream.tv/%d.ts\n", i, i)
+	}))
+	defer upstream.Close()
+
+	for _, concurrency := range []int{0, 1, 3, 16} {
+		t.Run(strconv.Itoa(concurrency), func(t *testing.T) {
+			atomic.StoreInt32(&maxInFlight, 0)
+			c := newTestConfig()
+			c.RemoteURL, _ = url.Parse(upstream.URL + "/0.m3u")
+			c.PlaylistMergeSources = nil
+			for i := 1; i < 8; i++ {
+				c.PlaylistMergeSources = append(c.PlaylistMergeSources, fmt.Sprintf("%s/%d.m3u", upstream.URL, i))
+			}
+			c.PlaylistFetchConcurrency = concurrency
+
+			p, err := fetchPlaylists(upstreamClient, c.ProxyConfig)
+			if err != nil {
+				t.Fatalf("fetchPlaylists() error = %v", err)
+			}
+			for i, track := range p.Tracks {
+				if want := fmt.Sprintf("Channel %d", i); track.Name != want {
+					t.Fatalf("track %d = %q, want %q", i, track.Name, want)
+				}
+			}
+			if len(p.Tracks) != 8 {
+				t.Fatalf("merged %d tracks, want 8", len(p.Tracks))
+			}
+
+			want := int32(concurrency)
+			if want < 1 {
+				want = 1
+			}
+			if want > 8 {
+				want = 8
+			}
+			got := atomic.LoadInt32(&maxInFlight)
+			if got > want {
+				t.Errorf("%d playlists fetched concurrently, want at most %d", got, want)
+			}
+			if want > 1 && got < 2 {
+				t.Errorf("the playlists are fetched one after the other with a concurrency of %d", concurrency)
+			}
+		})
+	}
+}
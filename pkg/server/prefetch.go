@@ -0,0 +1,156 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// prefetchTTL is how long a prefetched segment is kept for its request, its download is bounded
+// by it too, the segment is dropped unrequested by then.
+const prefetchTTL = 30 * time.Second
+
+// prefetchedSegment is a segment downloaded ahead of its request.
+type prefetchedSegment struct {
+	call *segmentCall
+	time.Time
+}
+
+// prefetchedSegments are the prefetched segments, downloaded or in progress, by upstream url.
+var prefetchedSegments = map[string]prefetchedSegment{}
+var prefetchedSegmentsLock = sync.Mutex{}
+
+// prefetchSegments download in the background the segments following the requested one,
+// so that they are ready when the player requests them.
+func (c *Config) prefetchSegments(ctx *gin.Context, keys []string) {
+	if c.SegmentPrefetch <= 0 || ctx.Request.Method != http.MethodGet || ctx.GetHeader("Range") != "" {
+		return
+	}
+
+	for _, key := range keys {
+		res, ok := getHLSResource(key)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(res.url)
+		if err != nil {
+			continue
+		}
+		callKey := segmentCallKey(ctx, u)
+
+		prefetchedSegmentsLock.Lock()
+		for k, p := range prefetchedSegments {
+			if time.Since(p.Time) > prefetchTTL {
+				delete(prefetchedSegments, k)
+			}
+		}
+		if _, ok := prefetchedSegments[callKey]; ok {
+			prefetchedSegmentsLock.Unlock()
+			continue
+		}
+		call := &segmentCall{done: make(chan struct{})}
+		prefetchedSegments[callKey] = prefetchedSegment{call: call, Time: time.Now()}
+		prefetchedSegmentsLock.Unlock()
+
+		// the request is built here, the gin context must not be used after the handler returns.
+		// It is detached from the request of the player and takes no host slot.
+		reqCtx, cancel := context.WithTimeout(withSpeculative(context.Background()), prefetchTTL)
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			cancel()
+			call.err = err
+			close(call.done)
+			continue
+		}
+		req.Header.Set("User-Agent", ctx.Request.UserAgent())
+		c.setChannelHeaders(req.Header)
+
+		go c.prefetchSegment(withSelectedUpstream(ctx, req), call, cancel)
+	}
+}
+
+// prefetchSegment download the whole segment into the call, up to the size of the segments held in memory.
+func (c *Config) prefetchSegment(req *http.Request, call *segmentCall, cancel context.CancelFunc) {
+	defer close(call.done)
+	defer cancel()
+
+	resp, err := c.upstreamDo(upstreamClient, req)
+	if err != nil {
+		logger.Debugf("segment prefetch of %s failed: %v", req.URL, err)
+		call.err = err
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	call.body, call.err = io.ReadAll(io.LimitReader(resp.Body, maxCoalescedSegmentSize+1))
+	if call.err == nil && len(call.body) > maxCoalescedSegmentSize {
+		call.body = nil
+		call.err = fmt.Errorf("%s: segment larger than %d bytes", req.URL.Redacted(), maxCoalescedSegmentSize)
+		return
+	}
+	call.request = resp.Request
+	call.status = resp.StatusCode
+	call.header = resp.Header
+}
+
+// servePrefetched serve the segment when it was prefetched, waiting for its download in progress.
+// It returns false when the segment must be requested upstream.
+func (c *Config) servePrefetched(ctx *gin.Context, u *url.URL) bool {
+	if c.SegmentPrefetch <= 0 || ctx.Request.Method != http.MethodGet || ctx.GetHeader("Range") != "" {
+		return false
+	}
+
+	callKey := segmentCallKey(ctx, u)
+
+	prefetchedSegmentsLock.Lock()
+	p, ok := prefetchedSegments[callKey]
+	if ok {
+		delete(prefetchedSegments, callKey)
+	}
+	prefetchedSegmentsLock.Unlock()
+	if !ok || time.Since(p.Time) > prefetchTTL {
+		return false
+	}
+
+	select {
+	case <-p.call.done:
+	case <-ctx.Request.Context().Done():
+		return false
+	}
+
+	// a failed prefetch is retried by the request itself
+	if p.call.err != nil || p.call.status != http.StatusOK {
+		return false
+	}
+
+	c.streamSegmentResponse(ctx, p.call.response())
+
+	return true
+}
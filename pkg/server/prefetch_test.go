@@ -0,0 +1,146 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSpeculativeRequestsTakeNoHostSlot(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte("segment"))
+	}))
+	defer upstream.Close()
+	host := upstream.Listener.Addr().String()
+
+	configureHostLimit(1, nil)
+	defer configureHostLimit(0, nil)
+	slots := hostLimit(host)
+
+	c := newTestConfig()
+	speculative := func() *http.Request {
+		req, err := http.NewRequestWithContext(withSpeculative(context.Background()), http.MethodGet, upstream.URL+"/1.ts", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	// a free host: the request is sent without taking the slot of a player
+	resp, err := c.upstreamHostDo(upstreamClient, speculative())
+	if err != nil {
+		t.Fatalf("speculative request to a free host: %v", err)
+	}
+	if !slots.tryAcquire() {
+		t.Error("the speculative request in flight holds the host slot")
+	}
+	_ = resp.Body.Close()
+
+	// a busy host: the request is skipped at once, without waiting for the slot
+	_, err = c.upstreamHostDo(upstreamClient, speculative())
+	if !errors.Is(err, errHostBusy) {
+		t.Errorf("speculative request to a busy host error = %v, want %v", err, errHostBusy)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("sent %d requests upstream, want 1", n)
+	}
+	slots.release()
+}
+
+// roundTripFunc is an http.RoundTripper answering with a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestPrefetchSegments(t *testing.T) {
+	prefetched := make(chan *http.Request, 1)
+	proceed := make(chan struct{})
+	client := upstreamClient
+	upstreamClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		prefetched <- req
+		<-proceed
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("segment")), Request: req}, nil
+	})}
+	defer func() { upstreamClient = client }()
+
+	c := newTestConfig()
+	c.SegmentPrefetch = 1
+	key := registerHLSResource(hlsResource{url: "http://upstream.tv/live/2.ts"})
+	defer func() {
+		prefetchedSegmentsLock.Lock()
+		prefetchedSegments = map[string]prefetchedSegment{}
+		prefetchedSegmentsLock.Unlock()
+	}()
+
+	// the player request ends before the prefetch
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	reqCtx, cancel := context.WithCancel(context.Background())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/1.ts", nil).WithContext(reqCtx)
+	c.prefetchSegments(ctx, []string{key})
+	cancel()
+
+	var req *http.Request
+	select {
+	case req = <-prefetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the segment is not prefetched")
+	}
+	if _, ok := req.Context().Deadline(); !ok {
+		t.Error("the prefetch request has no deadline")
+	}
+	if req.Context().Err() != nil {
+		t.Error("the prefetch request ends with the player request")
+	}
+	if speculative, _ := req.Context().Value(speculativeKey{}).(bool); !speculative {
+		t.Error("the prefetch request is not speculative, it takes a host slot")
+	}
+	close(proceed)
+
+	u, _ := url.Parse("http://upstream.tv/live/2.ts")
+	prefetchedSegmentsLock.Lock()
+	p, ok := prefetchedSegments[segmentCallKey(ctx, u)]
+	prefetchedSegmentsLock.Unlock()
+	if !ok {
+		t.Fatal("the segment is not prefetched")
+	}
+	select {
+	case <-p.call.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the prefetch does not end")
+	}
+	if p.call.err != nil || string(p.call.body) != "segment" {
+		t.Errorf("prefetched %q, %v, want the segment", p.call.body, p.call.err)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// channelProbe is the availability and metadata of an upstream hls channel.
+type channelProbe struct {
+	hlsTime     string
+	hlsListSize string
+	// attributes of the best variant of a master playlist
+	resolution string
+	codecs     string
+	bandwidth  uint32
+	// the upstream playlist is a media playlist, closed by EXT-X-ENDLIST for a vod
+	media  bool
+	closed bool
+	err    error
+	time.Time
+}
+
+var channelProbes = map[string]channelProbe{}
+var channelProbesLock = sync.RWMutex{}
+
+// probeChannel fetch the upstream media playlist to read its metadata,
+// a result younger than the availability cache ttl is reused for the same url.
+func (c *Config) probeChannel(fullURL string) (channelProbe, error) {
+	return c.cachedChannelProbe(fullURL, c.AvailabilityCacheTTL)
+}
+
+// cachedChannelProbe fetch the upstream playlist to read its metadata,
+// a result younger than the ttl is reused for the same url.
+func (c *Config) cachedChannelProbe(fullURL string, ttl time.Duration) (channelProbe, error) {
+	channelProbesLock.RLock()
+	probe, ok := channelProbes[fullURL]
+	channelProbesLock.RUnlock()
+	if ok && time.Since(probe.Time) < ttl {
+		return probe, probe.err
+	}
+
+	probe = c.fetchChannelProbe(fullURL)
+
+	if ttl > 0 {
+		channelProbesLock.Lock()
+		for u, p := range channelProbes {
+			if time.Since(p.Time) >= ttl {
+				delete(channelProbes, u)
+			}
+		}
+		channelProbes[fullURL] = probe
+		channelProbesLock.Unlock()
+	}
+
+	return probe, probe.err
+}
+
+func (c *Config) fetchChannelProbe(fullURL string) channelProbe {
+	probe := channelProbe{Time: time.Now()}
+
+	req, err := http.NewRequest("GET", fullURL, nil)
+	if err != nil {
+		probe.err = err
+		return probe
+	}
+	c.setChannelHeaders(req.Header)
+
+	resp, err := c.upstreamDo(upstreamClient, req)
+	if err != nil {
+		probe.err = err
+		return probe
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		probe.err = fmt.Errorf("upstream playlist %s: unexpected status %s", fullURL, resp.Status)
+		return probe
+	}
+
+	p, listType, err := m3u8.DecodeFrom(bufio.NewReader(resp.Body), true)
+	if err != nil {
+		probe.err = err
+		return probe
+	}
+
+	if listType == m3u8.MASTER {
+		for _, variant := range p.(*m3u8.MasterPlaylist).Variants {
+			if variant != nil && !variant.Iframe && variant.Bandwidth >= probe.bandwidth {
+				probe.resolution = variant.Resolution
+				probe.codecs = variant.Codecs
+				probe.bandwidth = variant.Bandwidth
+			}
+		}
+	}
+
+	if listType == m3u8.MEDIA {
+		mediaList := p.(*m3u8.MediaPlaylist)
+		probe.media = true
+		probe.closed = mediaList.Closed || mediaList.MediaType == m3u8.VOD
+		probe.hlsTime = fmt.Sprintf("%.0f", mediaList.TargetDuration)
+		var count int
+		for _, segment := range mediaList.Segments {
+			if segment != nil {
+				count++
+			}
+		}
+		probe.hlsListSize = fmt.Sprintf("%d", count)
+	}
+
+	return probe
+}
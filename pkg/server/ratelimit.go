@@ -0,0 +1,148 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// errRateLimited is returned while backing off an upstream host which answered 429.
+var errRateLimited = errors.New("upstream rate limit, backing off")
+
+// maxRateLimitBackoff caps the growth of the backoff of a host rate limiting repeatedly,
+// and the Retry-After durations.
+const maxRateLimitBackoff = 5 * time.Minute
+
+var upstreamRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "iptv_proxy",
+	Name:      "upstream_rate_limited_total",
+	Help:      "Upstream responses asking to slow down (429, or 503 with a Retry-After), by host.",
+}, []string{"host"})
+
+var upstreamBackoffRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "iptv_proxy",
+	Name:      "upstream_backoff_rejected_total",
+	Help:      "Requests not sent upstream because the host is in a rate limit backoff, by host.",
+}, []string{"host"})
+
+type rateLimitBackoff struct {
+	until    time.Time
+	attempts int
+}
+
+var rateLimitBackoffs = map[string]*rateLimitBackoff{}
+var rateLimitBackoffsLock = sync.Mutex{}
+
+// checkRateLimit return an error while the host is in a rate limit backoff.
+func (c *Config) checkRateLimit(host string) error {
+	if c.UpstreamRateLimitBackoff <= 0 {
+		return nil
+	}
+
+	rateLimitBackoffsLock.Lock()
+	defer rateLimitBackoffsLock.Unlock()
+
+	b, ok := rateLimitBackoffs[host]
+	if !ok || !time.Now().Before(b.until) {
+		return nil
+	}
+	upstreamBackoffRejected.WithLabelValues(host).Inc()
+
+	return fmt.Errorf("%s: %w for %s", host, errRateLimited, time.Until(b.until).Round(time.Second))
+}
+
+// reportRateLimit start or extend the backoff of the host when the response asks to slow down,
+// for the Retry-After duration or else an exponential one, and end it on other responses.
+func (c *Config) reportRateLimit(host string, resp *http.Response) {
+	if c.UpstreamRateLimitBackoff <= 0 {
+		return
+	}
+
+	retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+	limited := resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusServiceUnavailable && hasRetryAfter)
+
+	rateLimitBackoffsLock.Lock()
+	defer rateLimitBackoffsLock.Unlock()
+
+	if !limited {
+		delete(rateLimitBackoffs, host)
+		return
+	}
+	upstreamRateLimited.WithLabelValues(host).Inc()
+
+	b, ok := rateLimitBackoffs[host]
+	if !ok {
+		b = &rateLimitBackoff{}
+		rateLimitBackoffs[host] = b
+	}
+	b.attempts++
+
+	delay := retryAfter
+	if !hasRetryAfter {
+		delay = c.UpstreamRateLimitBackoff << uint(b.attempts-1)
+		if delay > maxRateLimitBackoff || delay <= 0 {
+			delay = maxRateLimitBackoff
+		}
+	}
+	b.until = time.Now().Add(delay)
+
+	logger.Warnf("upstream %s answered %d, backing off for %s", host, resp.StatusCode, delay.Round(time.Second))
+}
+
+// parseRetryAfter parse the Retry-After header, in seconds or as an http date,
+// capped to the maximum backoff so that a host can't stop the requests for longer.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		// compared before the conversion, which overflows for the huge values
+		if seconds > int(maxRateLimitBackoff/time.Second) {
+			return maxRateLimitBackoff, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		if d > maxRateLimitBackoff {
+			d = maxRateLimitBackoff
+		}
+		return d, true
+	}
+
+	return 0, false
+}
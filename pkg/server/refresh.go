@@ -0,0 +1,269 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+type diffChannel struct {
+	Name  string `json:"name"`
+	TvgID string `json:"tvg_id,omitempty"`
+	URI   string `json:"uri"`
+}
+
+type renamedChannel struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	TvgID string `json:"tvg_id,omitempty"`
+	URI   string `json:"uri"`
+}
+
+// playlistDiff is the channels changes of the last playlist refresh.
+type playlistDiff struct {
+	RefreshedAt *time.Time       `json:"refreshed_at"`
+	Added       []diffChannel    `json:"added"`
+	Removed     []diffChannel    `json:"removed"`
+	Renamed     []renamedChannel `json:"renamed"`
+}
+
+var lastDiff = playlistDiff{Added: []diffChannel{}, Removed: []diffChannel{}, Renamed: []renamedChannel{}}
+var lastDiffLock = sync.RWMutex{}
+
+// playlistCheckedAt is when the playlist was last fetched from the remote url, successfully or not.
+var playlistCheckedAt time.Time
+
+// playlistRefreshedAt is when the playlist was last replaced.
+var playlistRefreshedAt time.Time
+var playlistCheckedAtLock = sync.Mutex{}
+
+// refreshing is set while a playlist refresh runs, so that a single one runs at a time.
+var refreshing int32
+
+// setPlaylistCheckedAt record when the playlist was fetched from the remote url.
+func setPlaylistCheckedAt(t time.Time) {
+	playlistCheckedAtLock.Lock()
+	defer playlistCheckedAtLock.Unlock()
+
+	playlistCheckedAt = t
+}
+
+// setPlaylistRefreshedAt record when the playlist was replaced.
+func setPlaylistRefreshedAt(t time.Time) {
+	playlistCheckedAtLock.Lock()
+	defer playlistCheckedAtLock.Unlock()
+
+	playlistRefreshedAt = t
+}
+
+// lastPlaylistRefresh return when the playlist was last replaced, zero before the first load.
+func lastPlaylistRefresh() time.Time {
+	playlistCheckedAtLock.Lock()
+	defer playlistCheckedAtLock.Unlock()
+
+	return playlistRefreshedAt
+}
+
+// revalidatePlaylist refresh the playlist in the background when it is older than the
+// stale-while-revalidate window, the current one is served meanwhile.
+func (c *Config) revalidatePlaylist() {
+	if c.StaleWhileRevalidate <= 0 || c.RemoteURL.String() == "" {
+		return
+	}
+
+	playlistCheckedAtLock.Lock()
+	stale := time.Since(playlistCheckedAt) >= c.StaleWhileRevalidate
+	if stale {
+		// the next requests don't trigger another refresh, even when this one fails
+		playlistCheckedAt = time.Now()
+	}
+	playlistCheckedAtLock.Unlock()
+
+	if stale {
+		go c.refreshPlaylistOnce("revalidation")
+	}
+}
+
+// refreshPlaylistOnce refresh the playlist unless a refresh is already running.
+func (c *Config) refreshPlaylistOnce(reason string) {
+	if !atomic.CompareAndSwapInt32(&refreshing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&refreshing, 0)
+
+	if err := c.refreshPlaylist(); err != nil {
+		logger.Warnf("playlist %s failed, the current playlist is kept: %s", reason, err)
+	}
+}
+
+// refreshLoop refresh the playlist from the remote url at the given interval.
+func (c *Config) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.refreshPlaylistOnce("refresh")
+		}
+	}
+}
+
+// fetchRefreshedPlaylist fetch the playlist for a refresh, the failures are retried
+// with an exponential backoff in case the provider has a hiccup.
+func (c *Config) fetchRefreshedPlaylist() (m3u.Playlist, error) {
+	delay := c.PlaylistRefreshRetryDelay
+	for attempt := 0; ; attempt++ {
+		p, err := fetchPlaylists(upstreamClient, c.ProxyConfig)
+		// an empty playlist is most likely an error page of the provider
+		if err == nil && len(p.Tracks) == 0 && len(c.tracks()) > 0 {
+			err = errEmptyPlaylist
+		}
+		if err == nil || attempt >= c.PlaylistRefreshRetries {
+			return p, err
+		}
+
+		logger.Warnf("playlist refresh failed, retrying in %s: %s", delay, err)
+		select {
+		case <-c.stop:
+			return p, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// refreshPlaylist fetch the playlist again, replace the proxyfied one
+// and keep the changes from the previous one.
+func (c *Config) refreshPlaylist() error {
+	setPlaylistCheckedAt(time.Now())
+	p, err := c.fetchRefreshedPlaylist()
+	if err != nil {
+		return err
+	}
+
+	// the playlist is filtered aside, the current one is served until it is replaced
+	refreshed := *c
+	refreshed.playlist = &p
+
+	tmpPath := c.proxyfiedM3UPath + ".tmp"
+	if c.PlaylistFileCache {
+		f, err := os.Create(tmpPath)
+		if err != nil {
+			return err
+		}
+		err = refreshed.marshallInto(f, false)
+		_ = f.Close()
+		if err != nil {
+			_ = os.Remove(tmpPath)
+			return err
+		}
+	} else {
+		refreshed.filterTracks(false)
+	}
+
+	previous := c.tracks()
+	playlistLock.Lock()
+	if c.PlaylistFileCache {
+		err = os.Rename(tmpPath, c.proxyfiedM3UPath)
+	}
+	if err == nil {
+		c.playlist.Tracks = p.Tracks
+		c.indexTracks(p.Tracks)
+	}
+	playlistLock.Unlock()
+	if err != nil {
+		return err
+	}
+	setPlaylistRefreshedAt(time.Now())
+
+	diff := diffTracks(previous, p.Tracks)
+	if len(diff.Added)+len(diff.Removed)+len(diff.Renamed) > 0 {
+		logger.Infof("playlist refreshed: %d channels, %d added, %d removed, %d renamed", len(p.Tracks), len(diff.Added), len(diff.Removed), len(diff.Renamed))
+	} else {
+		logger.Debugf("playlist refreshed: %d channels, no change", len(p.Tracks))
+	}
+
+	lastDiffLock.Lock()
+	lastDiff = diff
+	lastDiffLock.Unlock()
+
+	return nil
+}
+
+// diffKey identify a channel across the refreshes, by its tvg-id or its upstream url.
+func diffKey(track *m3u.Track) string {
+	if id := track.Tag("tvg-id"); id != "" {
+		return "tvg-id:" + id
+	}
+
+	return "uri:" + track.URI
+}
+
+func diffTracks(previous, current []m3u.Track) playlistDiff {
+	now := time.Now()
+	diff := playlistDiff{RefreshedAt: &now, Added: []diffChannel{}, Removed: []diffChannel{}, Renamed: []renamedChannel{}}
+
+	before := make(map[string]*m3u.Track, len(previous))
+	for i := range previous {
+		before[diffKey(&previous[i])] = &previous[i]
+	}
+
+	after := make(map[string]bool, len(current))
+	for i := range current {
+		track := &current[i]
+		key := diffKey(track)
+		after[key] = true
+
+		old, ok := before[key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, diffChannel{track.Name, track.Tag("tvg-id"), track.URI})
+		case old.Name != track.Name:
+			diff.Renamed = append(diff.Renamed, renamedChannel{old.Name, track.Name, track.Tag("tvg-id"), track.URI})
+		}
+	}
+
+	for i := range previous {
+		track := &previous[i]
+		if !after[diffKey(track)] {
+			diff.Removed = append(diff.Removed, diffChannel{track.Name, track.Tag("tvg-id"), track.URI})
+		}
+	}
+
+	return diff
+}
+
+// getDiff serve the channels changes of the last playlist refresh.
+func (c *Config) getDiff(ctx *gin.Context) {
+	lastDiffLock.RLock()
+	defer lastDiffLock.RUnlock()
+
+	ctx.JSON(http.StatusOK, lastDiff)
+}
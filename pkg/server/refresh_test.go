@@ -0,0 +1,89 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// TestRefreshConcurrentReads read the tracks while the playlist is refreshed,
+// it is meant to be run with the race detector: go test -race.
+func TestRefreshConcurrentReads(t *testing.T) {
+	var refreshes int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every refresh serves a playlist of another length
+		n := 10 + int(atomic.AddInt32(&refreshes, 1))%10
+		var b strings.Builder
+		b.WriteString("#EXTM3U\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "#EXTINF:-1 tvg-id=\"%d\",Channel %d\nhttp://upstream.tv/live/%d.ts\n", i, i, i)
+		}
+		_, _ = w.Write([]byte(b.String()))
+	}))
+	defer upstream.Close()
+
+	c := newTestConfig(m3u.Track{Name: "Channel", URI: "http://upstream.tv/live/0.ts"})
+	c.RemoteURL, _ = url.Parse(upstream.URL)
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for j, track := range c.tracks() {
+					// the playlist may have been refreshed in between, the index still maps to its channel
+					found, ok := c.trackByIndex(c.encodeTrackIndex(j, track.URI))
+					if ok && found.URI != track.URI {
+						t.Errorf("trackByIndex(%d) = %q, want %q", j, found.URI, track.URI)
+						return
+					}
+				}
+				serveTest(c, httptest.NewRequest(http.MethodGet, "/iptv.m3u?username=user&password=pass", nil))
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := c.refreshPlaylist(); err != nil {
+			t.Fatalf("refreshPlaylist() error = %v", err)
+		}
+	}
+	close(done)
+	readers.Wait()
+
+	if n := len(c.tracks()); n < 10 {
+		t.Errorf("got %d tracks after the refreshes, want the refreshed playlist", n)
+	}
+}
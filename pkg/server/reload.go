@@ -0,0 +1,98 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// activeRouter is the http.Handler serving the requests, replaced when the configuration is reloaded.
+var activeRouter atomic.Value
+
+// reloadLock serialize the configuration reloads.
+var reloadLock = sync.Mutex{}
+
+// reloadConfig read the configuration again, validate it and replace the served one with it,
+// the current configuration is kept when the new one is invalid. The listening address is not changed.
+func (c *Config) reloadConfig(ctx *gin.Context) {
+	if c.configLoader == nil {
+		_ = ctx.AbortWithError(http.StatusNotImplemented, errors.New("the configuration can't be reloaded")) // nolint: errcheck
+		return
+	}
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	select {
+	case <-c.stop:
+		_ = ctx.AbortWithError(http.StatusConflict, errors.New("the configuration was already reloaded")) // nolint: errcheck
+		return
+	default:
+	}
+
+	conf, err := c.configLoader()
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+
+	// the new configuration is validated and its playlist written aside,
+	// the served one is untouched until they are swapped
+	reloaded, err := NewServer(conf)
+	if err == nil {
+		err = reloaded.playlistInitialization()
+	}
+	if err != nil {
+		logger.Errorf("configuration reload rejected: %s", err)
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+	reloaded.configLoader = c.configLoader
+
+	if conf.HostConfig.Port != c.HostConfig.Port || conf.HostConfig.UnixSocket != c.HostConfig.UnixSocket {
+		logger.Warnf("the listening port and unix socket changes need a restart")
+	}
+
+	if level, err := logger.ParseLevel(conf.LogLevel); err == nil {
+		logger.SetLevel(level)
+	}
+
+	// the streams and upstream requests in flight keep their slots in the new limits
+	reloaded.configureGlobals()
+	activeRouter.Store(reloaded.engine)
+	close(c.stop)
+
+	reloaded.startPlaylistRefresh()
+	reloaded.startTimeshiftBuffers()
+	if reloaded.HDHomeRun && reloaded.MDNSEnabled {
+		go reloaded.advertiseMDNS()
+	}
+	if reloaded.XtreamBaseURL != "" && reloaded.XtreamExpiryWarning > 0 {
+		go reloaded.watchXtreamExpiry()
+	}
+
+	logger.Infof("configuration reloaded")
+	ctx.JSON(http.StatusOK, gin.H{"status": "reloaded"})
+}
@@ -0,0 +1,44 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+)
+
+func TestReloadOutOfMaxRequestDuration(t *testing.T) {
+	c := newTestConfig()
+	c.MaxRequestDuration = 10 * time.Millisecond
+	// the loader outlasts the maximum duration, the reload result is still answered
+	c.configLoader = func() (*config.ProxyConfig, error) {
+		time.Sleep(5 * c.MaxRequestDuration)
+		return nil, errors.New("invalid configuration")
+	}
+
+	w := serveTest(c, httptest.NewRequest(http.MethodPost, "/api/config/reload?username=user&password=pass", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /api/config/reload status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
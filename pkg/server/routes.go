@@ -20,14 +20,28 @@ package server
 
 import (
 	"fmt"
-	"path"
+	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+// readMethods are the methods of the playlist and stream routes, HEAD lets the players probe them.
+var readMethods = []string{http.MethodGet, http.MethodHead}
+
 func (c *Config) routes(r *gin.RouterGroup) {
 	r = r.Group(c.CustomEndpoint)
+	if len(c.namedUpstreams) > 0 {
+		r.Use(c.selectUpstream)
+	}
+	timed := c.timed(r)
+	if c.IndexPage {
+		timed.GET("/", c.getIndex)
+	}
+	// the maintenance api requires the credentials, the trusted clients included
+	timed.GET("/api/maintenance", c.authenticate, c.getMaintenance)
+	timed.POST("/api/maintenance", c.authenticate, c.postMaintenance)
+
 	//Xtream service endopoints
 	if c.ProxyConfig.XtreamBaseURL != "" {
 		c.xtreamRoutes(r)
@@ -35,16 +49,16 @@ func (c *Config) routes(r *gin.RouterGroup) {
 			c.XtreamUser.String() == c.RemoteURL.Query().Get("username") &&
 			c.XtreamPassword.String() == c.RemoteURL.Query().Get("password") {
 
-			r.GET("/"+c.M3UFileName, c.authenticate, c.xtreamGetAuto)
+			timed.Match(readMethods, "/"+c.M3UFileName, c.authenticate, c.xtreamGetAuto)
 
 			// XXX Private need: for external Android app
-			r.POST("/"+c.M3UFileName, c.authenticate, c.xtreamGetAuto)
+			timed.POST("/"+c.M3UFileName, c.authenticate, c.xtreamGetAuto)
 
 			return
 		}
 	}
 
-	r.GET("/hlsdownloads/:tsID/stream/:streamID", c.tsHandler)
+	c.streams(r).Match(readMethods, "/hlsdownloads/:tsID/stream/:streamID", c.tsHandler)
 	c.m3uRoutes(r)
 
 }
@@ -54,38 +68,73 @@ func (c *Config) xtreamRoutes(r *gin.RouterGroup) {
 	if c.XtreamGenerateApiGet {
 		getphp = c.xtreamApiGet
 	}
-	r.GET("/get.php", c.authenticate, getphp)
-	r.POST("/get.php", c.authenticate, getphp)
-	r.GET("/apiget", c.authenticate, c.xtreamApiGet)
-	r.GET("/player_api.php", c.authenticate, c.xtreamPlayerAPIGET)
-	r.POST("/player_api.php", c.appAuthenticate, c.xtreamPlayerAPIPOST)
-	r.GET("/xmltv.php", c.authenticate, c.xtreamXMLTV)
-	r.GET(fmt.Sprintf("/%s/%s/:id", c.User, c.Password), c.xtreamStreamHandler)
-	r.GET(fmt.Sprintf("/live/%s/%s/:id", c.User, c.Password), c.xtreamStreamLive)
-	r.GET(fmt.Sprintf("/timeshift/%s/%s/:duration/:start/:id", c.User, c.Password), c.xtreamStreamTimeshift)
-	r.GET(fmt.Sprintf("/movie/%s/%s/:id", c.User, c.Password), c.xtreamStreamMovie)
-	r.GET(fmt.Sprintf("/series/%s/%s/:id", c.User, c.Password), c.xtreamStreamSeries)
-	r.GET(fmt.Sprintf("/hlsr/:token/%s/%s/:channel/:hash/:chunk", c.User, c.Password), c.xtreamHlsrStream)
-	r.GET("/hls/:token/:chunk", c.xtreamHlsStream)
-	r.GET("/play/:token/:type", c.xtreamStreamPlay)
+	timed := c.timed(r)
+	streams := c.streams(r)
+	timed.GET("/get.php", c.authenticate, getphp)
+	timed.POST("/get.php", c.authenticate, getphp)
+	timed.GET("/apiget", c.authenticate, c.xtreamApiGet)
+	timed.GET("/player_api.php", c.authenticate, c.xtreamPlayerAPIGET)
+	timed.POST("/player_api.php", c.appAuthenticate, c.xtreamPlayerAPIPOST)
+	timed.GET("/xmltv.php", c.authenticate, c.xtreamXMLTV)
+	timed.GET("/api/xtream/account", c.authenticate, c.getXtreamAccount)
+	streams.Match(readMethods, fmt.Sprintf("/%s/%s/:id", c.User, c.Password), limitStreams, c.xtreamStreamHandler)
+	streams.Match(readMethods, fmt.Sprintf("/live/%s/%s/:id", c.User, c.Password), limitStreams, c.xtreamStreamLive)
+	streams.Match(readMethods, fmt.Sprintf("/timeshift/%s/%s/:duration/:start/:id", c.User, c.Password), limitStreams, c.xtreamStreamTimeshift)
+	streams.Match(readMethods, fmt.Sprintf("/movie/%s/%s/:id", c.User, c.Password), limitStreams, c.xtreamStreamMovie)
+	streams.Match(readMethods, fmt.Sprintf("/series/%s/%s/:id", c.User, c.Password), limitStreams, c.xtreamStreamSeries)
+	streams.Match(readMethods, fmt.Sprintf("/hlsr/:token/%s/%s/:channel/:hash/:chunk", c.User, c.Password), c.xtreamHlsrStream)
+	streams.Match(readMethods, "/hls/:token/:chunk", c.xtreamHlsStream)
+	streams.Match(readMethods, "/play/:token/:type", limitStreams, c.xtreamStreamPlay)
 }
 
 func (c *Config) m3uRoutes(r *gin.RouterGroup) {
-	r.GET("/"+c.M3UFileName, c.authenticate, c.getM3U)
+	timed := c.timed(r)
+	timed.Match(readMethods, "/"+c.M3UFileName, c.authenticatePlaylist, c.getM3U)
 	// XXX Private need: for external Android app
-	r.POST("/"+c.M3UFileName, c.authenticate, c.getM3U)
+	timed.POST("/"+c.M3UFileName, c.authenticatePlaylist, c.getM3U)
+	if c.M3UFileName != "playlist.m3u" {
+		timed.Match(readMethods, "/playlist.m3u", c.authenticatePlaylist, c.getM3UForHost)
+	}
+	timed.GET("/epg.xml", c.authenticatePlaylist, c.getEPG)
+	timed.GET("/groups", c.authenticatePlaylist, c.getGroups)
+	timed.Match(readMethods, "/group/*name", c.authenticatePlaylist, c.getGroupM3U)
+	if c.PlaylistChunkSize > 0 {
+		timed.GET("/playlists", c.authenticatePlaylist, c.getChunks)
+		timed.Match(readMethods, "/playlist/:chunk", c.authenticatePlaylist, c.getChunkM3U)
+	}
+	timed.GET("/userbouquet.tv", c.authenticate, c.getEnigma2Bouquet)
+	timed.GET("/api/channels", c.authenticate, c.getChannels)
+	timed.GET("/api/channels.csv", c.authenticate, c.getChannelsCSV)
+	timed.GET("/api/diff", c.authenticate, c.getDiff)
+	timed.GET("/api/export", c.authenticate, c.getExport)
+	// a reload cut by the maximum duration would be reported failed while it goes on
+	r.POST("/api/config/reload", c.authenticate, c.reloadConfig)
+	timed.GET("/api/channel/:index/test", c.authenticate, c.getChannelTest)
+	timed.POST("/api/channel/:index/disable", c.authenticate, c.postChannelDisable)
+	timed.POST("/api/channel/:index/enable", c.authenticate, c.postChannelEnable)
+	timed.Match(readMethods, "/master.m3u8", c.authenticate, c.getHLSMaster)
 
-	for i, track := range c.playlist.Tracks {
-		trackConfig := &Config{
-			ProxyConfig: c.ProxyConfig,
-			track:       &c.playlist.Tracks[i],
-		}
+	if c.HDHomeRun {
+		c.hdhomerunRoutes(timed)
+	}
 
-		if strings.HasSuffix(track.URI, ".m3u8") {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/:id", c.endpointAntiColision, c.User, c.Password, i), trackConfig.m3u8ReverseProxy)
-		} else {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/%s", c.endpointAntiColision, c.User, c.Password, i, path.Base(track.URI)), trackConfig.reverseProxy)
-		}
+	streams := c.streams(r)
+	streams.Match(readMethods, fmt.Sprintf("/%s/%s/%s/:index/:id", c.endpointAntiColision, c.User, c.Password), c.checkSignature, limitStreams, c.trackHandler)
+	streams.Match(readMethods, fmt.Sprintf("/%s/%s/%s/hls/:key", c.endpointAntiColision, c.User, c.Password), c.checkSignature, c.hlsResourceHandler)
+	streams.Match(readMethods, fmt.Sprintf("/%s/%s/%s/dash/:key/:signature/*path", c.endpointAntiColision, c.User, c.Password), c.checkSignature, c.dashResourceHandler)
+	if len(c.TimeshiftBufferByChannel) > 0 {
+		timed.GET("/api/timeshift", c.authenticate, c.getTimeshiftChannels)
+		streams.Match(readMethods, fmt.Sprintf("/%s/%s/%s/timeshift/:index/:file", c.endpointAntiColision, c.User, c.Password), c.checkSignature, c.timeshiftHandler)
+	}
+	r.Match(readMethods, fmt.Sprintf("/%s/%s/%s/logo/:index", c.endpointAntiColision, c.User, c.Password), c.logoHandler)
 
+	if len(c.trustedNetworks) > 0 {
+		streams.Match(readMethods, fmt.Sprintf("/%s/:index/:id", c.endpointAntiColision), c.checkSignature, limitStreams, c.trusted((*Config).trackHandler))
+		streams.Match(readMethods, fmt.Sprintf("/%s/hls/:key", c.endpointAntiColision), c.checkSignature, c.trusted((*Config).hlsResourceHandler))
+		streams.Match(readMethods, fmt.Sprintf("/%s/dash/:key/:signature/*path", c.endpointAntiColision), c.checkSignature, c.trusted((*Config).dashResourceHandler))
+		if len(c.TimeshiftBufferByChannel) > 0 {
+			streams.Match(readMethods, fmt.Sprintf("/%s/timeshift/:index/:file", c.endpointAntiColision), c.checkSignature, c.trusted((*Config).timeshiftHandler))
+		}
+		r.Match(readMethods, fmt.Sprintf("/%s/logo/:index", c.endpointAntiColision), c.trusted((*Config).logoHandler))
 	}
 }
@@ -0,0 +1,90 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var maxAgeRegexp = regexp.MustCompile(`(?:^|[\s,])max-age=(\d+)`)
+
+// segmentCacheControl return the Cache-Control of a segment of the content type,
+// the most specific content type prefix configured wins over the default.
+func (c *Config) segmentCacheControl(contentType string) string {
+	contentType = strings.ToLower(contentType)
+
+	value, matched := c.SegmentCacheControl, ""
+	for prefix, cacheControl := range c.SegmentCacheControlByType {
+		if strings.HasPrefix(contentType, strings.ToLower(prefix)) && len(prefix) > len(matched) {
+			value, matched = cacheControl, prefix
+		}
+	}
+
+	return value
+}
+
+// setSegmentCacheHeaders set the configured Cache-Control of the segment, and the matching Expires.
+func (c *Config) setSegmentCacheHeaders(ctx *gin.Context, contentType string) {
+	cacheControl := c.segmentCacheControl(contentType)
+	if cacheControl == "" {
+		return
+	}
+
+	ctx.Header("Cache-Control", cacheControl)
+
+	if m := maxAgeRegexp.FindStringSubmatch(cacheControl); m != nil {
+		if maxAge, err := strconv.Atoi(m[1]); err == nil {
+			ctx.Header("Expires", time.Now().Add(time.Duration(maxAge)*time.Second).UTC().Format(http.TimeFormat))
+		}
+	} else if strings.Contains(cacheControl, "no-cache") || strings.Contains(cacheControl, "no-store") {
+		ctx.Header("Expires", "0")
+	}
+}
+
+// streamSegment proxy the upstream segment with the configured cache headers.
+func (c *Config) streamSegment(ctx *gin.Context, u *url.URL) {
+	resp, err := c.segmentRequest(ctx, u)
+	if err != nil {
+		_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	c.streamSegmentResponse(ctx, resp)
+}
+
+// streamSegmentResponse relay the upstream segment response with the configured cache headers.
+func (c *Config) streamSegmentResponse(ctx *gin.Context, resp *http.Response) {
+	mergeHttpHeader(ctx.Writer.Header(), resp.Header)
+	c.forceContentType(ctx, resp)
+	if resp.StatusCode == http.StatusOK {
+		c.setSegmentCacheHeaders(ctx, resp.Header.Get("Content-Type"))
+	}
+	c.relayBody(ctx, resp)
+}
@@ -0,0 +1,63 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/sha1" // nolint: gosec
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// segmentNumberRegexp match the ffmpeg numbering of the segments in a file name template, e.g. %02d.
+var segmentNumberRegexp = regexp.MustCompile(`%0?\d*d`)
+
+// validateSegmentFilename check the template of the downloaded segments names, the segments are
+// served from a single directory level by the hlsdownloads route.
+func validateSegmentFilename(template string) error {
+	if !segmentNumberRegexp.MatchString(template) {
+		return fmt.Errorf("invalid segment filename %q: expected the segment number, e.g. %%02d", template)
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return fmt.Errorf("invalid segment filename %q: expected a file name without directory", template)
+	}
+
+	return nil
+}
+
+// segmentFilename return the ffmpeg segment file name of the channel from the template,
+// {index} is replaced by the channel index, {hash} by a hash of its upstream url
+// and {time} by the unix time the download started.
+func (c *Config) segmentFilename(index, upstreamURL string) string {
+	sum := sha1.Sum([]byte(upstreamURL)) // nolint: gosec
+
+	// a % in the values would be taken as a numbering by ffmpeg
+	escape := func(s string) string {
+		return strings.ReplaceAll(s, "%", "%%")
+	}
+
+	return strings.NewReplacer(
+		"{index}", escape(index),
+		"{hash}", hex.EncodeToString(sum[:4]),
+		"{time}", strconv.FormatInt(time.Now().Unix(), 10),
+	).Replace(c.SegmentFilename)
+}
@@ -0,0 +1,365 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grafov/m3u8"
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+const (
+	defaultSegmentStoreRegion = "us-east-1"
+	emptyPayloadHash          = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// segmentUploadWorkers is the number of concurrent segment uploads
+	segmentUploadWorkers = 4
+	// segmentUploadQueueSize is the number of segments waiting for an upload,
+	// the segments beyond are uploaded with a next playlist
+	segmentUploadQueueSize = 64
+)
+
+// segmentStore is the S3 compatible bucket the hlsdownloads segments are shared through,
+// so that the replicas of the proxy serve the segments downloaded by the others.
+// Only the segments are shared, the ffmpeg playlist is served by the replica running the
+// download, the others serve the segments it lists from the bucket.
+// The objects are addressed path-style and signed with AWS signature v4,
+// their expiry is left to the lifecycle rules of the bucket.
+type segmentStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// storedSegments is the modification time of the uploaded segments by object key,
+// a segment rewritten by a new ffmpeg process is uploaded again. The segments are
+// forgotten once they leave the ffmpeg playlist or their directory is removed.
+var storedSegments = map[string]time.Time{}
+var storedSegmentsLock = sync.Mutex{}
+
+// segmentUpload is a segment waiting for its upload to the store.
+type segmentUpload struct {
+	store    *segmentStore
+	key      string
+	filePath string
+}
+
+// segmentUploads is the queue of the upload workers, started with the first upload.
+var segmentUploads = make(chan segmentUpload, segmentUploadQueueSize)
+var segmentUploadWorkersOnce = sync.Once{}
+
+// newSegmentStore return the configured segment store, nil to keep the segments on the local disk only.
+func newSegmentStore(conf *config.ProxyConfig) (*segmentStore, error) {
+	if conf.SegmentStoreBucket == "" {
+		return nil, nil
+	}
+
+	// the segment keys only tell apart the downloads of the replicas by the segment names
+	if !strings.Contains(conf.SegmentFilename, "{hash}") || !strings.Contains(conf.SegmentFilename, "{time}") {
+		return nil, fmt.Errorf("invalid segment filename %q: expected {hash} and {time} with a segment store, the replicas would overwrite the segments of each other", conf.SegmentFilename)
+	}
+
+	endpoint, err := url.Parse(conf.SegmentStoreEndpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid segment store endpoint %q: expected an http(s) url", conf.SegmentStoreEndpoint)
+	}
+
+	region := conf.SegmentStoreRegion
+	if region == "" {
+		region = defaultSegmentStoreRegion
+	}
+
+	return &segmentStore{
+		endpoint:  endpoint,
+		bucket:    conf.SegmentStoreBucket,
+		region:    region,
+		accessKey: conf.SegmentStoreAccessKey.String(),
+		secretKey: conf.SegmentStoreSecretKey.String(),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// objectURL return the url of the object in the bucket.
+func (s *segmentStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + awsEscape(s.bucket) + "/" + awsEscapePath(key)
+	u.RawQuery = ""
+
+	return &u
+}
+
+// put upload the object.
+func (s *segmentStore) put(key string, body []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("segment store: put %s: %s", key, resp.Status)
+	}
+
+	return nil
+}
+
+// get download the object, nil when it isn't in the bucket.
+func (s *segmentStore) get(key string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("segment store: get %s: %s", key, resp.Status)
+}
+
+// sign add the AWS signature v4 of the request.
+func (s *segmentStore) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscapePath escape the segments of the object key as expected by the signature.
+func awsEscapePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = awsEscape(part)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// awsEscape percent-encode all but the unreserved characters.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || strings.IndexByte("-_.~", ch) >= 0 {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+
+	return b.String()
+}
+
+// segmentKey return the object key of a hlsdownloads file.
+func segmentKey(filePath string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filePath), "hlsdownloads/")
+}
+
+// storeSegments upload in the background the segments listed by the ffmpeg playlist,
+// complete once listed, that aren't in the bucket yet.
+func (c *Config) storeSegments(dirPath, playlistPath string) {
+	if c.segmentStore == nil {
+		return
+	}
+
+	file, err := os.Open(playlistPath)
+	if err != nil {
+		return
+	}
+	p, listType, err := m3u8.DecodeFrom(bufio.NewReader(file), true)
+	_ = file.Close()
+	if err != nil || listType != m3u8.MEDIA {
+		return
+	}
+
+	segmentUploadWorkersOnce.Do(startSegmentUploadWorkers)
+
+	listed := map[string]struct{}{}
+	for _, segment := range p.(*m3u8.MediaPlaylist).Segments {
+		if segment == nil {
+			continue
+		}
+
+		filePath := dirPath + "/" + segment.URI
+		info, err := os.Stat(filePath)
+		if err != nil {
+			continue
+		}
+
+		key := segmentKey(filePath)
+		listed[key] = struct{}{}
+		storedSegmentsLock.Lock()
+		stored, ok := storedSegments[key]
+		if ok && stored.Equal(info.ModTime()) {
+			storedSegmentsLock.Unlock()
+			continue
+		}
+		storedSegments[key] = info.ModTime()
+		storedSegmentsLock.Unlock()
+
+		select {
+		case segmentUploads <- segmentUpload{store: c.segmentStore, key: key, filePath: filePath}:
+		default:
+			logger.Debugf("segment store: upload queue full, %s is uploaded with a next playlist", key)
+			forgetStoredSegment(key)
+		}
+	}
+
+	// the segments deleted by ffmpeg as they leave its playlist
+	forgetStoredSegments(segmentKey(dirPath)+"/", listed)
+}
+
+// startSegmentUploadWorkers start the workers uploading the queued segments.
+func startSegmentUploadWorkers() {
+	for i := 0; i < segmentUploadWorkers; i++ {
+		go func() {
+			for upload := range segmentUploads {
+				upload.store.storeSegment(upload.key, upload.filePath)
+			}
+		}()
+	}
+}
+
+func (s *segmentStore) storeSegment(key, filePath string) {
+	body, err := os.ReadFile(filePath)
+	if err == nil {
+		err = s.put(key, body, hlsdownloadsContentType(filePath))
+	}
+	if err != nil {
+		logger.Warnf("segment store: %s", err)
+		// uploaded again with the next playlist
+		forgetStoredSegment(key)
+	}
+}
+
+// forgetStoredSegment forget the upload of the segment.
+func forgetStoredSegment(key string) {
+	storedSegmentsLock.Lock()
+	defer storedSegmentsLock.Unlock()
+
+	delete(storedSegments, key)
+}
+
+// forgetStoredSegments forget the uploads of the segments under the key prefix but the kept ones.
+func forgetStoredSegments(prefix string, keep map[string]struct{}) {
+	storedSegmentsLock.Lock()
+	defer storedSegmentsLock.Unlock()
+
+	for key := range storedSegments {
+		if _, ok := keep[key]; !ok && strings.HasPrefix(key, prefix) {
+			delete(storedSegments, key)
+		}
+	}
+}
+
+// serveStoredSegment serve a segment missing on the local disk from the bucket,
+// it return false when the segment isn't there either.
+func (c *Config) serveStoredSegment(ctx *gin.Context, filePath string) bool {
+	if c.segmentStore == nil {
+		return false
+	}
+
+	resp, err := c.segmentStore.get(segmentKey(filePath))
+	if err != nil {
+		logger.Warnf("%s", err)
+		return false
+	}
+	if resp == nil {
+		return false
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	contentType := hlsdownloadsContentType(filePath)
+	c.setSegmentCacheHeaders(ctx, contentType)
+	ctx.DataFromReader(http.StatusOK, resp.ContentLength, contentType, resp.Body, nil)
+
+	return true
+}
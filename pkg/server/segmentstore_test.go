@@ -0,0 +1,147 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+)
+
+func TestStoreSegmentsForgetsTheSegmentsLeavingThePlaylist(t *testing.T) {
+	var lock sync.Mutex
+	uploaded := map[string]bool{}
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		lock.Lock()
+		uploaded[r.URL.Path] = true
+		lock.Unlock()
+	}))
+	defer bucket.Close()
+	endpoint, _ := url.Parse(bucket.URL)
+
+	dir := t.TempDir()
+	for _, name := range []string{"data00.ts", "data01.ts", "data02.ts"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	playlist := filepath.Join(dir, "index.m3u8")
+	writePlaylist := func(segments ...string) {
+		content := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n"
+		for _, segment := range segments {
+			content += "#EXTINF:4.000000,\n" + segment + "\n"
+		}
+		if err := os.WriteFile(playlist, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Config{segmentStore: &segmentStore{endpoint: endpoint, bucket: "bucket", region: defaultSegmentStoreRegion, client: bucket.Client()}}
+	defer forgetStoredSegments(segmentKey(dir)+"/", nil)
+
+	writePlaylist("data00.ts", "data01.ts")
+	c.storeSegments(dir, playlist)
+	writePlaylist("data01.ts", "data02.ts")
+	c.storeSegments(dir, playlist)
+
+	storedSegmentsLock.Lock()
+	_, first := storedSegments[segmentKey(filepath.Join(dir, "data00.ts"))]
+	n := 0
+	for key := range storedSegments {
+		if filepath.Dir(key) == segmentKey(dir) {
+			n++
+		}
+	}
+	storedSegmentsLock.Unlock()
+	if first || n != 2 {
+		t.Errorf("stored segments of the directory = %d (data00.ts kept: %v), want the 2 listed", n, first)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		count := len(uploaded)
+		lock.Unlock()
+		if count == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("uploaded %d segments, want 3", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForgetStoredSegments(t *testing.T) {
+	storedSegmentsLock.Lock()
+	storedSegments["1/data00.ts"] = time.Now()
+	storedSegments["1/data01.ts"] = time.Now()
+	storedSegments["12/data00.ts"] = time.Now()
+	storedSegmentsLock.Unlock()
+	defer forgetStoredSegments("12/", nil)
+
+	forgetStoredSegments("1/", map[string]struct{}{"1/data01.ts": {}})
+
+	storedSegmentsLock.Lock()
+	defer storedSegmentsLock.Unlock()
+	if _, ok := storedSegments["1/data00.ts"]; ok {
+		t.Error("the segment left the playlist and is still stored")
+	}
+	if _, ok := storedSegments["1/data01.ts"]; !ok {
+		t.Error("the kept segment is forgotten")
+	}
+	if _, ok := storedSegments["12/data00.ts"]; !ok {
+		t.Error("the segment of another directory is forgotten")
+	}
+	delete(storedSegments, "1/data01.ts")
+}
+
+func TestNewSegmentStoreSegmentFilename(t *testing.T) {
+	tests := []struct {
+		bucket   string
+		template string
+		wantErr  bool
+	}{
+		{template: "data%02d.ts"},
+		{bucket: "segments", template: "data%02d.ts", wantErr: true},
+		{bucket: "segments", template: "data-{hash}-%02d.ts", wantErr: true},
+		{bucket: "segments", template: "data-{time}-%02d.ts", wantErr: true},
+		{bucket: "segments", template: "data-{hash}-{time}-%02d.ts"},
+	}
+
+	for _, tt := range tests {
+		_, err := newSegmentStore(&config.ProxyConfig{
+			SegmentStoreEndpoint: "http://minio:9000",
+			SegmentStoreBucket:   tt.bucket,
+			SegmentFilename:      tt.template,
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newSegmentStore() with the bucket %q and the segment filename %q error = %v, wantErr %v", tt.bucket, tt.template, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// upstreamHeader is the request header selecting a named upstream.
+const upstreamHeader = "X-Upstream"
+
+// selectedUpstreamKey is the gin and request context key of the selected upstream base url.
+type selectedUpstreamKey struct{}
+
+// parseNamedUpstreams parse the base urls of the named upstreams.
+func parseNamedUpstreams(upstreams map[string]string) (map[string]*url.URL, error) {
+	named := make(map[string]*url.URL, len(upstreams))
+	for name, upstream := range upstreams {
+		u, err := url.Parse(upstream)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid named upstream %s=%q: expected a base url", name, upstream)
+		}
+		named[name] = u
+	}
+
+	return named, nil
+}
+
+// selectUpstream honor the upstream selected by a trusted client with the X-Upstream header.
+func (c *Config) selectUpstream(ctx *gin.Context) {
+	name := ctx.GetHeader(upstreamHeader)
+	if name == "" || !c.isTrusted(ctx) {
+		return
+	}
+
+	base, ok := c.namedUpstreams[name]
+	if !ok {
+		_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("unknown upstream %q", name)) // nolint: errcheck
+		return
+	}
+
+	logger.Debugf("%s | upstream %s selected", ctx.ClientIP(), name)
+	ctx.Set(upstreamHeader, base)
+}
+
+// withSelectedUpstream carry the upstream selected by the client over to the upstream request.
+func withSelectedUpstream(ctx *gin.Context, req *http.Request) *http.Request {
+	base, ok := ctx.Get(upstreamHeader)
+	if !ok {
+		return req
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), selectedUpstreamKey{}, base))
+}
+
+// selectedUpstreamURL return the url on the selected upstream, the url itself without selection.
+func selectedUpstreamURL(req *http.Request) *url.URL {
+	base, ok := req.Context().Value(selectedUpstreamKey{}).(*url.URL)
+	if !ok {
+		return req.URL
+	}
+
+	selected := *req.URL
+	selected.Scheme = base.Scheme
+	selected.Host = base.Host
+
+	return &selected
+}
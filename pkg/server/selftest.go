@@ -0,0 +1,180 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// selfTestReadBytes is the amount of a stream read to consider it playing.
+const selfTestReadBytes = 64 * 1024
+
+type selfTestStep struct {
+	name     string
+	duration time.Duration
+	err      error
+}
+
+// selfTest fetch the proxyfied playlist, then the first channel and its first segment through
+// the proxy, log a pass/fail summary and exit with the result.
+func (c *Config) selfTest() {
+	client := &http.Client{Timeout: 30 * time.Second}
+	local := fmt.Sprintf("http://127.0.0.1:%d", c.HostConfig.Port)
+	if customEnd := strings.Trim(c.CustomEndpoint, "/"); customEnd != "" {
+		local += "/" + customEnd
+	}
+
+	// wait for the server to listen
+	for i := 0; i < 50; i++ {
+		if resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/ping", c.HostConfig.Port)); err == nil {
+			_ = resp.Body.Close()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var steps []selfTestStep
+	run := func(name string, f func() error) bool {
+		start := time.Now()
+		err := f()
+		steps = append(steps, selfTestStep{name, time.Since(start), err})
+		return err == nil
+	}
+
+	// the generated urls point at the advertised address, they are requested locally
+	localURL := func(u string) string {
+		return strings.Replace(u, c.baseURL(), local, 1)
+	}
+
+	var channelURL string
+	ok := run("playlist", func() error {
+		q := url.Values{"username": {c.User.String()}, "password": {c.Password.String()}}
+		body, err := selfTestGet(client, fmt.Sprintf("%s/%s?%s", local, c.M3UFileName, q.Encode()), -1)
+		if err != nil {
+			return err
+		}
+		channelURL = firstURI(body)
+		if channelURL == "" {
+			return fmt.Errorf("no channel in the playlist")
+		}
+		return nil
+	})
+
+	var segmentURL string
+	ok = ok && run("channel "+channelURL, func() error {
+		u := localURL(channelURL)
+		if !strings.Contains(u, ".m3u8") {
+			_, err := selfTestGet(client, u, selfTestReadBytes)
+			return err
+		}
+
+		body, err := selfTestGet(client, u, -1)
+		if err != nil {
+			return err
+		}
+		uri := firstURI(body)
+		if uri == "" {
+			return fmt.Errorf("no uri in the hls playlist")
+		}
+		base, _ := url.Parse(u)
+		ref, err := url.Parse(localURL(uri))
+		if err != nil {
+			return err
+		}
+		segmentURL = base.ResolveReference(ref).String()
+		return nil
+	})
+
+	if ok && segmentURL != "" {
+		run("segment "+segmentURL, func() error {
+			_, err := selfTestGet(client, segmentURL, selfTestReadBytes)
+			return err
+		})
+	}
+
+	passed := true
+	for _, step := range steps {
+		if step.err != nil {
+			passed = false
+			logger.Errorf("self-test: %s: FAIL (%s): %s", step.name, step.duration.Round(time.Microsecond), step.err)
+			continue
+		}
+		logger.Infof("self-test: %s: ok (%s)", step.name, step.duration.Round(time.Microsecond))
+	}
+
+	if !passed {
+		logger.Errorf("self-test: FAILED")
+		os.Exit(1)
+	}
+	logger.Infof("self-test: PASSED")
+	os.Exit(0)
+}
+
+// selfTestGet fetch the url and return up to limit bytes of the body, all of it when limit is negative.
+func selfTestGet(client *http.Client, u string, limit int64) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	if limit >= 0 {
+		body = io.LimitReader(resp.Body, limit)
+	}
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return b, nil
+}
+
+// firstURI return the first uri line of an m3u playlist.
+func firstURI(playlist []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+
+	return ""
+}
@@ -19,24 +19,41 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
 	"github.com/romaxa55/iptv-proxy/pkg/m3u"
 	uuid "github.com/satori/go.uuid"
-	"log"
+	"io"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var defaultProxyfiedM3UPath = filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
-var endpointAntiColision = "a6d7e846"
+var defaultEndpointAntiColision = "a6d7e846"
+
+// playlistLock guard the playlist tracks and their index against a concurrent update,
+// it is global as the Config is copied by the handlers.
+var playlistLock = sync.RWMutex{}
+
+// pathSegmentRegexp match the characters allowed in the custom endpoint and id, the url unreserved ones.
+var pathSegmentRegexp = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
 
 // Config represent the server configuration
 type Config struct {
@@ -50,100 +67,650 @@ type Config struct {
 	proxyfiedM3UPath string
 
 	endpointAntiColision string
+
+	// reverse lookup of the track indexes when they are hashed in the urls
+	trackKeys map[string]int
+
+	// upstream headers by tvg-id or channel name
+	upstreamHeaders map[string]map[string]string
+
+	// mirrors by upstream base url
+	upstreamMirrors map[string]*mirrorGroup
+
+	// base urls of the upstreams selectable with the X-Upstream header
+	namedUpstreams map[string]*url.URL
+
+	// networks whose clients don't need the credentials
+	trustedNetworks []*net.IPNet
+	// the urls are generated without the credentials for a trusted client
+	credentialless bool
+
+	// router of the api, built and checked with the configuration
+	engine *gin.Engine
+
+	// read the configuration again on a reload request
+	configLoader func() (*config.ProxyConfig, error)
+	// mpeg-ts segment served for the unknown channels
+	notFoundSegment []byte
+
+	// tvg-id by lowercased channel name
+	tvgIDs map[string]string
+
+	// stream urls dropped from the playlist
+	urlBlacklist *urlBlacklist
+
+	// EXTINF tags the tracks are filtered on, nil without
+	tagFilters *tagFilters
+
+	// networks the clients are allowed and denied from, nil without
+	clientFilter *clientFilter
+
+	// bucket the hlsdownloads segments are shared through, nil without
+	segmentStore *segmentStore
+
+	// upstream clients shared once the configuration is applied
+	clients *upstreamClients
+	// channels disabled before a restart, nil to keep the current ones
+	disabledChannels map[string]struct{}
+	// when the playlist was fetched from the remote url
+	playlistFetchedAt time.Time
+
+	// closed when the configuration is replaced by a reload
+	stop chan struct{}
 }
 
-// NewServer initialize a new server configuration
+// configureGlobals set up the upstream clients, the limits and the disabled channels shared by the handlers
+// from the configuration, it is validated by NewServer and the playlist is fetched beforehand.
+func (c *Config) configureGlobals() {
+	upstreamClient = c.clients.upstream
+	xtreamAPIClient = c.clients.xtreamAPI
+	configureStreamLimit(c.MaxConcurrentStreams)
+	configureHostLimit(c.UpstreamHostConcurrency, c.UpstreamHostConcurrencyByHost)
+	if c.disabledChannels != nil {
+		setDisabledChannels(c.disabledChannels)
+	}
+	if !c.playlistFetchedAt.IsZero() {
+		setPlaylistCheckedAt(c.playlistFetchedAt)
+		setPlaylistRefreshedAt(c.playlistFetchedAt)
+	}
+}
+
+// SetConfigLoader set the function reading the configuration again on a reload request.
+func (c *Config) SetConfigLoader(loader func() (*config.ProxyConfig, error)) {
+	c.configLoader = loader
+}
+
+// NewServer initialize a new server configuration, the shared upstream clients and limits
+// are set up from it when it is served.
 func NewServer(config *config.ProxyConfig) (*Config, error) {
+	upstreams, err := newUpstreamClients(config)
+	if err != nil {
+		return nil, err
+	}
+
 	var p m3u.Playlist
+	var fetchedAt time.Time
 	if config.RemoteURL.String() != "" {
-		var err error
-		p, err = m3u.Parse(config.RemoteURL.String())
+		p, err = fetchPlaylists(upstreams.upstream, config)
 		if err != nil {
 			return nil, err
 		}
+		fetchedAt = time.Now()
+
+		if len(p.Tracks) == 0 {
+			if config.FailOnEmptyPlaylist {
+				return nil, errEmptyPlaylist
+			}
+			logger.Warnf("%v, the proxyfied playlist is empty", errEmptyPlaylist)
+		}
+	}
+
+	if len(config.PlaylistMergeSources) > 0 && config.RemoteURL.String() == "" {
+		return nil, fmt.Errorf("invalid merged playlists: expected the m3u url they are merged with")
+	}
+
+	if config.PlaylistFetchConcurrency < 0 {
+		return nil, fmt.Errorf("invalid playlist fetch concurrency %d: expected 0 or more, 0 and 1 fetching the playlists one after the other", config.PlaylistFetchConcurrency)
+	}
+
+	if !validMergeDuplicates(config.PlaylistMergeDuplicates) {
+		return nil, fmt.Errorf("invalid merge duplicates handling %q: expected %q or %q", config.PlaylistMergeDuplicates, mergeDuplicatesKeep, mergeDuplicatesDrop)
+	}
+
+	if config.AdvertisedPort < 0 || config.AdvertisedPort > 65535 {
+		return nil, fmt.Errorf("invalid advertised port %d: expected a port between 0 and 65535, 0 leaving it out of the urls", config.AdvertisedPort)
+	}
+
+	if !validEnigma2ServiceType(config.Enigma2ServiceType) {
+		return nil, fmt.Errorf("invalid enigma2 service type %d: expected one of %v", config.Enigma2ServiceType, enigma2ServiceTypes)
+	}
+
+	if err := validateCustomPath("custom endpoint", config.CustomEndpoint, true); err != nil {
+		return nil, err
+	}
+
+	if err := validateCustomPath("custom id", config.CustomId, false); err != nil {
+		return nil, err
+	}
+
+	if !validIndexEncoding(config.URLIndexEncoding) {
+		return nil, fmt.Errorf("invalid url index encoding %q: expected %q, %q or %q", config.URLIndexEncoding, indexEncodingDecimal, indexEncodingBase62, indexEncodingHash)
+	}
+
+	if !validTrailingSlash(config.TrailingSlash) {
+		return nil, fmt.Errorf("invalid trailing slash behavior %q: expected %q, %q or %q", config.TrailingSlash, trailingSlashRedirect, trailingSlashStrict, trailingSlashBoth)
+	}
+
+	if !validDisposition(config.PlaylistDisposition) {
+		return nil, fmt.Errorf("invalid playlist disposition %q: expected %q or %q", config.PlaylistDisposition, dispositionAttachment, dispositionInline)
+	}
+
+	if config.EmptyPlaylistStatus < 200 || config.EmptyPlaylistStatus > 599 || http.StatusText(config.EmptyPlaylistStatus) == "" {
+		return nil, fmt.Errorf("invalid empty playlist status %d: expected an http status", config.EmptyPlaylistStatus)
+	}
+
+	if !validEndList(config.HLSEndList) {
+		return nil, fmt.Errorf("invalid hls endlist handling %q: expected %q, %q or %q", config.HLSEndList, endListAuto, endListKeep, endListStrip)
+	}
+
+	if err := validateSegmentFilename(config.SegmentFilename); err != nil {
+		return nil, err
+	}
+
+	if err := validateGroupRules(config.GroupNormalization); err != nil {
+		return nil, err
+	}
+
+	if err := validateTvgShifts(config.TvgShift, config.TvgShiftByGroup); err != nil {
+		return nil, err
+	}
+
+	upstreamHeaders, err := loadChannelHeaders(config.ChannelHeadersFile)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedNetworks, err := parseTrustedNetworks(config.TrustedNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamMirrors, err := loadUpstreamMirrors(config.UpstreamMirrorsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	namedUpstreams, err := parseNamedUpstreams(config.NamedUpstreams)
+	if err != nil {
+		return nil, err
 	}
 
+	notFoundSegment, err := loadNotFoundSegment(config.NotFoundSegment)
+	if err != nil {
+		return nil, err
+	}
+
+	tvgIDs, err := loadTvgIDMap(config.TvgIDMapFile, config.TvgIDMap)
+	if err != nil {
+		return nil, err
+	}
+
+	blacklist, err := compileURLBlacklist(config.URLBlacklist)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, err := compileTagFilters(config.TagFilters, config.TagExclude)
+	if err != nil {
+		return nil, err
+	}
+
+	clients, err := parseClientFilter(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseNetworks("trusted proxy", config.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	store, err := newSegmentStore(config)
+	if err != nil {
+		return nil, err
+	}
+
+	disabled, err := loadDisabledChannels(config.DisabledChannelsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointAntiColision := defaultEndpointAntiColision
 	if trimmedCustomId := strings.Trim(config.CustomId, "/"); trimmedCustomId != "" {
 		endpointAntiColision = trimmedCustomId
 	}
 
-	return &Config{
-		config,
-		&p,
-		nil,
-		defaultProxyfiedM3UPath,
-		endpointAntiColision,
-	}, nil
+	c := &Config{
+		ProxyConfig:          config,
+		playlist:             &p,
+		proxyfiedM3UPath:     defaultProxyfiedM3UPath,
+		endpointAntiColision: endpointAntiColision,
+		upstreamHeaders:      upstreamHeaders,
+		trustedNetworks:      trustedNetworks,
+		upstreamMirrors:      upstreamMirrors,
+		namedUpstreams:       namedUpstreams,
+		notFoundSegment:      notFoundSegment,
+		tvgIDs:               tvgIDs,
+		urlBlacklist:         blacklist,
+		tagFilters:           filters,
+		clientFilter:         clients,
+		segmentStore:         store,
+		clients:              upstreams,
+		disabledChannels:     disabled,
+		playlistFetchedAt:    fetchedAt,
+		stop:                 make(chan struct{}),
+	}
+
+	if c.engine, err = c.checkedRouter(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// validateCustomPath check a custom path can be used as is in the routes and urls.
+func validateCustomPath(name, value string, multiSegments bool) error {
+	trimmed := strings.Trim(value, "/")
+	if trimmed == "" {
+		return nil
+	}
+
+	if strings.Contains(trimmed, "://") {
+		return fmt.Errorf("invalid %s %q: expected a path, not an url", name, value)
+	}
+
+	segments := []string{trimmed}
+	if multiSegments {
+		segments = strings.Split(trimmed, "/")
+	}
+
+	for _, segment := range segments {
+		if segment == "." || segment == ".." || !pathSegmentRegexp.MatchString(segment) {
+			if multiSegments {
+				return fmt.Errorf("invalid %s %q: only letters, digits, '-', '.', '_' and '~' are allowed in each '/' separated part", name, value)
+			}
+			return fmt.Errorf("invalid %s %q: only letters, digits, '-', '.', '_' and '~' are allowed", name, value)
+		}
+	}
+
+	return nil
 }
 
 // Serve the iptv-proxy api
 func (c *Config) Serve() error {
+	c.configureGlobals()
 	if err := c.playlistInitialization(); err != nil {
 		return err
 	}
 
-	router := gin.Default()
+	c.startPlaylistRefresh()
+	c.startTimeshiftBuffers()
+	if c.HDHomeRun && c.MDNSEnabled {
+		go c.advertiseMDNS()
+	}
+	if c.XtreamBaseURL != "" && c.XtreamExpiryWarning > 0 {
+		go c.watchXtreamExpiry()
+	}
+
+	activeRouter.Store(c.engine)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeRouter.Load().(http.Handler).ServeHTTP(w, r)
+	})
+
+	if c.HostConfig.UnixSocket != "" {
+		if c.SelfTest {
+			return errors.New("the self-test is not supported on a unix socket")
+		}
+		return c.serveUnix(handler)
+	}
+
+	if c.SelfTest {
+		go c.selfTest()
+	}
+
+	addr := fmt.Sprintf(":%d", c.HostConfig.Port)
+	logger.Infof("listening and serving HTTP on %s", addr)
+	return http.ListenAndServe(addr, handler)
+}
+
+// checkedRouter return the router of the api, or an error when a route collides with another
+// one, gin panics on the collisions. The m3u file name and the custom id are used as is in the routes.
+func (c *Config) checkedRouter() (router *gin.Engine, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid m3u file name %q or custom id %q, a route collides with another one: %v", c.M3UFileName, c.CustomId, r)
+		}
+	}()
+
+	return c.router(), nil
+}
+
+// router return the router of the api.
+func (c *Config) router() *gin.Engine {
+	// the probes are too frequent to be logged, the favicon requests are browsers noise
+	skipPaths := []string{"/ping"}
+	if c.Favicon {
+		skipPaths = append(skipPaths, "/favicon.ico")
+	}
+
+	router := gin.New()
+	// the client address is read from the forwarded headers of the trusted proxies only,
+	// gin trusts any proxy by default
+	if len(c.TrustedProxies) > 0 {
+		if err := router.SetTrustedProxies(c.TrustedProxies); err != nil {
+			logger.Errorf("trusted proxies: %s", err)
+		}
+	}
+	// the routes answer 405 to the methods they don't support
+	router.HandleMethodNotAllowed = true
+	c.configureTrailingSlash(router)
+	// the requests are logged at the info level
+	if logger.Enabled(logger.LevelInfo) {
+		router.Use(gin.LoggerWithConfig(gin.LoggerConfig{SkipPaths: skipPaths, Output: logger.Writer()}))
+	}
+	router.Use(gin.RecoveryWithWriter(logger.Writer()))
+	if c.clientFilter != nil {
+		router.Use(c.filterClients)
+	}
 	router.Use(cors.Default())
+	router.GET("/ping", ping)
+	if c.Metrics {
+		router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	}
+	if c.Favicon {
+		router.GET("/favicon.ico", ping)
+	}
 	group := router.Group("/")
 	c.routes(group)
 
-	return router.Run(fmt.Sprintf(":%d", c.HostConfig.Port))
+	return router
 }
 
+// serveUnix serve the api on the unix socket and remove the socket file on shutdown.
+func (c *Config) serveUnix(handler http.Handler) error {
+	// remove the socket left by a previous run
+	if err := os.Remove(c.HostConfig.UnixSocket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", c.HostConfig.UnixSocket)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: handler}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Infof("shutting down unix socket %s", c.HostConfig.UnixSocket)
+		_ = srv.Close() // nolint: errcheck
+	}()
+
+	logger.Infof("listening and serving HTTP on unix socket %s", c.HostConfig.UnixSocket)
+	err = srv.Serve(listener)
+	_ = os.Remove(c.HostConfig.UnixSocket)
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// playlistInitialization filter the playlist and write the proxyfied file, into a temporary file
+// renamed over the served one so that it is never served half written.
 func (c *Config) playlistInitialization() error {
-	if len(c.playlist.Tracks) == 0 {
+	if len(c.tracks()) == 0 {
 		return nil
 	}
 
-	f, err := os.Create(c.proxyfiedM3UPath)
+	if !c.PlaylistFileCache {
+		c.filterTracks(false)
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(c.proxyfiedM3UPath), filepath.Base(c.proxyfiedM3UPath)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer func(f *os.File) {
-		_ = f.Close()
-	}(f)
+	err = c.marshallInto(f, false)
+	_ = f.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	playlistLock.Lock()
+	defer playlistLock.Unlock()
+
+	return os.Rename(f.Name(), c.proxyfiedM3UPath)
+}
+
+// tracks return the current playlist tracks, the returned slice must not be modified.
+func (c *Config) tracks() []m3u.Track {
+	playlistLock.RLock()
+	defer playlistLock.RUnlock()
+
+	return c.playlist.Tracks
+}
 
-	return c.marshallInto(f, false)
+// setTracks replace the playlist tracks and their index.
+func (c *Config) setTracks(tracks []m3u.Track) {
+	playlistLock.Lock()
+	defer playlistLock.Unlock()
+
+	c.playlist.Tracks = tracks
+	c.indexTracks(tracks)
 }
 
-// MarshallInto a *bufio.Writer a Playlist.
+// MarshallInto filter the playlist tracks and write them proxyfied into the file.
 func (c *Config) marshallInto(into *os.File, xtream bool) error {
-	filteredTrack := make([]m3u.Track, 0, len(c.playlist.Tracks))
-	ret := 0
-	_, _ = into.WriteString("#EXTM3U\n") // nolint: errcheck
+	filteredTrack := c.filterTracks(xtream)
+
+	if err := c.writeTracks(into, filteredTrack, xtream, nil); err != nil {
+		return err
+	}
+
+	return into.Sync()
+}
+
+// filterTracks replace the playlist tracks by the ones kept, normalized,
+// and report the skipped ones.
+func (c *Config) filterTracks(xtream bool) []m3u.Track {
+	tracks := c.tracks()
+	filteredTrack := make([]m3u.Track, 0, len(tracks))
+	var skipped []skippedTrack
 	re := regexp.MustCompile(`FHD|\+|orig| 4K`)
 
-	for i, track := range c.playlist.Tracks {
+	// the tracks are checked concurrently, their order is kept by collecting the results by index
+	rejected := make([]*skippedTrack, len(tracks))
+	c.forEachTrack(len(tracks), func(i int) {
+		track := &tracks[i]
 		if re.MatchString(track.Name) {
-			ret++
+			rejected[i] = &skippedTrack{Name: track.Name, URI: track.URI, Reason: skipReasonRegex}
+			return
+		}
+
+		if strings.TrimSpace(track.URI) == "" {
+			rejected[i] = &skippedTrack{Name: track.Name, Reason: skipReasonEmptyURI}
+			return
+		}
+
+		if c.urlBlacklist.matches(track.URI) {
+			rejected[i] = &skippedTrack{Name: track.Name, URI: track.URI, Reason: skipReasonURLBlacklist}
+			return
+		}
+
+		if !c.tagFilters.keep(track) {
+			rejected[i] = &skippedTrack{Name: track.Name, URI: track.URI, Reason: skipReasonTagFilter}
+			return
+		}
+
+		if _, err := c.replaceURL(track.URI, i, xtream); err != nil {
+			logger.Errorf("track: %s: %s", track.Name, err)
+			rejected[i] = &skippedTrack{Name: track.Name, URI: track.URI, Reason: skipReasonParseError, Error: err.Error()}
+		}
+	})
+
+	for i, track := range tracks {
+		if rejected[i] != nil {
+			skipped = append(skipped, *rejected[i])
 			continue
 		}
+		filteredTrack = append(filteredTrack, c.shiftTvg(c.normalizeGroup(c.mapTvgID(track))))
+	}
+	c.setTracks(filteredTrack)
+
+	if err := c.writeSkippedTracks(skipped); err != nil {
+		logger.Errorf("skipped tracks report: %s", err)
+	}
+
+	return filteredTrack
+}
+
+// writeTracks write the tracks as a proxyfied m3u playlist.
+// Tracks rejected by keep are not written but they still hold their index,
+// so the urls are the same whatever the subset of tracks written.
+func (c *Config) writeTracks(into io.Writer, tracks []m3u.Track, xtream bool, keep func(*m3u.Track) bool) error {
+	// the entries are built concurrently and written in the tracks order
+	entries := make([]string, len(tracks))
+	c.forEachTrack(len(tracks), func(i int) {
+		track := &tracks[i]
+		if keep != nil && !keep(track) {
+			return
+		}
+		if isChannelDisabled(track) {
+			return
+		}
+
+		uri, err := c.trackURL(track, i, xtream)
+		if err != nil {
+			logger.Errorf("track: %s: %s", track.Name, err)
+			return
+		}
+
 		var buffer bytes.Buffer
 
-		buffer.WriteString("#EXTINF:")                       // nolint: errcheck
-		buffer.WriteString(fmt.Sprintf("%d ", track.Length)) // nolint: errcheck
+		// Write the widely accepted form: #EXTINF:-1 tvg-id="..." group-title="...",Name
+		buffer.WriteString("#EXTINF:")                      // nolint: errcheck
+		buffer.WriteString(fmt.Sprintf("%d", track.Length)) // nolint: errcheck
 
-		for i := range track.Tags {
-			if i == len(track.Tags)-1 {
-				buffer.WriteString(fmt.Sprintf("%s=%q", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
-				continue
+		if track.Tag("tvg-id") == "" && !xtream {
+			if id := c.channelID(track); id != "" {
+				buffer.WriteString(fmt.Sprintf(" tvg-id=%q", id)) // nolint: errcheck
+			}
+		}
+		for j := range track.Tags {
+			value := track.Tags[j].Value
+			if !xtream && strings.EqualFold(track.Tags[j].Name, "tvg-logo") {
+				value = c.logoURL(track, i)
 			}
-			buffer.WriteString(fmt.Sprintf("%s=%q ", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
+			buffer.WriteString(fmt.Sprintf(" %s=%q", track.Tags[j].Name, value)) // nolint: errcheck
 		}
 
-		uri, err := c.replaceURL(track.URI, i-ret, xtream)
-		if err != nil {
-			ret++
-			log.Printf("ERROR: track: %s: %s", track.Name, err)
-			continue
+		buffer.WriteString(fmt.Sprintf(",%s\n", c.displayName(track))) // nolint: errcheck
+		if track.Group != "" {
+			buffer.WriteString(fmt.Sprintf("%s\n", track.Group)) // nolint: errcheck
+		}
+		for _, option := range track.Options {
+			buffer.WriteString(fmt.Sprintf("%s\n", option)) // nolint: errcheck
 		}
-		_, _ = into.WriteString(fmt.Sprintf("%s, %s\n%s\n%s\n", buffer.String(), track.Name, track.Group, uri)) // nolint: errcheck
 
-		filteredTrack = append(filteredTrack, track)
+		entries[i] = fmt.Sprintf("%s%s\n", buffer.String(), uri)
+	})
+
+	w := bufio.NewWriter(into)
+	if c.KodiPVR && !xtream {
+		_, _ = w.WriteString(fmt.Sprintf("#EXTM3U x-tvg-url=%q\n", c.tvgURL())) // nolint: errcheck
+	} else {
+		_, _ = w.WriteString("#EXTM3U\n") // nolint: errcheck
+	}
+	for _, entry := range entries {
+		_, _ = w.WriteString(entry) // nolint: errcheck
 	}
-	c.playlist.Tracks = filteredTrack
 
-	return into.Sync()
+	return w.Flush()
+}
+
+// displayName return the name of the track in the generated playlists, formatted with its group
+// by the channel name format for the players ignoring the groups.
+func (c *Config) displayName(track *m3u.Track) string {
+	group := trackGroup(track)
+	if c.ChannelNameFormat == "" || group == "" {
+		return track.Name
+	}
+
+	return strings.NewReplacer("{group}", group, "{name}", track.Name).Replace(c.ChannelNameFormat)
+}
+
+// forEachTrack call f with each index below n, on the configured number of playlist workers.
+func (c *Config) forEachTrack(n int, f func(i int)) {
+	workers := c.PlaylistWorkers
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				f(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// trackURL return the url of the track in the generated playlists,
+// the direct play tracks keep their upstream url.
+func (c *Config) trackURL(track *m3u.Track, trackIndex int, xtream bool) (string, error) {
+	if c.isDirectPlay(track) {
+		return track.URI, nil
+	}
+
+	return c.replaceURL(track.URI, trackIndex, xtream)
+}
+
+// isDirectPlay report whether the track is configured to be played directly.
+func (c *Config) isDirectPlay(track *m3u.Track) bool {
+	return trackMatches(track, c.DirectPlay)
+}
+
+// trackMatches report whether the track group, name or tvg-id is one of the names.
+func trackMatches(track *m3u.Track, names []string) bool {
+	for _, name := range names {
+		if strings.EqualFold(name, trackGroup(track)) ||
+			strings.EqualFold(name, track.Name) ||
+			strings.EqualFold(name, track.Tag("tvg-id")) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // ReplaceURL replace original playlist url by proxy url
@@ -153,43 +720,51 @@ func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, er
 		return "", err
 	}
 
-	protocol := "http"
-	if c.HTTPS {
-		protocol = "https"
-	}
-
-	customEnd := strings.Trim(c.CustomEndpoint, "/")
-	if customEnd != "" {
-		customEnd = fmt.Sprintf("/%s", customEnd)
-	}
-
 	uriPath := oriURL.EscapedPath()
 	if xtream {
 		uriPath = strings.ReplaceAll(uriPath, c.XtreamUser.PathEscape(), c.User.PathEscape())
 		uriPath = strings.ReplaceAll(uriPath, c.XtreamPassword.PathEscape(), c.Password.PathEscape())
 	} else {
-		uriPath = path.Join("/", c.endpointAntiColision, c.User.PathEscape(), c.Password.PathEscape(), fmt.Sprintf("%d", trackIndex), path.Base(uriPath))
-	}
-
-	basicAuth := oriURL.User.String()
-	if basicAuth != "" {
-		basicAuth += "@"
+		uriPath = path.Join(c.proxyPath(), c.encodeTrackIndex(trackIndex, uri), path.Base(uriPath))
 	}
 
-	newURI := fmt.Sprintf(
-		"%s://%s%s:%d%s%s",
-		protocol,
-		basicAuth,
-		c.HostConfig.Hostname,
-		c.AdvertisedPort,
-		customEnd,
-		uriPath,
-	)
-
-	newURL, err := url.Parse(newURI)
+	newURL, err := url.Parse(c.baseURL() + uriPath)
 	if err != nil {
 		return "", err
 	}
+	newURL.User = oriURL.User
+
+	// the xtream urls are served by the xtream routes, they are not signed
+	if !xtream {
+		c.signURL(newURL)
+	}
 
 	return newURL.String(), nil
 }
+
+// baseURL return the advertised url of the proxy, custom endpoint included.
+// The port is left out when the advertised port is 0 or the default one of the scheme.
+func (c *Config) baseURL() string {
+	protocol := "http"
+	defaultPort := 80
+	if c.HTTPS {
+		protocol = "https"
+		defaultPort = 443
+	}
+
+	host := c.HostConfig.Hostname
+	if c.AdvertisedPort != 0 && c.AdvertisedPort != defaultPort {
+		host = fmt.Sprintf("%s:%d", host, c.AdvertisedPort)
+	}
+
+	return fmt.Sprintf("%s://%s%s", protocol, host, c.endpointPath(""))
+}
+
+// endpointPath return the path of the route on the proxy, custom endpoint included.
+func (c *Config) endpointPath(route string) string {
+	if customEnd := strings.Trim(c.CustomEndpoint, "/"); customEnd != "" {
+		return "/" + customEnd + route
+	}
+
+	return route
+}
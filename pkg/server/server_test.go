@@ -0,0 +1,177 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// extinfRegExp matches the widely accepted form of the #EXTINF lines: #EXTINF:-1 tvg-id="..." group-title="...",Name
+var extinfRegExp = regexp.MustCompile(`^#EXTINF:-?\d+( [a-zA-Z0-9-]+="[^"]*")*,[^ ].*$`)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestConfig return a server configuration serving the tracks on http://proxy.local:8080
+// with the user:pass credentials.
+func newTestConfig(tracks ...m3u.Track) *Config {
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{
+			HostConfig:          &config.HostConfiguration{Hostname: "proxy.local", Port: 8080},
+			AdvertisedPort:      8080,
+			M3UFileName:         "iptv.m3u",
+			User:                "user",
+			Password:            "pass",
+			PlaylistDisposition: dispositionAttachment,
+			EmptyPlaylistStatus: http.StatusOK,
+		},
+		playlist:             &m3u.Playlist{},
+		endpointAntiColision: defaultEndpointAntiColision,
+		stop:                 make(chan struct{}),
+	}
+	c.setTracks(tracks)
+
+	return c
+}
+
+// serveTest serve the request with the router of the configuration.
+func serveTest(c *Config, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.router().ServeHTTP(w, req)
+
+	return w
+}
+
+func TestWriteTracksEXTINF(t *testing.T) {
+	c := newTestConfig(
+		m3u.Track{Name: "One", Length: -1, URI: "http://upstream.tv/1.ts"},
+		m3u.Track{Name: "Two", Length: -1, URI: "http://upstream.tv/2.ts", Tags: []m3u.Tag{
+			{Name: "tvg-id", Value: "two"},
+			{Name: "group-title", Value: "News"},
+		}},
+	)
+
+	var b bytes.Buffer
+	if err := c.writeTracks(&b, c.tracks(), false, nil); err != nil {
+		t.Fatalf("writeTracks() error = %v", err)
+	}
+
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, "#EXTINF") && !extinfRegExp.MatchString(line) {
+			t.Errorf("writeTracks() #EXTINF line %q is not in the widely accepted form", line)
+		}
+	}
+
+	// the proxyfied playlist is read back by the parser with the names and tags of the tracks
+	p, err := m3u.Decode(&b)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(p.Tracks) != 2 {
+		t.Fatalf("Decode() got %d tracks, want 2", len(p.Tracks))
+	}
+	if p.Tracks[0].Name != "One" {
+		t.Errorf("first track name = %q, want %q", p.Tracks[0].Name, "One")
+	}
+	second := p.Tracks[1]
+	if second.Name != "Two" || second.Tag("tvg-id") != "two" || second.Tag("group-title") != "News" {
+		t.Errorf("second track = %+v", second)
+	}
+	if !strings.HasPrefix(second.URI, "http://proxy.local:8080/") {
+		t.Errorf("second track uri = %q, want a proxyfied url", second.URI)
+	}
+}
+
+func TestCheckedRouter(t *testing.T) {
+	tests := []struct {
+		m3uFileName string
+		wantErr     bool
+	}{
+		{m3uFileName: "iptv.m3u"},
+		{m3uFileName: "playlist.m3u"},
+		{m3uFileName: "ping", wantErr: true},
+		{m3uFileName: "groups", wantErr: true},
+		{m3uFileName: "epg.xml", wantErr: true},
+		{m3uFileName: "master.m3u8", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		c := newTestConfig()
+		c.M3UFileName = tt.m3uFileName
+
+		router, err := c.checkedRouter()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkedRouter() with the m3u file name %q error = %v, wantErr %v", tt.m3uFileName, err, tt.wantErr)
+		}
+		if err == nil && router == nil {
+			t.Errorf("checkedRouter() with the m3u file name %q returned no router", tt.m3uFileName)
+		}
+	}
+}
+
+func TestNewServerAdvertisedPort(t *testing.T) {
+	tests := []struct {
+		port    int
+		https   bool
+		want    string
+		wantErr bool
+	}{
+		{port: -1, wantErr: true},
+		{port: 65536, wantErr: true},
+		{port: 0, want: "http://proxy.local"},
+		{port: 0, https: true, want: "https://proxy.local"},
+		{port: 80, want: "http://proxy.local"},
+		{port: 443, https: true, want: "https://proxy.local"},
+		{port: 443, want: "http://proxy.local:443"},
+		{port: 8080, want: "http://proxy.local:8080"},
+	}
+
+	for _, tt := range tests {
+		_, err := NewServer(&config.ProxyConfig{
+			HostConfig:     &config.HostConfiguration{Hostname: "proxy.local", Port: 8080},
+			RemoteURL:      &url.URL{},
+			AdvertisedPort: tt.port,
+			HTTPS:          tt.https,
+		})
+		if invalid := err != nil && strings.Contains(err.Error(), "invalid advertised port"); invalid != tt.wantErr {
+			t.Errorf("advertised port %d: error = %v, wantErr %v", tt.port, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+
+		c := newTestConfig()
+		c.AdvertisedPort = tt.port
+		c.HTTPS = tt.https
+		if got := c.baseURL(); got != tt.want {
+			t.Errorf("advertised port %d, https %v: baseURL() = %q, want %q", tt.port, tt.https, got, tt.want)
+		}
+	}
+}
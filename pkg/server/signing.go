@@ -0,0 +1,103 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unsignedPath is the path signature of the urls when they are not signed.
+const unsignedPath = "-"
+
+// urlSignature return the signature of the url path valid until exp.
+func (c *Config) urlSignature(escapedPath, exp string) string {
+	mac := hmac.New(sha256.New, []byte(c.URLSigningSecret))
+	_, _ = mac.Write([]byte(escapedPath + "\n" + exp)) // nolint: errcheck
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL add the expiry and the signature to the query of a proxyfied url.
+func (c *Config) signURL(u *url.URL) {
+	if c.URLSigningSecret == "" {
+		return
+	}
+
+	exp := strconv.FormatInt(time.Now().Add(c.URLSignTTL).Unix(), 10)
+
+	q := u.Query()
+	q.Set("exp", exp)
+	q.Set("sig", c.urlSignature(u.EscapedPath(), exp))
+	u.RawQuery = q.Encode()
+}
+
+// pathSignature return the expiry and the signature of the path prefix, written in the path
+// of the urls expanded by the players from templates, whose query is not kept.
+// It is a placeholder when the urls are not signed.
+func (c *Config) pathSignature(u *url.URL) string {
+	if c.URLSigningSecret == "" {
+		return unsignedPath
+	}
+
+	exp := strconv.FormatInt(time.Now().Add(c.URLSignTTL).Unix(), 10)
+
+	return exp + "." + c.urlSignature(u.EscapedPath(), exp)
+}
+
+// checkSignature reject the requests of an unsigned, tampered or expired url.
+// The signature of the routes with a signature param, written by pathSignature,
+// covers the path before it.
+func (c *Config) checkSignature(ctx *gin.Context) {
+	if c.URLSigningSecret == "" {
+		return
+	}
+
+	exp, sig := ctx.Query("exp"), ctx.Query("sig")
+	signedPath := ctx.Request.URL.EscapedPath()
+	if signature := ctx.Param("signature"); signature != "" {
+		exp, sig, _ = strings.Cut(signature, ".")
+		end := strings.Index(signedPath, "/"+signature+"/")
+		if end < 0 {
+			ctx.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		signedPath = signedPath[:end]
+	}
+
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expUnix {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	expected := c.urlSignature(signedPath, exp)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+}
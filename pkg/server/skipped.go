@@ -0,0 +1,64 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Reasons of a track skipped from the proxyfied playlist.
+const (
+	skipReasonRegex        = "regex"
+	skipReasonEmptyURI     = "empty-uri"
+	skipReasonParseError   = "parse-error"
+	skipReasonURLBlacklist = "url-blacklist"
+	skipReasonTagFilter    = "tag-filter"
+)
+
+// skippedTrack is an entry of the skipped tracks report.
+type skippedTrack struct {
+	Name   string `json:"name"`
+	URI    string `json:"uri"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// writeSkippedTracks write the skipped tracks report, replacing the previous one.
+func (c *Config) writeSkippedTracks(skipped []skippedTrack) error {
+	if c.SkippedTracksFile == "" {
+		return nil
+	}
+
+	if skipped == nil {
+		skipped = []skippedTrack{}
+	}
+
+	b, err := json.MarshalIndent(skipped, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := c.SkippedTracksFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.SkippedTracksFile)
+}
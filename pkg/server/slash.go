@@ -0,0 +1,84 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// trailingSlashRedirect redirect to the route with or without the trailing slash, the gin default
+	trailingSlashRedirect = "redirect"
+	// trailingSlashStrict answer 404 when the trailing slash doesn't match the route
+	trailingSlashStrict = "strict"
+	// trailingSlashBoth serve the route with and without the trailing slash, without redirect
+	trailingSlashBoth = "both"
+)
+
+// validTrailingSlash report whether the trailing slash behavior is supported.
+func validTrailingSlash(behavior string) bool {
+	switch behavior {
+	case trailingSlashRedirect, trailingSlashStrict, trailingSlashBoth:
+		return true
+	default:
+		return false
+	}
+}
+
+// slashRetriedKey is the request context key set when the route is retried with the other slash form.
+type slashRetriedKey struct{}
+
+// configureTrailingSlash set up how the router handles the paths whose trailing slash
+// doesn't match a route, the players don't all follow the redirects.
+func (c *Config) configureTrailingSlash(router *gin.Engine) {
+	switch c.TrailingSlash {
+	case trailingSlashStrict:
+		router.RedirectTrailingSlash = false
+		router.RedirectFixedPath = false
+	case trailingSlashBoth:
+		router.RedirectTrailingSlash = false
+		router.RedirectFixedPath = false
+		router.NoRoute(func(ctx *gin.Context) {
+			path := ctx.Request.URL.Path
+			if path == "/" || ctx.Request.Context().Value(slashRetriedKey{}) != nil {
+				return
+			}
+
+			// the route is retried once with the other form of the path
+			if strings.HasSuffix(path, "/") {
+				path = strings.TrimSuffix(path, "/")
+			} else {
+				path += "/"
+			}
+
+			ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), slashRetriedKey{}, true))
+			ctx.Request.URL.Path = path
+			ctx.Request.URL.RawPath = ""
+			// the 404 status set by gin before the NoRoute handlers is replaced by the route one,
+			// and the route handlers are not run again once this one returns
+			ctx.Status(http.StatusOK)
+			router.HandleContext(ctx)
+			ctx.Abort()
+		})
+	}
+}
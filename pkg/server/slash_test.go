@@ -0,0 +1,77 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestTrailingSlash(t *testing.T) {
+	tests := []struct {
+		behavior     string
+		path         string
+		wantStatus   int
+		wantLocation string
+	}{
+		{behavior: trailingSlashRedirect, path: "/iptv.m3u", wantStatus: http.StatusOK},
+		{behavior: trailingSlashRedirect, path: "/iptv.m3u/", wantStatus: http.StatusMovedPermanently, wantLocation: "/iptv.m3u?username=user&password=pass"},
+		{behavior: trailingSlashStrict, path: "/iptv.m3u", wantStatus: http.StatusOK},
+		{behavior: trailingSlashStrict, path: "/iptv.m3u/", wantStatus: http.StatusNotFound},
+		{behavior: trailingSlashBoth, path: "/iptv.m3u", wantStatus: http.StatusOK},
+		{behavior: trailingSlashBoth, path: "/iptv.m3u/", wantStatus: http.StatusOK},
+		{behavior: trailingSlashBoth, path: "/not/a/route/", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.behavior+" "+tt.path, func(t *testing.T) {
+			c := newTestConfig(m3u.Track{Name: "Channel", Length: -1, URI: "http://upstream.tv/live/1.ts"})
+			c.TrailingSlash = tt.behavior
+
+			w := serveTest(c, httptest.NewRequest(http.MethodGet, tt.path+"?username=user&password=pass", nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("GET %s status = %d, want %d", tt.path, w.Code, tt.wantStatus)
+			}
+			// the playlist is served once
+			if n := strings.Count(w.Body.String(), "#EXTM3U"); tt.wantStatus == http.StatusOK && n != 1 {
+				t.Errorf("GET %s served %d playlists, want 1", tt.path, n)
+			}
+			if location := w.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("GET %s location = %q, want %q", tt.path, location, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestValidTrailingSlash(t *testing.T) {
+	for _, behavior := range []string{trailingSlashRedirect, trailingSlashStrict, trailingSlashBoth} {
+		if !validTrailingSlash(behavior) {
+			t.Errorf("validTrailingSlash(%q) = false, want true", behavior)
+		}
+	}
+	for _, behavior := range []string{"", "Redirect", "ignore"} {
+		if validTrailingSlash(behavior) {
+			t.Errorf("validTrailingSlash(%q) = true, want false", behavior)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// Types of the channel streams, each served by its own strategy.
+const (
+	// streamTypeHLS is rewritten or remuxed by ffmpeg
+	streamTypeHLS = "hls"
+	// streamTypeDASH has its manifest rewritten
+	streamTypeDASH = "dash"
+	// streamTypeRaw is a ts, mp4 or any other stream relayed as is
+	streamTypeRaw = "raw"
+)
+
+// streamProbeBytes is the beginning of the stream read to detect its type.
+const streamProbeBytes = 512
+
+// streamTypes are the detected stream types by channel url, probed once.
+var streamTypes = map[string]string{}
+var streamTypesLock = sync.RWMutex{}
+
+// streamTypeByURI return the stream type given by the extension of the url, empty when it has none known.
+func streamTypeByURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".m3u8", ".m3u":
+		return streamTypeHLS
+	case ".mpd":
+		return streamTypeDASH
+	case ".ts", ".mp4", ".mkv", ".avi", ".mov", ".flv", ".aac", ".mp3", ".m4v", ".webm":
+		return streamTypeRaw
+	}
+
+	return ""
+}
+
+// streamTypeBySuffix return the stream type given by the suffix of the url, the mapping of the
+// channels served without the detection: only the .m3u8 urls are hls and the .mpd ones dash.
+func streamTypeBySuffix(uri string) string {
+	switch {
+	case strings.HasSuffix(uri, ".m3u8"):
+		return streamTypeHLS
+	case strings.HasSuffix(uri, ".mpd"):
+		return streamTypeDASH
+	default:
+		return streamTypeRaw
+	}
+}
+
+// knownStreamType return the stream type of the url known without requesting it, by its extension
+// with the detection enabled, empty when it has none known, else by its suffix.
+func (c *Config) knownStreamType(uri string) string {
+	if !c.DetectStreamType {
+		return streamTypeBySuffix(uri)
+	}
+
+	return streamTypeByURI(uri)
+}
+
+// streamType return the stream type of the channel known by its url, else probed
+// from the upstream response when the detection is enabled, else raw.
+func (c *Config) streamType(ctx *gin.Context) string {
+	if t := c.knownStreamType(c.track.URI); t != "" {
+		return t
+	}
+
+	streamTypesLock.RLock()
+	t, ok := streamTypes[c.track.URI]
+	streamTypesLock.RUnlock()
+	if ok {
+		return t
+	}
+
+	t, err := c.probeStreamType(ctx)
+	if err != nil {
+		// not cached, the next request probes again
+		logger.Debugf("%s | stream type of %s not detected: %v", ctx.ClientIP(), c.track.Name, err)
+		return streamTypeRaw
+	}
+	logger.Debugf("%s | stream type of %s detected: %s", ctx.ClientIP(), c.track.Name, t)
+
+	streamTypesLock.Lock()
+	streamTypes[c.track.URI] = t
+	streamTypesLock.Unlock()
+
+	return t
+}
+
+// probeStreamType request the channel upstream and detect the stream type
+// from the content type and the beginning of the response.
+func (c *Config) probeStreamType(ctx *gin.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx.Request.Context(), http.MethodGet, c.track.URI, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", ctx.Request.UserAgent())
+	c.setChannelHeaders(req.Header)
+
+	resp, err := c.upstreamDo(upstreamClient, withSelectedUpstream(ctx, req))
+	if err != nil {
+		return "", err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, streamProbeBytes))
+	if err != nil {
+		return "", err
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	switch {
+	case isHLSPlaylist(resp.Request.URL, contentType, body):
+		return streamTypeHLS, nil
+	case isDASHManifest(resp.Request.URL, contentType, body):
+		return streamTypeDASH, nil
+	}
+
+	return streamTypeRaw, nil
+}
+
+// isDASHManifest report whether the upstream response is a dash manifest.
+func isDASHManifest(u *url.URL, contentType string, body []byte) bool {
+	return strings.Contains(strings.ToLower(contentType), "dash+xml") ||
+		strings.HasSuffix(u.Path, ".mpd") ||
+		bytes.Contains(body, []byte("<MPD"))
+}
@@ -0,0 +1,49 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import "testing"
+
+func TestKnownStreamType(t *testing.T) {
+	tests := []struct {
+		uri          string
+		wantDetected string
+		wantDefault  string
+	}{
+		{uri: "http://upstream.tv/live/1.m3u8", wantDetected: streamTypeHLS, wantDefault: streamTypeHLS},
+		{uri: "http://upstream.tv/live/1.M3U8", wantDetected: streamTypeHLS, wantDefault: streamTypeRaw},
+		{uri: "http://upstream.tv/live/1.m3u8?token=abc", wantDetected: streamTypeHLS, wantDefault: streamTypeRaw},
+		{uri: "http://upstream.tv/live/1.m3u", wantDetected: streamTypeHLS, wantDefault: streamTypeRaw},
+		{uri: "http://upstream.tv/live/1.mpd", wantDetected: streamTypeDASH, wantDefault: streamTypeDASH},
+		{uri: "http://upstream.tv/live/1.ts", wantDetected: streamTypeRaw, wantDefault: streamTypeRaw},
+		{uri: "http://upstream.tv/live/1", wantDetected: "", wantDefault: streamTypeRaw},
+	}
+
+	for _, tt := range tests {
+		c := newTestConfig()
+		if got := c.knownStreamType(tt.uri); got != tt.wantDefault {
+			t.Errorf("knownStreamType(%q) without detection = %q, want %q", tt.uri, got, tt.wantDefault)
+		}
+
+		c.DetectStreamType = true
+		if got := c.knownStreamType(tt.uri); got != tt.wantDetected {
+			t.Errorf("knownStreamType(%q) with detection = %q, want %q", tt.uri, got, tt.wantDetected)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// tagValues is the values of an EXTINF tag matched by a tag filter.
+type tagValues struct {
+	exact    map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+// tagFilters filter the tracks on their EXTINF tags, a track is kept when each allowed tag
+// has one of its values and no excluded tag has one of its values.
+type tagFilters struct {
+	allow   map[string]*tagValues
+	exclude map[string]*tagValues
+}
+
+// compileTagFilters compile the allowed and excluded values by tag name, matched exactly,
+// or as a regular expression when written between slashes, e.g. /^(FR|BE)$/.
+func compileTagFilters(allow, exclude map[string][]string) (*tagFilters, error) {
+	if len(allow) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	f := &tagFilters{}
+	var err error
+	if f.allow, err = compileTagValues(allow); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compileTagValues(exclude); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func compileTagValues(filters map[string][]string) (map[string]*tagValues, error) {
+	compiled := make(map[string]*tagValues, len(filters))
+	for name, values := range filters {
+		v := &tagValues{exact: map[string]struct{}{}}
+		for _, value := range values {
+			value = strings.TrimSpace(value)
+			if len(value) > 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+				re, err := regexp.Compile(value[1 : len(value)-1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid tag filter pattern %q for %s: %w", value, name, err)
+				}
+				v.patterns = append(v.patterns, re)
+				continue
+			}
+			v.exact[value] = struct{}{}
+		}
+		compiled[strings.ToLower(strings.TrimSpace(name))] = v
+	}
+
+	return compiled, nil
+}
+
+// matches tell if the value is one of the filter values.
+func (v *tagValues) matches(value string) bool {
+	if _, ok := v.exact[strings.TrimSpace(value)]; ok {
+		return true
+	}
+	for _, re := range v.patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keep tell if the track passes the tag filters, a track without an allowed tag is dropped.
+func (f *tagFilters) keep(track *m3u.Track) bool {
+	if f == nil {
+		return true
+	}
+
+	for name, values := range f.allow {
+		if !hasTagValue(track, name, values) {
+			return false
+		}
+	}
+	for name, values := range f.exclude {
+		if hasTagValue(track, name, values) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasTagValue tell if the track has the tag with one of the values, tag names are case insensitive.
+func hasTagValue(track *m3u.Track, name string, values *tagValues) bool {
+	for _, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, name) && values.matches(tag.Value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,177 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+const requestTimeoutMessage = "request timeout\n"
+
+// timed return the group of the routes answering within the maximum request duration,
+// the playlists and the api, the streams are long-lived and the configuration reload
+// has to complete, they are registered out of it.
+func (c *Config) timed(r *gin.RouterGroup) *gin.RouterGroup {
+	if c.MaxRequestDuration <= 0 {
+		return r
+	}
+
+	return r.Group("", c.limitRequestDuration)
+}
+
+// limitRequestDuration answer 503 to the request still unanswered after the maximum duration,
+// and cancel its context. The handler keeps running until it returns, its response is dropped.
+func (c *Config) limitRequestDuration(ctx *gin.Context) {
+	reqCtx, cancel := context.WithCancel(ctx.Request.Context())
+	defer cancel()
+	ctx.Request = ctx.Request.WithContext(reqCtx)
+
+	w := &deadlineWriter{ResponseWriter: ctx.Writer, base: ctx.Writer.Header().Clone(), header: ctx.Writer.Header().Clone()}
+	ctx.Writer = w
+
+	// the gin context is used by the handler meanwhile
+	request := ctx.ClientIP() + " | " + ctx.Request.Method + " " + ctx.Request.URL.Path
+	timer := time.AfterFunc(c.MaxRequestDuration, func() {
+		if w.timeout() {
+			logger.Warnf("%s exceeded the maximum request duration of %s", request, c.MaxRequestDuration)
+		}
+		cancel()
+	})
+	defer timer.Stop()
+
+	ctx.Next()
+}
+
+// deadlineWriter is the response writer of a request with a maximum duration,
+// the writes of its handler are dropped once it has been answered 503.
+// The handler sets its own headers, copied to the response when it writes it,
+// so that they don't race with the 503 ones.
+type deadlineWriter struct {
+	gin.ResponseWriter
+	// the headers set before the handler, e.g. the cors ones
+	base     http.Header
+	header   http.Header
+	lock     sync.Mutex
+	timedOut bool
+}
+
+func (w *deadlineWriter) Header() http.Header {
+	return w.header
+}
+
+// syncHeader copy the handler headers to the response until it is written.
+func (w *deadlineWriter) syncHeader() {
+	if w.ResponseWriter.Written() {
+		return
+	}
+
+	h := w.ResponseWriter.Header()
+	for k := range h {
+		delete(h, k)
+	}
+	for k, v := range w.header {
+		h[k] = v
+	}
+}
+
+// timeout answer 503 when nothing is written yet, it return whether it did.
+func (w *deadlineWriter) timeout() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.ResponseWriter.Written() {
+		return false
+	}
+
+	w.timedOut = true
+	h := w.ResponseWriter.Header()
+	for k := range h {
+		delete(h, k)
+	}
+	for k, v := range w.base {
+		h[k] = v
+	}
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(requestTimeoutMessage)))
+	w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.ResponseWriter.WriteString(requestTimeoutMessage)
+	w.ResponseWriter.Flush()
+
+	return true
+}
+
+func (w *deadlineWriter) WriteHeader(code int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.timedOut {
+		w.syncHeader()
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *deadlineWriter) WriteHeaderNow() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.timedOut {
+		w.syncHeader()
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *deadlineWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	w.syncHeader()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *deadlineWriter) WriteString(s string) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	w.syncHeader()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *deadlineWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.timedOut {
+		w.syncHeader()
+		w.ResponseWriter.Flush()
+	}
+}
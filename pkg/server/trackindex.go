@@ -0,0 +1,177 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// Encodings of the track index in the proxyfied urls.
+//
+// The index is the position of the track in the playlist served by the proxy, the merged
+// playlists included, numbered one after the other by mergePlaylists, so it is unique across
+// the sources: an inbound url maps back to exactly one track with decodeTrackIndex, the decimal
+// and base62 encodings directly and the hash encoding through the reverse lookup built by
+// indexTracks. The tracks of several sources sharing an url share its hash and are served as
+// the first one, --merge-duplicates drop leaves them out of the merged playlist.
+const (
+	indexEncodingDecimal = "decimal"
+	indexEncodingBase62  = "base62"
+	indexEncodingHash    = "hash"
+)
+
+const base62Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func validIndexEncoding(encoding string) bool {
+	switch encoding {
+	case "", indexEncodingDecimal, indexEncodingBase62, indexEncodingHash:
+		return true
+	}
+
+	return false
+}
+
+func encodeBase62(n uint64) string {
+	if n == 0 {
+		return base62Alphabet[:1]
+	}
+
+	var b []byte
+	for n > 0 {
+		b = append([]byte{base62Alphabet[n%62]}, b...)
+		n /= 62
+	}
+
+	return string(b)
+}
+
+func decodeBase62(s string) (uint64, bool) {
+	if s == "" {
+		return 0, false
+	}
+
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(base62Alphabet, s[i])
+		if d < 0 {
+			return 0, false
+		}
+		// the values beyond an uint64 are not an index
+		if n > (math.MaxUint64-uint64(d))/62 {
+			return 0, false
+		}
+		n = n*62 + uint64(d)
+	}
+
+	return n, true
+}
+
+// hashTrackURI return an opaque key of the track which doesn't change when the playlist is reordered.
+func hashTrackURI(uri string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(uri)) // nolint: errcheck
+
+	return encodeBase62(h.Sum64())
+}
+
+// encodeTrackIndex return the representation of the track index used in the proxyfied url.
+func (c *Config) encodeTrackIndex(index int, uri string) string {
+	switch c.URLIndexEncoding {
+	case indexEncodingBase62:
+		return encodeBase62(uint64(index))
+	case indexEncodingHash:
+		return hashTrackURI(uri)
+	default:
+		return strconv.Itoa(index)
+	}
+}
+
+// indexTracks build the reverse lookup of the hashed track indexes, playlistLock must be held.
+func (c *Config) indexTracks(tracks []m3u.Track) {
+	if c.URLIndexEncoding != indexEncodingHash {
+		return
+	}
+
+	keys := make(map[string]int, len(tracks))
+	for i := range tracks {
+		key := hashTrackURI(tracks[i].URI)
+		// tracks sharing an uri share the same upstream, keep the first one.
+		j, ok := keys[key]
+		if !ok {
+			keys[key] = i
+			continue
+		}
+		if tracks[j].URI != tracks[i].URI {
+			logger.Warnf("the tracks %q and %q have the same url hash %s, the second one is served as the first one", tracks[j].Name, tracks[i].Name, key)
+		}
+	}
+	c.trackKeys = keys
+}
+
+// trackByIndex return the track from the representation of its index in a proxyfied url.
+func (c *Config) trackByIndex(s string) (m3u.Track, bool) {
+	playlistLock.RLock()
+	defer playlistLock.RUnlock()
+
+	index, ok := c.decodeTrackIndex(s)
+	if !ok {
+		return m3u.Track{}, false
+	}
+
+	return c.playlist.Tracks[index], true
+}
+
+// decodeTrackIndex return the index of the track from its representation in a proxyfied url,
+// playlistLock must be held.
+func (c *Config) decodeTrackIndex(s string) (int, bool) {
+	var index int
+
+	switch c.URLIndexEncoding {
+	case indexEncodingBase62:
+		n, ok := decodeBase62(s)
+		if !ok || n > uint64(len(c.playlist.Tracks)) {
+			return 0, false
+		}
+		index = int(n)
+	case indexEncodingHash:
+		i, ok := c.trackKeys[s]
+		if !ok {
+			return 0, false
+		}
+		index = i
+	default:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, false
+		}
+		index = i
+	}
+
+	if index < 0 || index >= len(c.playlist.Tracks) {
+		return 0, false
+	}
+
+	return index, true
+}
@@ -0,0 +1,174 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+func TestTrackIndexNoCollision(t *testing.T) {
+	tracks := make([]m3u.Track, 500)
+	for i := range tracks {
+		tracks[i] = m3u.Track{Name: fmt.Sprintf("Channel %d", i), URI: fmt.Sprintf("http://upstream.tv/live/%d.ts", i)}
+	}
+
+	for _, encoding := range []string{indexEncodingDecimal, indexEncodingBase62, indexEncodingHash} {
+		t.Run(encoding, func(t *testing.T) {
+			c := newTestConfig()
+			c.URLIndexEncoding = encoding
+			c.setTracks(tracks)
+
+			seen := map[string]int{}
+			for i := range tracks {
+				key := c.encodeTrackIndex(i, tracks[i].URI)
+				if j, ok := seen[key]; ok {
+					t.Fatalf("the tracks %d and %d share the index %q", j, i, key)
+				}
+				seen[key] = i
+
+				// an inbound url maps back to its own track
+				track, ok := c.trackByIndex(key)
+				if !ok || track.URI != tracks[i].URI {
+					t.Fatalf("trackByIndex(%q) = %q, %v, want %q", key, track.URI, ok, tracks[i].URI)
+				}
+			}
+		})
+	}
+}
+
+func TestMergedTrackIndexNoCollision(t *testing.T) {
+	// the sources number their tracks from 0 and share the url of their first track
+	playlists := make([]m3u.Playlist, 3)
+	for i := range playlists {
+		playlists[i].Tracks = append(playlists[i].Tracks, m3u.Track{Name: fmt.Sprintf("Shared %d", i), URI: "http://upstream.tv/live/shared.ts"})
+		for j := 0; j < 100; j++ {
+			playlists[i].Tracks = append(playlists[i].Tracks, m3u.Track{Name: fmt.Sprintf("Source %d channel %d", i, j), URI: fmt.Sprintf("http://source%d.tv/live/%d.ts", i, j)})
+		}
+	}
+
+	for _, duplicates := range []string{mergeDuplicatesKeep, mergeDuplicatesDrop} {
+		merged := mergePlaylists(playlists, duplicates)
+		wantTracks := 3 * 101
+		if duplicates == mergeDuplicatesDrop {
+			wantTracks -= 2
+		}
+		if len(merged.Tracks) != wantTracks {
+			t.Fatalf("%s: merged %d tracks, want %d", duplicates, len(merged.Tracks), wantTracks)
+		}
+
+		for _, encoding := range []string{indexEncodingDecimal, indexEncodingBase62, indexEncodingHash} {
+			t.Run(duplicates+"/"+encoding, func(t *testing.T) {
+				c := newTestConfig()
+				c.URLIndexEncoding = encoding
+				c.setTracks(merged.Tracks)
+
+				seen := map[string]int{}
+				for i, track := range merged.Tracks {
+					key := c.encodeTrackIndex(i, track.URI)
+					found, ok := c.trackByIndex(key)
+					if !ok || found.URI != track.URI {
+						t.Fatalf("trackByIndex(%q) = %q, %v, want %q", key, found.URI, ok, track.URI)
+					}
+					// only the tracks of several sources sharing an url share a proxy path
+					if j, ok := seen[key]; ok && merged.Tracks[j].URI != track.URI {
+						t.Fatalf("the tracks %q and %q share the index %q", merged.Tracks[j].Name, track.Name, key)
+					}
+					seen[key] = i
+				}
+			})
+		}
+	}
+}
+
+func TestMergePlaylistsOrder(t *testing.T) {
+	merged := mergePlaylists([]m3u.Playlist{
+		{Tracks: []m3u.Track{{Name: "A1", URI: "http://a.tv/1.ts"}, {Name: "A2", URI: "http://a.tv/2.ts"}}},
+		{Tracks: []m3u.Track{{Name: "B1", URI: "http://a.tv/1.ts"}, {Name: "B2", URI: "http://b.tv/2.ts"}, {Name: "B2 backup group", URI: "http://b.tv/2.ts"}}},
+	}, mergeDuplicatesDrop)
+
+	var names []string
+	for _, track := range merged.Tracks {
+		names = append(names, track.Name)
+	}
+	// the duplicates of a previous playlist are dropped, the ones within a playlist kept
+	if got, want := strings.Join(names, ","), "A1,A2,B2,B2 backup group"; got != want {
+		t.Errorf("merged tracks = %s, want %s", got, want)
+	}
+}
+
+func TestTrackIndexHashSharedURI(t *testing.T) {
+	c := newTestConfig()
+	c.URLIndexEncoding = indexEncodingHash
+	c.setTracks([]m3u.Track{
+		{Name: "Channel", URI: "http://upstream.tv/live/1.ts"},
+		{Name: "Channel (backup group)", URI: "http://upstream.tv/live/1.ts"},
+	})
+
+	// the tracks sharing an uri share the upstream, the first one is served
+	track, ok := c.trackByIndex(c.encodeTrackIndex(1, "http://upstream.tv/live/1.ts"))
+	if !ok || track.Name != "Channel" {
+		t.Errorf("trackByIndex() = %q, %v, want the first track", track.Name, ok)
+	}
+}
+
+func TestTrackIndexUnknown(t *testing.T) {
+	for _, encoding := range []string{indexEncodingDecimal, indexEncodingBase62, indexEncodingHash} {
+		c := newTestConfig(m3u.Track{Name: "Channel", URI: "http://upstream.tv/live/1.ts"})
+		c.URLIndexEncoding = encoding
+		c.setTracks(c.tracks())
+
+		for _, s := range []string{"", "-1", "1", "zz", "not an index"} {
+			if _, ok := c.trackByIndex(s); ok {
+				t.Errorf("%s: trackByIndex(%q) found a track", encoding, s)
+			}
+		}
+	}
+}
+
+func TestDecodeBase62(t *testing.T) {
+	last := base62Alphabet[len(base62Alphabet)-1:]
+
+	tests := []struct {
+		s      string
+		want   uint64
+		wantOK bool
+	}{
+		{s: "", wantOK: false},
+		{s: base62Alphabet[:1], want: 0, wantOK: true},
+		{s: last, want: 61, wantOK: true},
+		{s: base62Alphabet[1:2] + base62Alphabet[:1], want: 62, wantOK: true},
+		{s: encodeBase62(math.MaxUint64), want: math.MaxUint64, wantOK: true},
+		// 62^11-1 is beyond an uint64, it wrapped around without the overflow check
+		{s: strings.Repeat(last, 11), wantOK: false},
+		{s: strings.Repeat(last, 22), wantOK: false},
+		{s: "a-b", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		got, ok := decodeBase62(tt.s)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("decodeBase62(%q) = %d, %v, want %d, %v", tt.s, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// isTranscoded report whether the current track is configured to be transcoded.
+func (c *Config) isTranscoded() bool {
+	return c.TranscodeCommand != "" && c.track != nil && trackMatches(c.track, c.TranscodeChannels)
+}
+
+// transcodeArgs return the transcode command arguments, {url} and {name} are replaced
+// by the upstream url and the channel name.
+func (c *Config) transcodeArgs(upstream *url.URL) []string {
+	args := strings.Fields(c.TranscodeCommand)
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{url}", upstream.String())
+		args[i] = strings.ReplaceAll(args[i], "{name}", c.track.Name)
+	}
+
+	return args
+}
+
+// transcode pipe the upstream stream through the transcode command to the client,
+// the command is killed when the client goes away.
+func (c *Config) transcode(ctx *gin.Context, upstream *url.URL) {
+	resp, err := c.streamRequest(ctx, upstream)
+	if err != nil {
+		_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		c.streamResponse(ctx, resp)
+		return
+	}
+
+	if ctx.Request.Method == http.MethodHead {
+		ctx.Header("Content-Type", "video/mp2t")
+		ctx.Status(http.StatusOK)
+		return
+	}
+
+	args := c.transcodeArgs(upstream)
+	cmd := exec.CommandContext(ctx.Request.Context(), args[0], args[1:]...) // nolint: gosec
+	cmd.Stdin = resp.Body
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	if err := cmd.Start(); err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	logger.Debugf("%s | transcoding %s with %s", ctx.ClientIP(), c.track.Name, args[0])
+
+	ctx.Header("Content-Type", "video/mp2t")
+	ctx.Status(http.StatusOK)
+	ctx.Stream(func(w io.Writer) bool {
+		_, _ = io.Copy(w, stdout) // nolint: errcheck
+		return false
+	})
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if err != nil && ctx.Request.Context().Err() == nil && errors.As(err, &exitErr) {
+		logger.Errorf("transcoding %s: %s", c.track.Name, err)
+	}
+}
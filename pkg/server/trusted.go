@@ -0,0 +1,133 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// credentiallessKey is the context key set when a trusted client is served without credentials.
+const credentiallessKey = "iptv-proxy-credentialless"
+
+// parseTrustedNetworks parse the trusted CIDRs, a single address is a network of its own.
+func parseTrustedNetworks(networks []string) ([]*net.IPNet, error) {
+	return parseNetworks("trusted network", networks)
+}
+
+// parseNetworks parse the CIDRs named in the errors, a single address is a network of its own.
+func parseNetworks(name string, networks []string) ([]*net.IPNet, error) {
+	trusted := make([]*net.IPNet, 0, len(networks))
+
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s %q", name, network)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			network = fmt.Sprintf("%s/%d", network, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", name, network, err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+
+	return trusted, nil
+}
+
+// isTrusted report whether the request comes from a trusted network. The address of the
+// connection is used, the forwarded headers can be forged by anyone.
+func (c *Config) isTrusted(ctx *gin.Context) bool {
+	if len(c.trustedNetworks) == 0 {
+		return false
+	}
+
+	ip := net.ParseIP(ctx.RemoteIP())
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range c.trustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticatePlaylist serve the playlists without credentials to the trusted clients which
+// didn't send them, the other clients are authenticated. The admin and xtream routes keep
+// the strict authenticate.
+func (c *Config) authenticatePlaylist(ctx *gin.Context) {
+	if c.isTrusted(ctx) && ctx.Query("username") == "" && ctx.PostForm("username") == "" {
+		ctx.Set(credentiallessKey, true)
+		return
+	}
+
+	c.authenticate(ctx)
+}
+
+// requestConfig return the configuration generating the urls for the client,
+// without the credentials for a trusted client which didn't send them.
+func (c *Config) requestConfig(ctx *gin.Context) *Config {
+	if !ctx.GetBool(credentiallessKey) {
+		return c
+	}
+
+	credentialless := *c
+	credentialless.credentialless = true
+
+	return &credentialless
+}
+
+// trusted serve the credential-less routes to the trusted clients only.
+func (c *Config) trusted(handler func(*Config, *gin.Context)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !c.isTrusted(ctx) {
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		credentialless := *c
+		credentialless.credentialless = true
+		handler(&credentialless, ctx)
+	}
+}
+
+// proxyPath return the path prefix of the proxyfied urls.
+func (c *Config) proxyPath() string {
+	if c.credentialless {
+		return "/" + c.endpointAntiColision
+	}
+
+	return fmt.Sprintf("/%s/%s/%s", c.endpointAntiColision, c.User.PathEscape(), c.Password.PathEscape())
+}
@@ -0,0 +1,86 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// loadTvgIDMap read the json file mapping the channel names to their tvg-id,
+// e.g. {"France 2 HD": "France2.fr"}, the inline mapping overrides the file one.
+// The names are matched case-insensitively.
+func loadTvgIDMap(filePath string, inline map[string]string) (map[string]string, error) {
+	mapping := map[string]string{}
+
+	if filePath != "" {
+		b, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		file := map[string]string{}
+		if err := json.Unmarshal(b, &file); err != nil {
+			return nil, fmt.Errorf("invalid tvg-id map file %s: %w", filePath, err)
+		}
+		for name, id := range file {
+			mapping[strings.ToLower(name)] = id
+		}
+	}
+
+	for name, id := range inline {
+		mapping[strings.ToLower(name)] = id
+	}
+
+	if len(mapping) == 0 {
+		return nil, nil
+	}
+
+	return mapping, nil
+}
+
+// mapTvgID return the track with the tvg-id mapped to its name, set or overridden,
+// the unmapped tracks are returned as is.
+func (c *Config) mapTvgID(track m3u.Track) m3u.Track {
+	id, ok := c.tvgIDs[strings.ToLower(track.Name)]
+	if !ok {
+		return track
+	}
+
+	// the tags are shared with the fetched playlist, they are copied before being changed
+	tags := make([]m3u.Tag, 0, len(track.Tags)+1)
+	found := false
+	for _, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, "tvg-id") {
+			tag.Value = id
+			found = true
+		}
+		tags = append(tags, tag)
+	}
+	if !found {
+		tags = append([]m3u.Tag{{Name: "tvg-id", Value: id}}, tags...)
+	}
+	track.Tags = tags
+
+	return track
+}
@@ -0,0 +1,87 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// validateTvgShifts check the tvg-shift values are a number of hours, e.g. -2 or +5.5.
+func validateTvgShifts(global string, byGroup map[string]string) error {
+	values := map[string]string{"": global}
+	for group, shift := range byGroup {
+		values[group] = shift
+	}
+
+	for group, shift := range values {
+		if shift == "" && group == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(strings.TrimSpace(shift), 64); err != nil {
+			if group == "" {
+				return fmt.Errorf("invalid tvg-shift %q: expected a number of hours", shift)
+			}
+			return fmt.Errorf("invalid tvg-shift %q for group %q: expected a number of hours", shift, group)
+		}
+	}
+
+	return nil
+}
+
+// tvgShift return the tvg-shift configured for the group of the track, else the global one.
+func (c *Config) tvgShift(track *m3u.Track) string {
+	if group := trackGroup(track); group != "" {
+		for name, shift := range c.TvgShiftByGroup {
+			if strings.EqualFold(name, group) {
+				return strings.TrimSpace(shift)
+			}
+		}
+	}
+
+	return strings.TrimSpace(c.TvgShift)
+}
+
+// shiftTvg return the track with the configured tvg-shift, set or overridden,
+// the tracks without one are returned as is.
+func (c *Config) shiftTvg(track m3u.Track) m3u.Track {
+	shift := c.tvgShift(&track)
+	if shift == "" {
+		return track
+	}
+
+	// the tags are shared with the fetched playlist, they are copied before being changed
+	tags := make([]m3u.Tag, 0, len(track.Tags)+1)
+	found := false
+	for _, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, "tvg-shift") {
+			tag.Value = shift
+			found = true
+		}
+		tags = append(tags, tag)
+	}
+	if !found {
+		tags = append(tags, m3u.Tag{Name: "tvg-shift", Value: shift})
+	}
+	track.Tags = tags
+
+	return track
+}
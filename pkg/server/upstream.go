@@ -0,0 +1,333 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// errCircuitOpen is returned when an upstream host is failing and its circuit is open.
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// errUpstreamAuth is returned when the upstream refuses the provider credentials.
+var errUpstreamAuth = errors.New("upstream refused the credentials")
+
+// statusClientClosedRequest is the status logged for the requests the client canceled, as nginx does.
+const statusClientClosedRequest = 499
+
+// upstreamClient is the http client shared by every upstream request.
+var upstreamClient = &http.Client{}
+
+// xtreamAPIClient is the http client of the xtream api requests.
+var xtreamAPIClient = &http.Client{}
+
+// upstreamClients is the upstream and xtream api clients built from a configuration,
+// shared by the handlers once the configuration is applied.
+type upstreamClients struct {
+	upstream  *http.Client
+	xtreamAPI *http.Client
+}
+
+// newUpstreamClients build the upstream clients of the configuration, the shared ones are not changed.
+func newUpstreamClients(config *config.ProxyConfig) (*upstreamClients, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.UpstreamProxyURL != "" {
+		proxy, err := upstreamProxy(config.UpstreamProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = proxy
+	}
+
+	if config.UpstreamInsecureSkipVerify {
+		logger.Warnf("upstream TLS certificates are NOT verified, connections to the providers can be intercepted")
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // nolint: gosec
+	}
+
+	return &upstreamClients{
+		upstream: &http.Client{
+			Transport:     &timedTransport{next: transport},
+			CheckRedirect: keepRedirectHeaders,
+		},
+		xtreamAPI: &http.Client{
+			Transport:     &timedTransport{kind: upstreamKindXtreamAPI, next: transport},
+			CheckRedirect: keepRedirectHeaders,
+		},
+	}, nil
+}
+
+// upstreamProxy return the proxy function of the upstream transport sending the requests
+// through the http or socks5 proxy, the hosts listed in NO_PROXY and the loopback addresses
+// are reached directly.
+func upstreamProxy(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy url: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid upstream proxy url %q: expected an http, https or socks5 scheme", proxyURL)
+	}
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  u.String(),
+		HTTPSProxy: u.String(),
+		NoProxy:    noProxy,
+	}).ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}, nil
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type circuitBreaker struct {
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+var circuitBreakers = map[string]*circuitBreaker{}
+var circuitBreakersLock = sync.Mutex{}
+
+// allowUpstream tells if a request can be sent to the host.
+func (c *Config) allowUpstream(host string) bool {
+	if c.CircuitBreakerThreshold <= 0 {
+		return true
+	}
+
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+
+	cb, ok := circuitBreakers[host]
+	if !ok {
+		return true
+	}
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < c.CircuitBreakerCooldown {
+			return false
+		}
+		// let a single request probe the upstream
+		cb.state = circuitHalfOpen
+		logger.Warnf("circuit breaker %s for %s", cb.state, host)
+		return true
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// reportUpstream record the result of a request sent to the host.
+func (c *Config) reportUpstream(host string, success bool) {
+	if c.CircuitBreakerThreshold <= 0 {
+		return
+	}
+
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+
+	cb, ok := circuitBreakers[host]
+	if !ok {
+		if success {
+			return
+		}
+		cb = &circuitBreaker{}
+		circuitBreakers[host] = cb
+	}
+
+	if success {
+		if cb.state != circuitClosed {
+			logger.Infof("circuit breaker %s for %s", circuitClosed, host)
+		}
+		delete(circuitBreakers, host)
+		return
+	}
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= c.CircuitBreakerThreshold {
+		if cb.state != circuitOpen {
+			logger.Warnf("circuit breaker %s for %s after %d consecutive failures", circuitOpen, host, cb.failures)
+		}
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// abandonUpstream forget a request canceled before its result, a half-open circuit
+// lets the next request probe the upstream in its place.
+func (c *Config) abandonUpstream(host string) {
+	if c.CircuitBreakerThreshold <= 0 {
+		return
+	}
+
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+
+	if cb, ok := circuitBreakers[host]; ok && cb.state == circuitHalfOpen {
+		cb.state = circuitOpen
+	}
+}
+
+// upstreamDo send the request to the upstream with the given client, balanced between the
+// upstream mirrors, the next mirror is tried when one fails.
+func (c *Config) upstreamDo(client *http.Client, req *http.Request) (*http.Response, error) {
+	req = withRedirectHeaders(req, c.channelHeaders())
+	// the upstream selection of the client is resolved by the proxy, it is not forwarded
+	if req.Header.Get(upstreamHeader) != "" {
+		req = req.Clone(req.Context())
+		req.Header.Del(upstreamHeader)
+	}
+	if u := selectedUpstreamURL(req); u != req.URL {
+		req = req.Clone(req.Context())
+		req.URL = u
+		req.Host = ""
+	}
+
+	urls := c.mirrorURLs(req.URL)
+
+	var resp *http.Response
+	var err error
+	for i, u := range urls {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+
+		mirrored := req
+		if len(urls) > 1 {
+			mirrored = req.Clone(req.Context())
+			mirrored.URL = u
+			mirrored.Host = ""
+		}
+
+		resp, err = c.upstreamHostDo(client, mirrored)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		if i < len(urls)-1 {
+			logger.Warnf("upstream mirror %s failed, trying the next one", u.Host)
+		}
+	}
+
+	return resp, err
+}
+
+// upstreamHostDo send the request to the upstream with the given client,
+// it fast fails while the upstream host circuit is open or the host is rate limiting,
+// and waits while the host has its maximum of concurrent requests.
+func (c *Config) upstreamHostDo(client *http.Client, req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := c.checkRateLimit(host); err != nil {
+		return nil, err
+	}
+	if !c.allowUpstream(host) {
+		return nil, fmt.Errorf("%s: %w", host, errCircuitOpen)
+	}
+
+	release, err := hostSlot(req, host)
+	if err != nil {
+		// nothing was sent, a half-open circuit lets the next request probe the upstream
+		c.abandonUpstream(host)
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil && req.Context().Err() != nil {
+		// the client went away, it tells nothing about the upstream
+		c.abandonUpstream(host)
+	} else {
+		c.reportUpstream(host, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	c.reportRateLimit(host, resp)
+	resp.Body = &slotBody{ReadCloser: resp.Body, release: release}
+
+	return resp, nil
+}
+
+// upstreamErrorStatus return the http status to send to the client for an upstream error,
+// so that the players and the monitoring tell the failures apart: 504 when the upstream
+// timed out, 502 when it is unreachable, 503 while its circuit is open, 429 while
+// it rate limits, 403 when it refuses the credentials and 499 when the client canceled.
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+	var urlErr *url.Error
+
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errUpstreamAuth):
+		return http.StatusForbidden
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	case errors.As(err, &urlErr), errors.As(err, &netErr):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,341 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/romaxa55/iptv-proxy/pkg/config"
+	"github.com/romaxa55/iptv-proxy/pkg/m3u"
+)
+
+// timeoutError is a net.Error timing out, as the dial and read timeouts of the transport.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{
+			name: "circuit open",
+			err:  fmt.Errorf("upstream.tv: %w", errCircuitOpen),
+			want: http.StatusServiceUnavailable,
+		},
+		{
+			name: "rate limited",
+			err:  fmt.Errorf("upstream.tv: %w", errRateLimited),
+			want: http.StatusTooManyRequests,
+		},
+		{
+			name: "credentials refused",
+			err:  fmt.Errorf("unable to open playlist URL: %w: 401 Unauthorized", errUpstreamAuth),
+			want: http.StatusForbidden,
+		},
+		{
+			name: "deadline exceeded",
+			err:  &url.Error{Op: "Get", URL: "http://upstream.tv", Err: context.DeadlineExceeded},
+			want: http.StatusGatewayTimeout,
+		},
+		{
+			name: "network timeout",
+			err:  &url.Error{Op: "Get", URL: "http://upstream.tv", Err: &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}},
+			want: http.StatusGatewayTimeout,
+		},
+		{
+			name: "connection refused",
+			err:  &url.Error{Op: "Get", URL: "http://upstream.tv", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}},
+			want: http.StatusBadGateway,
+		},
+		{
+			name: "unknown host",
+			err:  &url.Error{Op: "Get", URL: "http://upstream.tv", Err: &net.DNSError{Err: "no such host", Name: "upstream.tv", IsNotFound: true}},
+			want: http.StatusBadGateway,
+		},
+		{
+			name: "client canceled",
+			err:  &url.Error{Op: "Get", URL: "http://upstream.tv", Err: context.Canceled},
+			want: statusClientClosedRequest,
+		},
+		{
+			name: "client canceled waiting for a slot",
+			err:  fmt.Errorf("upstream.tv: waiting for a request slot: %w", context.Canceled),
+			want: statusClientClosedRequest,
+		},
+		{
+			name: "internal",
+			err:  errors.New("unexpected"),
+			want: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamErrorStatus(tt.err); got != tt.want {
+				t.Errorf("upstreamErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchPlaylistErrorStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unauthorized.m3u":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/forbidden.m3u":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		source string
+		want   int
+	}{
+		{name: "unauthorized", source: upstream.URL + "/unauthorized.m3u", want: http.StatusForbidden},
+		{name: "forbidden", source: upstream.URL + "/forbidden.m3u", want: http.StatusForbidden},
+		{name: "not found", source: upstream.URL + "/missing.m3u", want: http.StatusInternalServerError},
+		{name: "unreachable", source: closedURL + "/playlist.m3u", want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := fetchPlaylist(upstream.Client(), &config.ProxyConfig{}, tt.source)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := upstreamErrorStatus(err); got != tt.want {
+				t.Errorf("upstreamErrorStatus(%v) = %d, want %d", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientErrorStatus(t *testing.T) {
+	c := newTestConfig(m3u.Track{Name: "Channel", URI: "http://upstream.tv/1.ts"})
+	c.ProtectPlaylist = true
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{name: "missing credentials", path: "/iptv.m3u", want: http.StatusUnauthorized},
+		{name: "wrong credentials", path: "/iptv.m3u?username=user&password=wrong", want: http.StatusUnauthorized},
+		{name: "credentials", path: "/iptv.m3u?username=user&password=pass", want: http.StatusOK},
+		{name: "unknown channel", path: c.proxyPath() + "/7/7.ts", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(c, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.want {
+				t.Errorf("GET %s status = %d, want %d", tt.path, w.Code, tt.want)
+			}
+		})
+	}
+
+	t.Run("wrong xtream app credentials", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/player_api.php", strings.NewReader("username=user&password=wrong"))
+		c.appAuthenticate(ctx)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("POST /player_api.php status = %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestCanceledRequestsSkipCircuitBreaker(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	defer func() {
+		circuitBreakersLock.Lock()
+		delete(circuitBreakers, u.Host)
+		circuitBreakersLock.Unlock()
+	}()
+
+	c := newTestConfig()
+	c.CircuitBreakerThreshold = 1
+	c.CircuitBreakerCooldown = time.Millisecond
+
+	canceled := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+		time.AfterFunc(10*time.Millisecond, cancel)
+		if _, err := c.upstreamHostDo(upstreamClient, req); !errors.Is(err, context.Canceled) {
+			t.Fatalf("canceled request error = %v, want %v", err, context.Canceled)
+		}
+	}
+
+	// a client going away doesn't open the circuit
+	canceled()
+	if !c.allowUpstream(u.Host) {
+		t.Fatal("the circuit is opened by a canceled request")
+	}
+
+	// a canceled probe lets the next request probe the upstream
+	c.reportUpstream(u.Host, false)
+	time.Sleep(2 * c.CircuitBreakerCooldown)
+	canceled()
+	if !c.allowUpstream(u.Host) {
+		t.Error("the circuit stays half-open after a canceled probe")
+	}
+}
+
+func TestUpstreamHeaderNotForwarded(t *testing.T) {
+	forwarded := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header
+	}))
+	defer upstream.Close()
+
+	c := newTestConfig()
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.Header.Set(upstreamHeader, "backup")
+	req.Header.Set("User-Agent", "player")
+	resp, err := c.upstreamDo(upstreamClient, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	header := <-forwarded
+	if v := header.Get(upstreamHeader); v != "" {
+		t.Errorf("%s = %q forwarded upstream", upstreamHeader, v)
+	}
+	if v := header.Get("User-Agent"); v != "player" {
+		t.Errorf("User-Agent = %q, want the one of the client", v)
+	}
+	if req.Header.Get(upstreamHeader) == "" {
+		t.Error("the request of the caller is modified")
+	}
+}
+
+func TestRefusedHostSlotKeepsCircuitProbe(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+	}{
+		{name: "speculative request to a busy host", ctx: func() (context.Context, context.CancelFunc) {
+			return withSpeculative(context.Background()), func() {}
+		}},
+		{name: "slot wait timing out", ctx: func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 10*time.Millisecond)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureHostLimit(1, nil)
+			defer configureHostLimit(0, nil)
+			defer func() {
+				circuitBreakersLock.Lock()
+				delete(circuitBreakers, u.Host)
+				circuitBreakersLock.Unlock()
+			}()
+
+			c := newTestConfig()
+			c.CircuitBreakerThreshold = 1
+			c.CircuitBreakerCooldown = time.Millisecond
+			c.reportUpstream(u.Host, false)
+			time.Sleep(2 * c.CircuitBreakerCooldown)
+
+			// the host is busy when the probe is allowed
+			slots := hostLimit(u.Host)
+			if !slots.tryAcquire() {
+				t.Fatal("no free host slot")
+			}
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+			if _, err := c.upstreamHostDo(upstreamClient, req); err == nil {
+				t.Fatal("request to a busy host sent")
+			}
+			slots.release()
+
+			req, _ = http.NewRequest(http.MethodGet, upstream.URL, nil)
+			resp, err := c.upstreamHostDo(upstreamClient, req)
+			if err != nil {
+				t.Fatalf("next request error = %v, want the upstream probed", err)
+			}
+			_ = resp.Body.Close()
+		})
+	}
+}
+
+func TestClientDisconnectCancelsUpstreamRequest(t *testing.T) {
+	canceled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(time.Second):
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	c := newTestConfig()
+	reqCtx, cancel := context.WithCancel(context.Background())
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/stream", nil).WithContext(reqCtx)
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := c.upstreamRequest(ctx, http.MethodGet, u); !errors.Is(err, context.Canceled) {
+		t.Fatalf("upstream request error = %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("the upstream request outlives the client")
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// urlBlacklist is the stream urls whose tracks are dropped from the playlist.
+type urlBlacklist struct {
+	exact    map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+// compileURLBlacklist compile the blacklisted urls, matched exactly,
+// or as a regular expression when written between slashes, e.g. /\.mkv$/.
+func compileURLBlacklist(entries []string) (*urlBlacklist, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	b := &urlBlacklist{exact: map[string]struct{}{}}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+			re, err := regexp.Compile(entry[1 : len(entry)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid url blacklist pattern %q: %w", entry, err)
+			}
+			b.patterns = append(b.patterns, re)
+			continue
+		}
+		if entry != "" {
+			b.exact[entry] = struct{}{}
+		}
+	}
+
+	return b, nil
+}
+
+// matches tell if the url is blacklisted.
+func (b *urlBlacklist) matches(uri string) bool {
+	if b == nil {
+		return false
+	}
+
+	if _, ok := b.exact[strings.TrimSpace(uri)]; ok {
+		return true
+	}
+	for _, re := range b.patterns {
+		if re.MatchString(uri) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,110 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// watchDebounce is the quiet period after the last change of the local playlist
+// before it is reloaded, a script regenerating it usually writes it in several times.
+const watchDebounce = 500 * time.Millisecond
+
+// watchPollInterval is the polling interval used when the local playlist can't be
+// watched and no refresh interval is configured.
+const watchPollInterval = 5 * time.Second
+
+// startPlaylistRefresh start the background refresh of the playlist: the periodic
+// refresh from the remote url and the watch of the local playlist file.
+func (c *Config) startPlaylistRefresh() {
+	source := c.RemoteURL.String()
+	if source == "" {
+		return
+	}
+
+	local := !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://")
+	if c.WatchPlaylistFile && local {
+		go c.watchPlaylistFile(source)
+		return
+	}
+
+	if c.PlaylistRefreshInterval > 0 {
+		go c.refreshLoop(c.PlaylistRefreshInterval)
+	}
+}
+
+// watchPlaylistFile reload the local playlist when it changes on disk, falling back
+// to polling it when it can't be watched.
+// The directory is watched rather than the file, to follow the files replaced by a rename.
+func (c *Config) watchPlaylistFile(path string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(path))
+		if err != nil {
+			_ = watcher.Close()
+		}
+	}
+	if err != nil {
+		interval := c.PlaylistRefreshInterval
+		if interval <= 0 {
+			interval = watchPollInterval
+		}
+		logger.Warnf("unable to watch the playlist file %q, polling it every %s: %s", path, interval, err)
+		c.refreshLoop(interval)
+		return
+	}
+	defer func() {
+		_ = watcher.Close()
+	}()
+
+	logger.Infof("watching the playlist file %q for changes", path)
+
+	name := filepath.Clean(path)
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != name || !event.Has(fsnotify.Write|fsnotify.Create) {
+				continue
+			}
+			debounce.Reset(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warnf("playlist file watch: %s", err)
+		case <-debounce.C:
+			logger.Infof("the playlist file %q changed, reloading it", path)
+			c.refreshPlaylistOnce("reload")
+		}
+	}
+}
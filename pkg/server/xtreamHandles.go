@@ -22,7 +22,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -32,6 +31,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
 	"github.com/romaxa55/iptv-proxy/pkg/m3u"
 	xtreamapi "github.com/romaxa55/iptv-proxy/pkg/xtream-proxy"
 	uuid "github.com/satori/go.uuid"
@@ -74,8 +74,30 @@ func (c *Config) cacheXtreamM3u(playlist *m3u.Playlist, cacheName string) error
 	return nil
 }
 
+// xtreamClient log in the xtream api, the following requests use the shared xtream api client.
+func (c *Config) xtreamClient(ctx *gin.Context) (*xtreamapi.Client, error) {
+	return c.newXtreamClient(ctx.Request.UserAgent())
+}
+
+// newXtreamClient log in the xtream server with the given user agent.
+func (c *Config) newXtreamClient(userAgent string) (*xtreamapi.Client, error) {
+	// the login is sent by the library default client, it is timed here
+	start := time.Now()
+	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, userAgent)
+	if u, perr := url.Parse(c.XtreamBaseURL); perr == nil {
+		observeUpstream(upstreamKindXtreamAPI, u.Host, start)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client.HTTP = xtreamAPIClient
+
+	return client, nil
+}
+
 func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Playlist, error) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+	client, err := c.xtreamClient(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -165,11 +187,11 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 	meta, ok := xtreamM3uCache[m3uURL.String()]
 	d := time.Since(meta.Time)
 	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
-		log.Printf("[iptv-proxy] %v | %s | xtream cache m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
+		logger.Infof("%s | xtream cache m3u file", ctx.ClientIP())
 		xtreamM3uCacheLock.RUnlock()
-		playlist, err := m3u.Parse(m3uURL.String())
+		playlist, err := fetchPlaylist(upstreamClient, c.ProxyConfig, m3uURL.String())
 		if err != nil {
-			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
 			return
 		}
 		if err := c.cacheXtreamM3u(&playlist, m3uURL.String()); err != nil {
@@ -180,7 +202,7 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 		xtreamM3uCacheLock.RUnlock()
 	}
 
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
+	ctx.Header("Content-Disposition", c.playlistDisposition())
 	xtreamM3uCacheLock.RLock()
 	path := xtreamM3uCache[m3uURL.String()].string
 	xtreamM3uCacheLock.RUnlock()
@@ -203,13 +225,19 @@ func (c *Config) xtreamApiGet(ctx *gin.Context) {
 	meta, ok := xtreamM3uCache[cacheName]
 	d := time.Since(meta.Time)
 	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
-		log.Printf("[iptv-proxy] %v | %s | xtream cache API m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
+		logger.Infof("%s | xtream cache API m3u file", ctx.ClientIP())
 		xtreamM3uCacheLock.RUnlock()
 		playlist, err := c.xtreamGenerateM3u(ctx, extension)
+		if err != nil && c.XtreamFallbackToM3U {
+			setXtreamFallback(true, err)
+			c.xtreamGet(ctx)
+			return
+		}
 		if err != nil {
 			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
+		setXtreamFallback(false, nil)
 		if err := c.cacheXtreamM3u(playlist, cacheName); err != nil {
 			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
@@ -218,7 +246,7 @@ func (c *Config) xtreamApiGet(ctx *gin.Context) {
 		xtreamM3uCacheLock.RUnlock()
 	}
 
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
+	ctx.Header("Content-Disposition", c.playlistDisposition())
 	xtreamM3uCacheLock.RLock()
 	path := xtreamM3uCache[cacheName].string
 	xtreamM3uCacheLock.RUnlock()
@@ -254,7 +282,7 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 		action = q["action"][0]
 	}
 
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+	client, err := c.xtreamClient(ctx)
 	if err != nil {
 		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -266,7 +294,7 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 		return
 	}
 
-	log.Printf("[iptv-proxy] %v | %s |Action\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
+	logger.Infof("%s |Action\t%s", ctx.ClientIP(), action)
 
 	if err != nil {
 		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
@@ -277,7 +305,7 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 }
 
 func (c *Config) xtreamXMLTV(ctx *gin.Context) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+	client, err := c.xtreamClient(ctx)
 	if err != nil {
 		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -442,6 +470,7 @@ func getHlsRedirectURL(channel string) (*url.URL, error) {
 
 func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 	client := &http.Client{
+		Transport: upstreamClient.Transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
@@ -455,9 +484,9 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 
 	mergeHttpHeader(req.Header, ctx.Request.Header)
 
-	resp, err := client.Do(req)
+	resp, err := c.upstreamDo(client, withSelectedUpstream(ctx, req))
 	if err != nil {
-		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
 		return
 	}
 	defer func(Body io.ReadCloser) {
@@ -484,16 +513,16 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 
 			mergeHttpHeader(hlsReq.Header, ctx.Request.Header)
 
-			hlsResp, err := client.Do(hlsReq)
+			hlsResp, err := c.upstreamDo(client, withSelectedUpstream(ctx, hlsReq))
 			if err != nil {
-				_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+				_ = ctx.AbortWithError(upstreamErrorStatus(err), err) // nolint: errcheck
 				return
 			}
 			defer func(Body io.ReadCloser) {
 				_ = Body.Close()
 			}(hlsResp.Body)
 
-			b, err := io.ReadAll(hlsResp.Body)
+			b, err := c.readUpstreamBody(hlsResp)
 			if err != nil {
 				_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 				return
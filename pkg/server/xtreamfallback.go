@@ -0,0 +1,41 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/romaxa55/iptv-proxy/pkg/logger"
+)
+
+// xtreamFallback is set while the playlist is served from the get.php m3u because the xtream API fails.
+var xtreamFallback int32
+
+// setXtreamFallback switch between the xtream API and the get.php m3u, logging the switches.
+func setXtreamFallback(active bool, err error) {
+	if active {
+		if atomic.CompareAndSwapInt32(&xtreamFallback, 0, 1) {
+			logger.Warnf("xtream API failed, falling back to the get.php m3u: %s", err)
+		}
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&xtreamFallback, 1, 0) {
+		logger.Infof("xtream API is back, the playlist is generated from it again")
+	}
+}